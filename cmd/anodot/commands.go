@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/anodot/anodot-common/pkg/metrics"
+	"github.com/anodot/anodot-common/pkg/metrics3"
+)
+
+func (a *app) flagSet(name string, usage string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(a.stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(a.stderr, "Usage: anodot %s\n", usage)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+func (a *app) submit(args []string) error {
+	flags := a.flagSet("submit", "submit [flags] [file|-]")
+	protocol := flags.String("protocol", "20", "metrics protocol, 20 or 30")
+	format := flags.String("format", "", "input format: json, ndjson or csv, guessed from file extension by default")
+	schemaId := flags.String("schema", "", "schema id of 3.0 metrics which do not specify one")
+	monitoring := flags.Bool("monitoring", false, "submit 2.0 metrics as monitoring metrics")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 1 {
+		return errors.New("submit accepts at most one input file")
+	}
+
+	path := flags.Arg(0)
+	f, err := inputFormat(*format, path)
+	if err != nil {
+		return err
+	}
+	in, err := openInput(path, a.stdin)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	switch strings.TrimPrefix(*protocol, "v") {
+	case "20", "2", "2.0":
+		return a.submit20(in, f, *monitoring)
+	case "30", "3", "3.0":
+		return a.submit30(in, f, *schemaId)
+	default:
+		return fmt.Errorf("unsupported protocol %q, should be 20 or 30", *protocol)
+	}
+}
+
+func (a *app) submit20(in io.Reader, format string, monitoring bool) error {
+	batch, err := readMetrics20(in, format)
+	if err != nil {
+		return err
+	}
+	client, err := a.client20()
+	if err != nil {
+		return err
+	}
+
+	var resp metrics.AnodotResponse
+	if monitoring {
+		resp, err = client.SubmitMonitoringMetrics(batch)
+	} else {
+		resp, err = client.SubmitMetrics(batch)
+	}
+
+	result := metrics.NewSubmitResult(batch, resp, err)
+	for _, r := range result.Rejected {
+		fmt.Fprintf(a.stderr, "rejected metric %d %v: %s\n", r.Index, r.Metric.Properties, r.Reason)
+	}
+	return a.summary(len(result.Accepted), len(result.Rejected), len(result.Undelivered), result.Err)
+}
+
+func (a *app) submit30(in io.Reader, format string, schemaId string) error {
+	batch, err := readMetrics30(in, format, schemaId)
+	if err != nil {
+		return err
+	}
+	client, err := a.client30()
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.SubmitMetrics(batch)
+
+	result := metrics3.NewSubmitResult(batch, resp, err)
+	for _, r := range result.Rejected {
+		fmt.Fprintf(a.stderr, "rejected metric %d %v: %s\n", r.Index, r.Metric.Dimensions, r.Reason)
+	}
+	return a.summary(len(result.Accepted), len(result.Rejected), len(result.Undelivered), result.Err)
+}
+
+func (a *app) summary(accepted, rejected, undelivered int, err error) error {
+	fmt.Fprintf(a.stdout, "accepted %d, rejected %d, undelivered %d metrics\n", accepted, rejected, undelivered)
+	if err != nil {
+		return err
+	}
+	if rejected > 0 {
+		return fmt.Errorf("%d metrics rejected", rejected)
+	}
+	return nil
+}
+
+// expressionsFlag collects delete expressions given as [type:]key=value.
+type expressionsFlag []metrics.DeleteExpression
+
+func (e *expressionsFlag) String() string {
+	parts := make([]string, len(*e))
+	for i, expr := range *e {
+		parts[i] = expr.Type + ":" + expr.Key + "=" + expr.Value
+	}
+	return strings.Join(parts, ",")
+}
+
+func (e *expressionsFlag) Set(s string) error {
+	eq := strings.Index(s, "=")
+	if eq <= 0 {
+		return fmt.Errorf("expression %q should be [type:]key=value", s)
+	}
+
+	expr := metrics.DeleteExpression{Type: "property", Key: s[:eq], Value: s[eq+1:]}
+	if colon := strings.Index(expr.Key, ":"); colon >= 0 {
+		expr.Type, expr.Key = expr.Key[:colon], expr.Key[colon+1:]
+	}
+	if expr.Type == "" || expr.Key == "" {
+		return fmt.Errorf("expression %q should be [type:]key=value", s)
+	}
+
+	*e = append(*e, expr)
+	return nil
+}
+
+func (a *app) delete(args []string) error {
+	flags := a.flagSet("delete", "delete -expr [type:]key=value...")
+	var expressions expressionsFlag
+	flags.Var(&expressions, "expr", "filter of deleted metrics as [type:]key=value, type defaults to property; may be repeated")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if len(expressions) == 0 {
+		return errors.New("at least one -expr should be given")
+	}
+
+	client, err := a.client20()
+	if err != nil {
+		return err
+	}
+	resp, err := client.DeleteMetrics(expressions...)
+	if err != nil {
+		return err
+	}
+	if d, ok := resp.(*metrics.DeleteResponse); ok && d.ID != "" {
+		fmt.Fprintf(a.stdout, "delete job %s started\n", d.ID)
+	}
+	return nil
+}
+
+func (a *app) schemas(args []string) error {
+	const usage = "schemas list | create [file|-] | delete <id>"
+	if len(args) == 0 {
+		return fmt.Errorf("usage: anodot %s", usage)
+	}
+
+	client, err := a.client30()
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "list":
+		resp, err := client.GetSchemas()
+		if err != nil {
+			return err
+		}
+		return a.printJSON(resp.Schemas)
+	case "create":
+		if len(args) > 2 {
+			return fmt.Errorf("usage: anodot %s", usage)
+		}
+		var path string
+		if len(args) == 2 {
+			path = args[1]
+		}
+		in, err := openInput(path, a.stdin)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+
+		var schema metrics3.AnodotMetricsSchema
+		if err := json.NewDecoder(in).Decode(&schema); err != nil {
+			return fmt.Errorf("failed to parse schema: %w", err)
+		}
+		resp, err := client.CreateSchema(schema)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(a.stdout, *resp.SchemaId)
+		return nil
+	case "delete":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: anodot %s", usage)
+		}
+		_, err := client.DeleteSchema(args[1])
+		return err
+	default:
+		return fmt.Errorf("unknown schemas command %q, usage: anodot %s", args[0], usage)
+	}
+}
+
+func (a *app) watermark(args []string) error {
+	flags := a.flagSet("watermark", "watermark -schema <id> [-time <time>]")
+	schemaId := flags.String("schema", "", "schema id")
+	at := flags.String("time", "", "watermark as unix seconds or RFC 3339 time, now by default")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *schemaId == "" {
+		return errors.New("-schema should be given")
+	}
+
+	t, err := parseTimestamp(*at)
+	if err != nil {
+		return err
+	}
+	client, err := a.client30()
+	if err != nil {
+		return err
+	}
+	_, err = client.SubmitWatermark(*schemaId, metrics3.AnodotTimestamp{Time: t})
+	return err
+}
+
+func (a *app) bc(args []string) error {
+	flags := a.flagSet("bc", "bc [file|-]")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 1 {
+		return errors.New("bc accepts at most one input file")
+	}
+
+	in, err := openInput(flags.Arg(0), a.stdin)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var pipeline metrics3.Pipeline
+	if err := json.NewDecoder(in).Decode(&pipeline); err != nil {
+		return fmt.Errorf("failed to parse pipeline: %w", err)
+	}
+
+	client, err := a.client30()
+	if err != nil {
+		return err
+	}
+	_, err = client.SendToBC(pipeline)
+	return err
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anodot/anodot-common/pkg/metrics"
+	"github.com/anodot/anodot-common/pkg/metrics3"
+)
+
+// Input formats. JSON input is either an array or a stream of objects, NDJSON included.
+//
+// CSV input has a header row. Column "timestamp" holds unix seconds or RFC 3339 time, now if missing.
+// Columns prefixed with "tag." are tags. For 2.0 metrics column "value" is the metric value and
+// other columns are properties. For 3.0 metrics column "schemaId" is the schema, columns prefixed
+// with "measurement." are measurements and other columns are dimensions.
+const (
+	formatJSON = "json"
+	formatCSV  = "csv"
+)
+
+// inputFormat returns format given by flag, or guessed from file extension.
+func inputFormat(format string, path string) (string, error) {
+	switch strings.ToLower(format) {
+	case "json", "ndjson", "jsonl":
+		return formatJSON, nil
+	case "csv":
+		return formatCSV, nil
+	case "":
+		if strings.EqualFold(filepath.Ext(path), ".csv") {
+			return formatCSV, nil
+		}
+		return formatJSON, nil
+	default:
+		return "", fmt.Errorf("unsupported input format %q", format)
+	}
+}
+
+// openInput opens file at path, or stdin if path is empty or "-".
+func openInput(path string, stdin io.Reader) (io.ReadCloser, error) {
+	if path == "" || path == "-" {
+		return ioutil.NopCloser(stdin), nil
+	}
+	return os.Open(path)
+}
+
+// readJSON calls add for every element of JSON array or every value of JSON stream.
+func readJSON(r io.Reader, add func(json.RawMessage) error) error {
+	br := bufio.NewReader(r)
+	for {
+		b, err := br.Peek(1)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if b[0] == ' ' || b[0] == '\t' || b[0] == '\r' || b[0] == '\n' {
+			_, _ = br.ReadByte()
+			continue
+		}
+		break
+	}
+
+	dec := json.NewDecoder(br)
+	first, _ := br.Peek(1)
+	if first[0] == '[' {
+		var items []json.RawMessage
+		if err := dec.Decode(&items); err != nil {
+			return fmt.Errorf("failed to parse JSON input: %w", err)
+		}
+		for _, item := range items {
+			if err := add(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for n := 1; ; n++ {
+		var item json.RawMessage
+		err := dec.Decode(&item)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to parse JSON value %d: %w", n, err)
+		}
+		if err := add(item); err != nil {
+			return err
+		}
+	}
+}
+
+// readCSV calls add for every row after the header, keyed by header columns.
+func readCSV(r io.Reader, add func(row map[string]string) error) error {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read CSV header: %w", err)
+	}
+
+	for n := 1; ; n++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read CSV: %w", err)
+		}
+
+		row := make(map[string]string, len(header))
+		for i, column := range header {
+			row[strings.TrimSpace(column)] = record[i]
+		}
+		if err := add(row); err != nil {
+			return fmt.Errorf("CSV row %d: %w", n, err)
+		}
+	}
+}
+
+// parseTimestamp parses unix seconds or RFC 3339 time, empty string means now.
+func parseTimestamp(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Now(), nil
+	}
+	if seconds, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q, should be unix seconds or RFC 3339", s)
+	}
+	return t, nil
+}
+
+func readMetrics20(r io.Reader, format string) ([]metrics.Anodot20Metric, error) {
+	var result []metrics.Anodot20Metric
+
+	if format == formatCSV {
+		err := readCSV(r, func(row map[string]string) error {
+			m := metrics.Anodot20Metric{Properties: make(map[string]string), Tags: make(map[string]string)}
+			for column, v := range row {
+				switch {
+				case column == "timestamp":
+					t, err := parseTimestamp(v)
+					if err != nil {
+						return err
+					}
+					m.Timestamp = metrics.AnodotTimestamp{Time: t}
+				case column == "value":
+					value, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+					if err != nil {
+						return fmt.Errorf("invalid value %q", v)
+					}
+					m.Value = value
+				case strings.HasPrefix(column, "tag."):
+					m.Tags[strings.TrimPrefix(column, "tag.")] = v
+				default:
+					m.Properties[column] = v
+				}
+			}
+			if m.Timestamp.IsZero() {
+				m.Timestamp = metrics.AnodotTimestamp{Time: time.Now()}
+			}
+			result = append(result, m)
+			return nil
+		})
+		return result, err
+	}
+
+	err := readJSON(r, func(item json.RawMessage) error {
+		var m metrics.Anodot20Metric
+		if err := json.Unmarshal(item, &m); err != nil {
+			return fmt.Errorf("failed to parse metric %d: %w", len(result), err)
+		}
+		if m.Timestamp.IsZero() {
+			m.Timestamp = metrics.AnodotTimestamp{Time: time.Now()}
+		}
+		result = append(result, m)
+		return nil
+	})
+	return result, err
+}
+
+// readMetrics30 reads 3.0 metrics, schemaId is used for metrics which do not specify one.
+func readMetrics30(r io.Reader, format string, schemaId string) ([]metrics3.AnodotMetrics30, error) {
+	var result []metrics3.AnodotMetrics30
+
+	add := func(m metrics3.AnodotMetrics30) error {
+		if m.SchemaId == "" {
+			m.SchemaId = schemaId
+		}
+		if m.SchemaId == "" {
+			return fmt.Errorf("metric %d has no schema id, use -schema flag", len(result))
+		}
+		if m.Timestamp.IsZero() {
+			m.Timestamp = metrics3.AnodotTimestamp{Time: time.Now()}
+		}
+		result = append(result, m)
+		return nil
+	}
+
+	if format == formatCSV {
+		err := readCSV(r, func(row map[string]string) error {
+			m := metrics3.AnodotMetrics30{Dimensions: make(map[string]string), Measurements: make(map[string]float64)}
+			for column, v := range row {
+				switch {
+				case column == "timestamp":
+					t, err := parseTimestamp(v)
+					if err != nil {
+						return err
+					}
+					m.Timestamp = metrics3.AnodotTimestamp{Time: t}
+				case column == "schemaId":
+					m.SchemaId = strings.TrimSpace(v)
+				case strings.HasPrefix(column, "measurement."):
+					value, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+					if err != nil {
+						return fmt.Errorf("invalid value %q of %s", v, column)
+					}
+					m.Measurements[strings.TrimPrefix(column, "measurement.")] = value
+				case strings.HasPrefix(column, "tag."):
+					if m.Tags == nil {
+						m.Tags = make(map[string][]string)
+					}
+					m.Tags[strings.TrimPrefix(column, "tag.")] = []string{v}
+				default:
+					m.Dimensions[column] = v
+				}
+			}
+			return add(m)
+		})
+		return result, err
+	}
+
+	err := readJSON(r, func(item json.RawMessage) error {
+		var m metrics3.AnodotMetrics30
+		if err := json.Unmarshal(item, &m); err != nil {
+			return fmt.Errorf("failed to parse metric %d: %w", len(result), err)
+		}
+		return add(m)
+	})
+	return result, err
+}
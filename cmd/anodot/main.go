@@ -0,0 +1,196 @@
+// Command anodot performs routine Anodot operations: submitting and deleting metrics,
+// managing 3.0 schemas, sending watermarks and pushing BC pipeline status.
+//
+// Credentials are taken from flags, then ANODOT_URL, ANODOT_TOKEN and ANODOT_ACCESS_KEY
+// environment variables, then the JSON config file given by -config or ANODOT_CONFIG,
+// ~/.anodot.json by default:
+//
+//	{"url": "https://app.anodot.com", "token": "data-collection-token", "accessKey": "access-key"}
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/anodot/anodot-common/pkg/metrics"
+	"github.com/anodot/anodot-common/pkg/metrics3"
+)
+
+const usage = `Usage: anodot [global flags] <command> [flags] [args]
+
+Commands:
+  submit      submit 2.0 or 3.0 metrics from JSON, NDJSON or CSV file or stdin
+  delete      delete 2.0 metrics matching expressions
+  schemas     list, create or delete 3.0 schemas
+  watermark   send 3.0 watermark of a schema
+  bc          push BC pipeline status
+
+Global flags:
+`
+
+// Config holds Anodot credentials.
+type Config struct {
+	URL       string `json:"url"`
+	Token     string `json:"token"`
+	AccessKey string `json:"accessKey"`
+}
+
+type app struct {
+	config Config
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("anodot", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		flags.PrintDefaults()
+	}
+
+	var cfg Config
+	configPath := flags.String("config", "", "path of JSON config file, defaults to ANODOT_CONFIG or ~/.anodot.json")
+	flags.StringVar(&cfg.URL, "url", "", "Anodot URL, e.g. https://app.anodot.com")
+	flags.StringVar(&cfg.Token, "token", "", "data collection token")
+	flags.StringVar(&cfg.AccessKey, "access-key", "", "access key used to obtain bearer token")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	cfg, err := loadConfig(cfg, *configPath)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	a := &app{config: cfg, stdin: stdin, stdout: stdout, stderr: stderr}
+
+	var cmd func([]string) error
+	switch flags.Arg(0) {
+	case "submit":
+		cmd = a.submit
+	case "delete":
+		cmd = a.delete
+	case "schemas":
+		cmd = a.schemas
+	case "watermark":
+		cmd = a.watermark
+	case "bc":
+		cmd = a.bc
+	default:
+		fmt.Fprintf(stderr, "unknown command %q\n", flags.Arg(0))
+		flags.Usage()
+		return 2
+	}
+
+	if err := cmd(flags.Args()[1:]); err != nil {
+		if err != flag.ErrHelp {
+			fmt.Fprintln(stderr, err)
+		}
+		return 1
+	}
+	return 0
+}
+
+// loadConfig fills settings missing in flags from environment and config file.
+func loadConfig(cfg Config, path string) (Config, error) {
+	env := Config{URL: os.Getenv("ANODOT_URL"), Token: os.Getenv("ANODOT_TOKEN"), AccessKey: os.Getenv("ANODOT_ACCESS_KEY")}
+	cfg = merge(cfg, env)
+
+	if path == "" {
+		path = os.Getenv("ANODOT_CONFIG")
+	}
+	explicit := path != ""
+	if !explicit {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return cfg, nil
+		}
+		path = filepath.Join(home, ".anodot.json")
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !explicit && os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return cfg, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	var file Config
+	if err := json.Unmarshal(data, &file); err != nil {
+		return cfg, fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+	return merge(cfg, file), nil
+}
+
+// merge returns cfg with empty settings taken from fallback.
+func merge(cfg Config, fallback Config) Config {
+	if cfg.URL == "" {
+		cfg.URL = fallback.URL
+	}
+	if cfg.Token == "" {
+		cfg.Token = fallback.Token
+	}
+	if cfg.AccessKey == "" {
+		cfg.AccessKey = fallback.AccessKey
+	}
+	return cfg
+}
+
+func (a *app) serverURL() (*url.URL, error) {
+	if a.config.URL == "" {
+		return nil, errors.New("anodot url is not set, use -url, ANODOT_URL or config file")
+	}
+	return url.Parse(a.config.URL)
+}
+
+func (a *app) client20() (*metrics.Anodot20Client, error) {
+	u, err := a.serverURL()
+	if err != nil {
+		return nil, err
+	}
+	return metrics.NewAnodot20Client(*u, a.config.Token, nil)
+}
+
+// client30 creates 3.0 client. Data collection token or access key may be missing,
+// depending on which APIs are used.
+func (a *app) client30() (*metrics3.Anodot30Client, error) {
+	u, err := a.serverURL()
+	if err != nil {
+		return nil, err
+	}
+
+	var token, accessKey *string
+	if a.config.Token != "" {
+		token = &a.config.Token
+	}
+	if a.config.AccessKey != "" {
+		accessKey = &a.config.AccessKey
+	}
+	return metrics3.NewAnodot30Client(*u, accessKey, token, nil)
+}
+
+// printJSON writes v to stdout as indented JSON.
+func (a *app) printJSON(v interface{}) error {
+	enc := json.NewEncoder(a.stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
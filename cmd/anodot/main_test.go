@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/anodot/anodot-common/pkg/anodottest"
+)
+
+func TestCommands(t *testing.T) {
+	srv := anodottest.NewServer()
+	defer srv.Close()
+
+	global := []string{"-url", srv.URL().String(), "-token", anodottest.DataToken, "-access-key", anodottest.AccessKey}
+	anodot := func(stdin string, args ...string) (string, int) {
+		var stdout, stderr bytes.Buffer
+		code := run(append(global, args...), strings.NewReader(stdin), &stdout, &stderr)
+		if code != 0 {
+			t.Logf("anodot %v: %s", args, stderr.String())
+		}
+		return stdout.String(), code
+	}
+
+	csv := "timestamp,value,what,target_type,tag.env\n1600000000,1,requests,counter,prod\n,2,latency,gauge,prod\n"
+	if _, code := anodot(csv, "submit", "-format", "csv"); code != 0 {
+		t.Fatalf("submit 2.0 failed with %d", code)
+	}
+	if m := srv.Metrics(); len(m) != 2 || m[0].Timestamp != 1600000000 || m[1].Value != 2 {
+		t.Fatalf("unexpected 2.0 metrics %+v", m)
+	}
+
+	out, code := anodot(`{"name": "requests", "dimensions": ["host"], "measurements": {"count": {"aggregation": "sum", "countBy": "none"}}}`, "schemas", "create")
+	if code != 0 {
+		t.Fatalf("schemas create failed with %d", code)
+	}
+	schemaId := strings.TrimSpace(out)
+
+	ndjson := `{"dimensions": {"host": "a"}, "measurements": {"count": 1}, "timestamp": 1600000000}
+{"dimensions": {"host": "b"}, "measurements": {"count": 2}}`
+	if _, code := anodot(ndjson, "submit", "-protocol", "30", "-schema", schemaId); code != 0 {
+		t.Fatalf("submit 3.0 failed with %d", code)
+	}
+	if m := srv.Metrics30(); len(m) != 2 || m[0].SchemaId != schemaId {
+		t.Fatalf("unexpected 3.0 metrics %+v", m)
+	}
+
+	if _, code := anodot("", "watermark", "-schema", schemaId, "-time", "1600000300"); code != 0 {
+		t.Fatalf("watermark failed with %d", code)
+	}
+	if w := srv.Watermarks(schemaId); len(w) != 1 || w[0] != 1600000300 {
+		t.Fatalf("unexpected watermarks %v", w)
+	}
+
+	if out, code := anodot("", "schemas", "list"); code != 0 || !strings.Contains(out, schemaId) {
+		t.Fatalf("schemas list failed with %d: %s", code, out)
+	}
+	if _, code := anodot("", "schemas", "delete", schemaId); code != 0 {
+		t.Fatalf("schemas delete failed with %d", code)
+	}
+
+	if _, code := anodot("", "delete", "-expr", "what=requests", "-expr", "property:target_type=counter"); code != 0 {
+		t.Fatalf("delete failed with %d", code)
+	}
+
+	if _, code := anodot(`{"pipeline_id": "p1", "status": "RUNNING", "created": "2020-09-13T12:26:40Z"}`, "bc"); code != 0 {
+		t.Fatalf("bc failed with %d", code)
+	}
+	if p := srv.Pipelines(); len(p) != 1 {
+		t.Fatalf("expected 1 pipeline, got %d", len(p))
+	}
+
+	// metric without what is rejected
+	if out, code := anodot(`[{"properties": {"target_type": "gauge"}, "value": 1}]`, "submit"); code != 1 || !strings.Contains(out, "rejected 1") {
+		t.Fatalf("expected rejected metric, got %d: %s", code, out)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "anodot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(path, []byte(`{"url": "http://file", "token": "file-token", "accessKey": "file-key"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("ANODOT_TOKEN", "env-token")
+	defer os.Unsetenv("ANODOT_TOKEN")
+
+	cfg, err := loadConfig(Config{URL: "http://flag"}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.URL != "http://flag" || cfg.Token != "env-token" || cfg.AccessKey != "file-key" {
+		t.Errorf("unexpected config %+v", cfg)
+	}
+
+	if _, err := loadConfig(Config{}, filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("expected error for missing config file")
+	}
+}
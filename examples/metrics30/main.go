@@ -49,7 +49,7 @@ var metrics metrics3.AnodotMetrics30 = metrics3.AnodotMetrics30{
 			"value1", "value2",
 		},
 	},
-	Timestamp: metrics3.AnodotTimestamp{time.Now()},
+	Timestamp: metrics3.AnodotTimestamp{Time: time.Now()},
 }
 
 func main() {
@@ -61,48 +61,48 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	respCreate, err := client.CreateSchema(schema)
+	// Creates schema, or returns existing one with the same name
+	ensured, err := client.EnsureSchema(schema)
 	if err != nil {
 		panic(err)
 	}
 
-	if respCreate.HasErrors() {
-		fmt.Println(respCreate.ErrorMessage())
-
+	for _, d := range ensured.Differences {
+		fmt.Println("existing schema differs:", d)
 	}
+	schemaId = ensured.Schema.Id
+
+	// Set schema id for metrics
+	metrics.SchemaId = schemaId
 
-	respGetschemas, err := client.GetSchemas()
+	// Writer sends metrics in batches and submits watermark once hourly bucket is closed
+	writer, err := metrics3.NewMetricsWriter(client, metrics3.WriterOptions{
+		Intervals: map[string]time.Duration{schemaId: time.Hour},
+		OnResult: func(r metrics3.WriterResult) {
+			if r.Err != nil {
+				fmt.Println(r.Err)
+			}
+		},
+	})
 	if err != nil {
 		panic(err)
 	}
 
-	if respGetschemas.HasErrors() {
-		fmt.Println(respGetschemas.ErrorMessage())
-	}
-
-	for _, s := range respGetschemas.Schemas {
-		if s.Name == "schema_test" {
-			schemaId = s.Id
-			break
-		}
-	}
-
-	// Set schema id for metrics
-	metrics.SchemaId = schemaId
-
-	respSubmit, err := client.SubmitMetrics([]metrics3.AnodotMetrics30{metrics})
+	err = writer.Write(metrics)
 	if err != nil {
 		panic(err)
 	}
 
-	if respSubmit.HasErrors() {
-		fmt.Println(respSubmit.ErrorMessage())
+	err = writer.Close()
+	if err != nil {
+		panic(err)
 	}
 
-	// Get next hour to close data bucket: https://docs.anodot.com/#send-stream-watermark
-	nextHour := time.Now().Add(time.Hour).Round(time.Hour)
+	// Writer closes the bucket only after its hour has passed. Get next hour to close
+	// data bucket right away: https://docs.anodot.com/#send-stream-watermark
+	nextHour := metrics.Timestamp.Add(time.Hour).Truncate(time.Hour)
 
-	respWatermark, err := client.SubmitWatermark(schemaId, metrics3.AnodotTimestamp{nextHour})
+	respWatermark, err := client.SubmitWatermark(schemaId, metrics3.AnodotTimestamp{Time: nextHour})
 	if err != nil {
 		panic(err)
 	}
@@ -111,8 +111,8 @@ func main() {
 		fmt.Println(respWatermark.ErrorMessage())
 	}
 
-	respDeleteSchema, err := client.DeleteSchema(schemaId)
-	if respDeleteSchema.HasErrors() {
-		fmt.Println(respDeleteSchema.ErrorMessage())
+	_, err = client.DeleteSchema(schemaId)
+	if err != nil {
+		fmt.Println(err)
 	}
 }
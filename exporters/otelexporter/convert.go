@@ -0,0 +1,121 @@
+package otelexporter
+
+import (
+	"math"
+	"time"
+
+	"github.com/anodot/anodot-common/pkg/metrics3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// convert turns data points of the instrument into records without schema id, and returns
+// measurements the records use. Data points with NaN or infinite values are skipped.
+func convert(m metricdata.Metrics, resourceDims map[string]string) ([]metrics3.AnodotMetrics30, map[string]metrics3.MeasurmentBase) {
+	measurement := func(aggregation string) metrics3.MeasurmentBase {
+		return metrics3.MeasurmentBase{Aggregation: aggregation, CountBy: "none", Units: m.Unit}
+	}
+
+	switch data := m.Data.(type) {
+	case metricdata.Gauge[int64]:
+		return valuePoints(data.DataPoints, resourceDims), valueMeasurement(measurement(aggregationAverage))
+	case metricdata.Gauge[float64]:
+		return valuePoints(data.DataPoints, resourceDims), valueMeasurement(measurement(aggregationAverage))
+	case metricdata.Sum[int64]:
+		return valuePoints(data.DataPoints, resourceDims), valueMeasurement(measurement(sumAggregation(data.IsMonotonic, data.Temporality)))
+	case metricdata.Sum[float64]:
+		return valuePoints(data.DataPoints, resourceDims), valueMeasurement(measurement(sumAggregation(data.IsMonotonic, data.Temporality)))
+	case metricdata.Histogram[int64]:
+		return histogramPoints(data.DataPoints, resourceDims), histogramMeasurements(measurement(aggregationSum))
+	case metricdata.Histogram[float64]:
+		return histogramPoints(data.DataPoints, resourceDims), histogramMeasurements(measurement(aggregationSum))
+	case metricdata.ExponentialHistogram[int64]:
+		return exponentialHistogramPoints(data.DataPoints, resourceDims), histogramMeasurements(measurement(aggregationSum))
+	case metricdata.ExponentialHistogram[float64]:
+		return exponentialHistogramPoints(data.DataPoints, resourceDims), histogramMeasurements(measurement(aggregationSum))
+	case metricdata.Summary:
+		var records []metrics3.AnodotMetrics30
+		for _, dp := range data.DataPoints {
+			records = appendRecord(records, dp.Attributes, resourceDims, dp.Time, map[string]float64{
+				MeasurementCount: float64(dp.Count),
+				MeasurementSum:   dp.Sum,
+			})
+		}
+		return records, histogramMeasurements(measurement(aggregationSum))
+	}
+
+	return nil, nil
+}
+
+// sumAggregation returns "sum" for delta monotonic sums. Cumulative and non-monotonic sums
+// are current totals, so they are averaged like gauges.
+func sumAggregation(monotonic bool, temporality metricdata.Temporality) string {
+	if monotonic && temporality == metricdata.DeltaTemporality {
+		return aggregationSum
+	}
+	return aggregationAverage
+}
+
+func valueMeasurement(m metrics3.MeasurmentBase) map[string]metrics3.MeasurmentBase {
+	return map[string]metrics3.MeasurmentBase{MeasurementValue: m}
+}
+
+func histogramMeasurements(m metrics3.MeasurmentBase) map[string]metrics3.MeasurmentBase {
+	return map[string]metrics3.MeasurmentBase{MeasurementCount: m, MeasurementSum: m}
+}
+
+func valuePoints[N int64 | float64](points []metricdata.DataPoint[N], resourceDims map[string]string) []metrics3.AnodotMetrics30 {
+	var records []metrics3.AnodotMetrics30
+	for _, dp := range points {
+		records = appendRecord(records, dp.Attributes, resourceDims, dp.Time, map[string]float64{MeasurementValue: float64(dp.Value)})
+	}
+	return records
+}
+
+func histogramPoints[N int64 | float64](points []metricdata.HistogramDataPoint[N], resourceDims map[string]string) []metrics3.AnodotMetrics30 {
+	var records []metrics3.AnodotMetrics30
+	for _, dp := range points {
+		records = appendRecord(records, dp.Attributes, resourceDims, dp.Time, map[string]float64{
+			MeasurementCount: float64(dp.Count),
+			MeasurementSum:   float64(dp.Sum),
+		})
+	}
+	return records
+}
+
+func exponentialHistogramPoints[N int64 | float64](points []metricdata.ExponentialHistogramDataPoint[N], resourceDims map[string]string) []metrics3.AnodotMetrics30 {
+	var records []metrics3.AnodotMetrics30
+	for _, dp := range points {
+		records = appendRecord(records, dp.Attributes, resourceDims, dp.Time, map[string]float64{
+			MeasurementCount: float64(dp.Count),
+			MeasurementSum:   float64(dp.Sum),
+		})
+	}
+	return records
+}
+
+func appendRecord(records []metrics3.AnodotMetrics30, attrs attribute.Set, resourceDims map[string]string, t time.Time, measurements map[string]float64) []metrics3.AnodotMetrics30 {
+	for _, v := range measurements {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return records
+		}
+	}
+
+	dims := make(map[string]string, len(resourceDims)+attrs.Len())
+	for k, v := range resourceDims {
+		dims[k] = v
+	}
+	iter := attrs.Iter()
+	for iter.Next() {
+		kv := iter.Attribute()
+		if v := kv.Value.Emit(); v != "" {
+			dims[dimensionName(string(kv.Key))] = v
+		}
+	}
+
+	return append(records, metrics3.AnodotMetrics30{
+		Timestamp:    metrics3.AnodotTimestamp{Time: t},
+		Dimensions:   dims,
+		Measurements: measurements,
+	})
+}
@@ -0,0 +1,329 @@
+// Package otelexporter implements OpenTelemetry metrics exporter which sends metric data to
+// Anodot as Anodot 3.0 metrics.
+//
+// Every instrument gets its own schema named SchemaPrefix + instrument name. Selected resource
+// attributes and data point attributes become dimensions, and instrument data becomes measurements:
+// "value" for sums and gauges, "count" and "sum" for histograms. Schemas are created on first
+// export and evolved when new attributes appear, see metrics3.SchemaRegistry.Evolve.
+// Dimension names are attribute keys with dots replaced by underscores.
+//
+// If the update of a schema is refused as breaking, e.g. because the instrument kind changed, the
+// error is returned by Export once and the schema is not updated again. Data points of the instrument
+// are then sent with the dimensions of the existing schema and the measurements it defines with
+// the same aggregation, other measurements are dropped.
+//
+// It is kept in a separate module, so that the OpenTelemetry SDK is not required by anodot-common.
+package otelexporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anodot/anodot-common/pkg/metrics3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// Measurement names used in derived schemas.
+const (
+	MeasurementValue = "value"
+	MeasurementCount = "count"
+	MeasurementSum   = "sum"
+)
+
+const (
+	aggregationSum     = "sum"
+	aggregationAverage = "average"
+)
+
+// DefaultResourceAttributes are resource attributes used as dimensions when Options.ResourceAttributes is nil.
+var DefaultResourceAttributes = []string{"service.name", "service.namespace", "service.instance.id", "host.name"}
+
+type Options struct {
+	// Prefix of schema names.
+	SchemaPrefix string
+	// Resource attributes used as dimensions. Defaults to DefaultResourceAttributes.
+	ResourceAttributes []string
+	// Bucket interval of the schemas. When set, watermark aligned to the interval is sent
+	// for every schema after export, once the bucket is closed. Watermarks are not sent when zero.
+	WatermarkInterval time.Duration
+	// Time to wait after the end of a bucket before its watermark is sent.
+	WatermarkDelay time.Duration
+}
+
+type instrument struct {
+	schema    metrics3.AnodotMetricsSchema
+	watermark time.Time
+	// Set once the schema update was refused as breaking.
+	breaking *metrics3.BreakingChangeError
+}
+
+// Exporter implements metric.Exporter of OpenTelemetry SDK.
+type Exporter struct {
+	client *metrics3.Anodot30Client
+	opts   Options
+	now    func() time.Time
+
+	mu          sync.Mutex
+	instruments map[string]*instrument
+	shutdown    bool
+}
+
+var _ metric.Exporter = (*Exporter)(nil)
+
+// Constructs new Exporter sending metrics with the client.
+func New(client *metrics3.Anodot30Client, opts Options) (*Exporter, error) {
+	if client == nil {
+		return nil, errors.New("anodot client should not be nil")
+	}
+	if opts.ResourceAttributes == nil {
+		opts.ResourceAttributes = DefaultResourceAttributes
+	}
+	if opts.WatermarkInterval < 0 || opts.WatermarkDelay < 0 {
+		return nil, errors.New("watermark interval and delay should not be negative")
+	}
+
+	return &Exporter{client: client, opts: opts, now: time.Now, instruments: make(map[string]*instrument)}, nil
+}
+
+// Temporality returns delta temporality for counters and histograms, so that their values are summed
+// in Anodot buckets, and cumulative temporality for up-down counters and gauges.
+func (e *Exporter) Temporality(kind metric.InstrumentKind) metricdata.Temporality {
+	switch kind {
+	case metric.InstrumentKindCounter, metric.InstrumentKindObservableCounter, metric.InstrumentKindHistogram:
+		return metricdata.DeltaTemporality
+	}
+	return metricdata.CumulativeTemporality
+}
+
+func (e *Exporter) Aggregation(kind metric.InstrumentKind) metric.Aggregation {
+	return metric.DefaultAggregationSelector(kind)
+}
+
+// Export sends data points of all instruments, creating or evolving their schemas first.
+func (e *Exporter) Export(ctx context.Context, rm *metricdata.ResourceMetrics) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.shutdown {
+		return errors.New("exporter is shut down")
+	}
+
+	resourceDims := make(map[string]string)
+	if rm.Resource != nil {
+		for _, key := range e.opts.ResourceAttributes {
+			if v, ok := rm.Resource.Set().Value(attribute.Key(key)); ok && v.Emit() != "" {
+				resourceDims[dimensionName(key)] = v.Emit()
+			}
+		}
+	}
+
+	var errs []string
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if err := e.export(ctx, m, resourceDims); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", m.Name, err))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New("anodot export failed: " + strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (e *Exporter) export(ctx context.Context, m metricdata.Metrics, resourceDims map[string]string) error {
+	records, measurements := convert(m, resourceDims)
+	if len(records) == 0 {
+		return nil
+	}
+
+	// breaking change error is returned only by the first failed update, after the data is sent
+	inst, schemaErr := e.ensureSchema(ctx, m.Name, records, measurements)
+	if inst == nil {
+		return schemaErr
+	}
+	if inst.breaking != nil {
+		if records = compatibleRecords(inst.schema, records, measurements); len(records) == 0 {
+			return schemaErr
+		}
+	}
+
+	for i := range records {
+		records[i].SchemaId = inst.schema.Id
+	}
+	if _, err := e.client.SubmitMetricsContext(ctx, records); err != nil {
+		return err
+	}
+
+	if e.opts.WatermarkInterval > 0 {
+		wm := e.now().Add(-e.opts.WatermarkDelay).Truncate(e.opts.WatermarkInterval)
+		if wm.After(inst.watermark) {
+			if _, err := e.client.SubmitWatermarkContext(ctx, inst.schema.Id, metrics3.AnodotTimestamp{Time: wm}); err != nil {
+				return err
+			}
+			inst.watermark = wm
+		}
+	}
+
+	return schemaErr
+}
+
+// ensureSchema returns schema of the instrument, creating it or adding new dimensions and measurements of the records.
+// If the update is refused as breaking, the instrument is returned together with *metrics3.BreakingChangeError.
+func (e *Exporter) ensureSchema(ctx context.Context, name string, records []metrics3.AnodotMetrics30, measurements map[string]metrics3.MeasurmentBase) (*instrument, error) {
+	inst, ok := e.instruments[name]
+	if ok && inst.breaking != nil {
+		return inst, nil
+	}
+
+	desired := metrics3.AnodotMetricsSchema{
+		Name:             e.opts.SchemaPrefix + name,
+		Measurements:     map[string]metrics3.MeasurmentBase{},
+		MissingDimPolicy: &metrics3.DimensionPolicy{Action: metrics3.MissingDimFill, Fill: metrics3.DefaultDimensionFill},
+	}
+	if ok {
+		desired.Dimensions = inst.schema.Dimensions
+		for k, v := range inst.schema.Measurements {
+			desired.Measurements[k] = v
+		}
+	}
+
+	changed := mergeSchema(&desired, records, measurements)
+	if ok && !changed {
+		return inst, nil
+	}
+
+	if !ok {
+		res, err := e.client.EnsureSchemaContext(ctx, desired)
+		if err != nil {
+			return nil, err
+		}
+		inst = &instrument{schema: res.Schema}
+		e.instruments[name] = inst
+
+		// keep dimensions and measurements of the existing schema, so that the update is additive
+		existing := res.Schema
+		desired.Dimensions = append(append([]string(nil), existing.Dimensions...), desired.Dimensions...)
+		for k, v := range existing.Measurements {
+			if _, ok := desired.Measurements[k]; !ok {
+				desired.Measurements[k] = v
+			}
+		}
+		desired.Dimensions = unique(desired.Dimensions)
+		if res.Created || len(metrics3.DiffSchemas(existing, desired)) == 0 {
+			return inst, nil
+		}
+	}
+
+	res, err := e.client.Schemas().Evolve(ctx, desired)
+	if errors.As(err, &inst.breaking) {
+		return inst, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	inst.schema = res.Schema
+	return inst, nil
+}
+
+// compatibleRecords returns records with dimensions of the schema and measurements which the schema
+// defines with the same aggregation. Records left without measurements are dropped.
+func compatibleRecords(schema metrics3.AnodotMetricsSchema, records []metrics3.AnodotMetrics30, measurements map[string]metrics3.MeasurmentBase) []metrics3.AnodotMetrics30 {
+	dimensions := make(map[string]bool, len(schema.Dimensions))
+	for _, d := range schema.Dimensions {
+		dimensions[d] = true
+	}
+
+	var result []metrics3.AnodotMetrics30
+	for _, r := range records {
+		values := make(map[string]float64, len(r.Measurements))
+		for k, v := range r.Measurements {
+			existing, ok := schema.Measurements[k]
+			if ok && existing.Aggregation == measurements[k].Aggregation && existing.CountBy == measurements[k].CountBy {
+				values[k] = v
+			}
+		}
+		if len(values) == 0 {
+			continue
+		}
+
+		dims := make(map[string]string, len(r.Dimensions))
+		for k, v := range r.Dimensions {
+			if dimensions[k] {
+				dims[k] = v
+			}
+		}
+		r.Dimensions, r.Measurements = dims, values
+		result = append(result, r)
+	}
+	return result
+}
+
+// mergeSchema adds dimensions and measurements of the records to the schema and reports whether it was changed.
+func mergeSchema(schema *metrics3.AnodotMetricsSchema, records []metrics3.AnodotMetrics30, measurements map[string]metrics3.MeasurmentBase) bool {
+	changed := false
+
+	known := make(map[string]bool, len(schema.Dimensions))
+	for _, d := range schema.Dimensions {
+		known[d] = true
+	}
+	var added []string
+	for _, r := range records {
+		for d := range r.Dimensions {
+			if !known[d] {
+				known[d] = true
+				added = append(added, d)
+			}
+		}
+	}
+	if len(added) > 0 {
+		sort.Strings(added)
+		schema.Dimensions = append(append([]string(nil), schema.Dimensions...), added...)
+		changed = true
+	}
+
+	for k, v := range measurements {
+		if existing, ok := schema.Measurements[k]; !ok || existing != v {
+			schema.Measurements[k] = v
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+func unique(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	result := values[:0]
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// ForceFlush does nothing, data is sent synchronously by Export.
+func (e *Exporter) ForceFlush(ctx context.Context) error {
+	return ctx.Err()
+}
+
+func (e *Exporter) Shutdown(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.shutdown = true
+	return ctx.Err()
+}
+
+func dimensionName(key string) string {
+	return strings.ReplaceAll(key, ".", "_")
+}
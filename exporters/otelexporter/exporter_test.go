@@ -0,0 +1,166 @@
+package otelexporter
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anodot/anodot-common/pkg/anodottest"
+	"github.com/anodot/anodot-common/pkg/metrics3"
+	"go.opentelemetry.io/otel/attribute"
+	otelmetric "go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+func schemaByName(srv *anodottest.Server, name string) (metrics3.AnodotMetricsSchema, bool) {
+	for _, s := range srv.Schemas() {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return metrics3.AnodotMetricsSchema{}, false
+}
+
+func TestExporter(t *testing.T) {
+	srv := anodottest.NewServer()
+	defer srv.Close()
+
+	accessKey, dataToken := anodottest.AccessKey, anodottest.DataToken
+	client, err := metrics3.NewAnodot30Client(*srv.URL(), &accessKey, &dataToken, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp, err := New(client, Options{SchemaPrefix: "app_", WatermarkInterval: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	provider := metric.NewMeterProvider(
+		metric.WithReader(metric.NewPeriodicReader(exp, metric.WithInterval(time.Hour))),
+		metric.WithResource(resource.NewSchemaless(attribute.String("service.name", "checkout"), attribute.String("os.type", "linux"))),
+	)
+	meter := provider.Meter("test")
+
+	requests, _ := meter.Int64Counter("requests", otelmetric.WithUnit("1"))
+	latency, _ := meter.Float64Histogram("latency", otelmetric.WithUnit("ms"))
+
+	requests.Add(ctx, 3, otelmetric.WithAttributes(attribute.String("http.method", "GET")))
+	latency.Record(ctx, 10)
+	latency.Record(ctx, 30)
+	if err := provider.ForceFlush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	schema, ok := schemaByName(srv, "app_requests")
+	if !ok {
+		t.Fatalf("requests schema was not created: %+v", srv.Schemas())
+	}
+	if len(schema.Dimensions) != 2 || schema.Dimensions[0] != "http_method" || schema.Dimensions[1] != "service_name" {
+		t.Fatalf("unexpected dimensions %v", schema.Dimensions)
+	}
+	if m := schema.Measurements[MeasurementValue]; m.Aggregation != "sum" || m.Units != "1" {
+		t.Fatalf("unexpected measurement %+v", m)
+	}
+	if _, ok := schemaByName(srv, "app_latency"); !ok {
+		t.Fatal("latency schema was not created")
+	}
+
+	var sum, count float64
+	for _, m := range srv.Metrics30() {
+		if m.SchemaId == schema.Id {
+			sum += m.Measurements[MeasurementValue]
+			if m.Dimensions["service_name"] != "checkout" {
+				t.Fatalf("unexpected dimensions %v", m.Dimensions)
+			}
+		} else {
+			count += m.Measurements[MeasurementCount]
+		}
+	}
+	if sum != 3 || count != 2 {
+		t.Fatalf("expected 3 requests and 2 latency records, got %v and %v", sum, count)
+	}
+	if len(srv.Watermarks(schema.Id)) != 1 {
+		t.Fatalf("expected watermark for requests schema")
+	}
+
+	// new attribute evolves the schema
+	requests.Add(ctx, 1, otelmetric.WithAttributes(attribute.String("http.method", "POST"), attribute.String("region", "eu")))
+	if err := provider.ForceFlush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	schema, _ = schemaByName(srv, "app_requests")
+	if len(schema.Dimensions) != 3 || schema.Dimensions[2] != "region" || schema.Version != "1" {
+		t.Fatalf("expected schema to be evolved, got %+v", schema)
+	}
+
+	if err := provider.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExporterBreakingChange(t *testing.T) {
+	srv := anodottest.NewServer()
+	defer srv.Close()
+
+	accessKey, dataToken := anodottest.AccessKey, anodottest.DataToken
+	client, err := metrics3.NewAnodot30Client(*srv.URL(), &accessKey, &dataToken, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// existing schema averages the sum, which can't be changed to summing without breaking it
+	created, err := client.CreateSchema(metrics3.AnodotMetricsSchema{
+		Name:       "app_latency",
+		Dimensions: []string{"service_name"},
+		Measurements: map[string]metrics3.MeasurmentBase{
+			MeasurementCount: {Aggregation: "sum", CountBy: "none", Units: "ms"},
+			MeasurementSum:   {Aggregation: "average", CountBy: "none", Units: "ms"},
+		},
+		MissingDimPolicy: &metrics3.DimensionPolicy{Action: metrics3.MissingDimFill, Fill: metrics3.DefaultDimensionFill},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	schemaId := *created.SchemaId
+
+	exp, err := New(client, Options{SchemaPrefix: "app_"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	provider := metric.NewMeterProvider(
+		metric.WithReader(metric.NewPeriodicReader(exp, metric.WithInterval(time.Hour))),
+		metric.WithResource(resource.NewSchemaless(attribute.String("service.name", "checkout"))),
+	)
+	defer provider.Shutdown(ctx)
+	latency, _ := provider.Meter("test").Float64Histogram("latency", otelmetric.WithUnit("ms"))
+
+	latency.Record(ctx, 10, otelmetric.WithAttributes(attribute.String("http.method", "GET")))
+	if err := provider.ForceFlush(ctx); err == nil || !strings.Contains(err.Error(), "breaking changes") {
+		t.Fatalf("expected breaking change error, got %v", err)
+	}
+
+	latency.Record(ctx, 30, otelmetric.WithAttributes(attribute.String("http.method", "GET")))
+	if err := provider.ForceFlush(ctx); err != nil {
+		t.Fatalf("breaking change should be reported once, got %v", err)
+	}
+
+	if n := srv.Requests("/api/v2/stream-schemas/" + schemaId); n != 1 {
+		t.Fatalf("expected single schema update attempt, got %d", n)
+	}
+	metrics := srv.Metrics30()
+	if len(metrics) != 2 {
+		t.Fatalf("expected records to be sent with existing schema, got %+v", metrics)
+	}
+	for _, m := range metrics {
+		_, hasSum := m.Measurements[MeasurementSum]
+		if m.SchemaId != schemaId || m.Measurements[MeasurementCount] != 1 || hasSum || len(m.Dimensions) != 1 {
+			t.Fatalf("expected only compatible measurements and dimensions, got %+v", m)
+		}
+	}
+}
@@ -0,0 +1,673 @@
+// Package anodottest provides in-process fake Anodot server for testing code which uses
+// metrics and metrics3 clients.
+//
+// The server keeps submitted metrics, watermarks, schemas and pipelines in memory,
+// validates payloads the same way Anodot does and allows to inject failures:
+//
+//	srv := anodottest.NewServer()
+//	defer srv.Close()
+//
+//	client, _ := metrics.NewAnodot20Client(*srv.URL(), anodottest.DataToken, nil)
+package anodottest
+
+import (
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anodot/anodot-common/pkg/metrics3"
+)
+
+const (
+	// Data collection token accepted by the server.
+	DataToken = "test-data-token"
+	// Access key accepted by the server for bearer token refresh.
+	AccessKey = "test-access-key"
+)
+
+// Error codes reported by the server for rejected records.
+const (
+	ErrCodeMissingWhat       = 1001
+	ErrCodeInvalidTargetType = 1002
+	ErrCodeInvalidTimestamp  = 1003
+	ErrCodeUnknownSchema     = 2001
+	ErrCodeMissingDimension  = 2002
+	ErrCodeUnknownDimension  = 2003
+	ErrCodeUnknownMeasure    = 2004
+)
+
+// Metric20 is Anodot 2.0 metric as received by the server.
+type Metric20 struct {
+	Properties map[string]string `json:"properties"`
+	Timestamp  int64             `json:"timestamp"`
+	Value      float64           `json:"value"`
+	Tags       map[string]string `json:"tags"`
+}
+
+// Metric30 is Anodot 3.0 metric as received by the server.
+type Metric30 struct {
+	SchemaId     string              `json:"schemaId"`
+	Timestamp    int64               `json:"timestamp"`
+	Dimensions   map[string]string   `json:"dimensions"`
+	Measurements map[string]float64  `json:"measurements"`
+	Tags         map[string][]string `json:"tags"`
+}
+
+// Failure is injected response returned instead of handling the request.
+type Failure struct {
+	Status int
+	Body   string
+	Header http.Header
+	// Number of requests to fail. Zero or negative fails every request until ClearFailures is called.
+	Count int
+}
+
+type recordError struct {
+	Description string `json:"description"`
+	Error       int64  `json:"error"`
+	Index       string `json:"index"`
+}
+
+// Server is fake Anodot server. All methods are safe for concurrent use.
+type Server struct {
+	srv *httptest.Server
+
+	mu           sync.Mutex
+	metrics      []Metric20
+	monitoring   []Metric20
+	metrics30    []Metric30
+	watermarks   map[string][]int64
+	schemas      map[string]metrics3.AnodotMetricsSchema
+	pipelines    []json.RawMessage
+	bearerTokens map[string]time.Time
+	bearerTTL    time.Duration
+	failures     map[string][]*Failure
+	requests     map[string]int
+	sequence     int
+}
+
+// Starts new fake server. Close should be called to shut it down.
+func NewServer() *Server {
+	s := &Server{
+		watermarks:   make(map[string][]int64),
+		schemas:      make(map[string]metrics3.AnodotMetricsSchema),
+		bearerTokens: make(map[string]time.Time),
+		failures:     make(map[string][]*Failure),
+		requests:     make(map[string]int),
+	}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+func (s *Server) URL() *url.URL {
+	u, _ := url.Parse(s.srv.URL)
+	return u
+}
+
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// InjectFailure makes requests with the given path, e.g. "/api/v1/metrics", fail.
+// Failures for the same path are applied in the order they were injected.
+func (s *Server) InjectFailure(path string, f Failure) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[path] = append(s.failures[path], &f)
+}
+
+func (s *Server) ClearFailures() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = make(map[string][]*Failure)
+}
+
+// Requests returns number of requests received for the path, including failed ones.
+func (s *Server) Requests(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[path]
+}
+
+// ExpireBearerTokens invalidates all issued bearer tokens.
+func (s *Server) ExpireBearerTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bearerTokens = make(map[string]time.Time)
+}
+
+// SetBearerTokenTTL makes the server issue JWT bearer tokens which expire after ttl.
+// Zero ttl, the default, issues opaque tokens which never expire.
+func (s *Server) SetBearerTokenTTL(ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bearerTTL = ttl
+}
+
+// Metrics returns accepted Anodot 2.0 metrics.
+func (s *Server) Metrics() []Metric20 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Metric20(nil), s.metrics...)
+}
+
+// MonitoringMetrics returns accepted Anodot 2.0 monitoring metrics.
+func (s *Server) MonitoringMetrics() []Metric20 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Metric20(nil), s.monitoring...)
+}
+
+// Metrics30 returns accepted Anodot 3.0 metrics.
+func (s *Server) Metrics30() []Metric30 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Metric30(nil), s.metrics30...)
+}
+
+// Watermarks returns watermarks received for the schema as unix timestamps.
+func (s *Server) Watermarks(schemaId string) []int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int64(nil), s.watermarks[schemaId]...)
+}
+
+func (s *Server) Schemas() []metrics3.AnodotMetricsSchema {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	schemas := make([]metrics3.AnodotMetricsSchema, 0, len(s.schemas))
+	for _, schema := range s.schemas {
+		schemas = append(schemas, schema)
+	}
+	return schemas
+}
+
+// Pipelines returns raw JSON of pipelines received by BC endpoint.
+func (s *Server) Pipelines() []json.RawMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]json.RawMessage(nil), s.pipelines...)
+}
+
+func (s *Server) nextId(prefix string) string {
+	s.sequence++
+	return prefix + strconv.Itoa(s.sequence)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	p := "/" + strings.TrimLeft(r.URL.Path, "/")
+
+	s.mu.Lock()
+	s.requests[p]++
+	var failure *Failure
+	if fs := s.failures[p]; len(fs) > 0 {
+		failure = fs[0]
+		if failure.Count > 0 {
+			failure.Count--
+			if failure.Count == 0 {
+				s.failures[p] = fs[1:]
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	if failure != nil {
+		for k, v := range failure.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(failure.Status)
+		_, _ = w.Write([]byte(failure.Body))
+		return
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, 0, err.Error())
+		return
+	}
+
+	switch {
+	case p == "/api/v1/metrics" && r.Method == http.MethodPost:
+		if !s.checkDataToken(w, r) {
+			return
+		}
+		if r.URL.Query().Get("protocol") == "anodot30" {
+			s.submitMetrics30(w, r, body)
+		} else {
+			s.submitMetrics20(w, r, body, false)
+		}
+	case p == "/api/v1/metrics" && r.Method == http.MethodDelete:
+		if s.checkDataToken(w, r) {
+			s.deleteMetrics(w, r, body)
+		}
+	case p == "/api/v1/agents" && r.Method == http.MethodPost:
+		if s.checkDataToken(w, r) {
+			s.submitMetrics20(w, r, body, true)
+		}
+	case p == "/api/v1/metrics/watermark" && r.Method == http.MethodPost:
+		if s.checkDataToken(w, r) {
+			s.submitWatermark(w, r, body)
+		}
+	case p == "/api/v2/access-token" && r.Method == http.MethodPost:
+		s.refreshToken(w, r, body)
+	case p == "/api/v2/stream-schemas" && r.Method == http.MethodPost:
+		if s.checkBearer(w, r) {
+			s.createSchema(w, r, body)
+		}
+	case p == "/api/v2/stream-schemas/schemas" && r.Method == http.MethodGet:
+		if s.checkBearer(w, r) {
+			s.getSchemas(w)
+		}
+	case strings.HasPrefix(p, "/api/v2/stream-schemas/") && r.Method == http.MethodGet:
+		if s.checkBearer(w, r) {
+			s.getSchema(w, r, strings.TrimPrefix(p, "/api/v2/stream-schemas/"))
+		}
+	case strings.HasPrefix(p, "/api/v2/stream-schemas/") && r.Method == http.MethodPut:
+		if s.checkBearer(w, r) {
+			s.updateSchema(w, r, strings.TrimPrefix(p, "/api/v2/stream-schemas/"), body)
+		}
+	case strings.HasPrefix(p, "/api/v2/stream-schemas/") && r.Method == http.MethodDelete:
+		if s.checkBearer(w, r) {
+			s.deleteSchema(w, r, strings.TrimPrefix(p, "/api/v2/stream-schemas/"))
+		}
+	case p == "/api/v2/bc/agents" && r.Method == http.MethodPost:
+		if s.checkBearer(w, r) {
+			s.sendToBC(w, r, body)
+		}
+	default:
+		writeError(w, r, http.StatusNotFound, 0, "not found")
+	}
+}
+
+// readBody reads request body, decompressing gzip encoded one.
+func readBody(r *http.Request) ([]byte, error) {
+	switch encoding := r.Header.Get("Content-Encoding"); encoding {
+	case "":
+		return ioutil.ReadAll(r.Body)
+	case "gzip":
+		gr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		return ioutil.ReadAll(gr)
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeError responds with Anodot 3.0 error body.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code int, message string) {
+	writeJSON(w, status, map[string]interface{}{
+		"status":        status,
+		"name":          http.StatusText(status),
+		"message":       message,
+		"andtErrorCode": code,
+		"path":          r.URL.Path,
+	})
+}
+
+func (s *Server) checkDataToken(w http.ResponseWriter, r *http.Request) bool {
+	if r.URL.Query().Get("token") != DataToken {
+		writeError(w, r, http.StatusUnauthorized, 0, "invalid data collection token")
+		return false
+	}
+	return true
+}
+
+func (s *Server) checkBearer(w http.ResponseWriter, r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	s.mu.Lock()
+	expires, valid := s.bearerTokens[token]
+	s.mu.Unlock()
+	if valid && !expires.IsZero() && time.Now().After(expires) {
+		valid = false
+	}
+
+	if !valid {
+		writeError(w, r, http.StatusUnauthorized, 0, "invalid bearer token")
+	}
+	return valid
+}
+
+func (s *Server) refreshToken(w http.ResponseWriter, r *http.Request, body []byte) {
+	req := struct {
+		RefreshToken string `json:"refreshToken"`
+	}{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeError(w, r, http.StatusBadRequest, 0, err.Error())
+		return
+	}
+	if req.RefreshToken != AccessKey {
+		writeError(w, r, http.StatusUnauthorized, 0, "invalid access key")
+		return
+	}
+
+	s.mu.Lock()
+	token := s.nextId("bearer-")
+	var expires time.Time
+	if s.bearerTTL > 0 {
+		expires = time.Now().Add(s.bearerTTL)
+		claims, _ := json.Marshal(map[string]interface{}{"sub": token, "exp": expires.Unix()})
+		token = "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString(claims) + ".sig"
+	}
+	s.bearerTokens[token] = expires
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]string{"token": token})
+}
+
+func validateMetric20(m Metric20) (int64, string) {
+	if strings.TrimSpace(m.Properties["what"]) == "" {
+		return ErrCodeMissingWhat, "missing 'what' property"
+	}
+	if tt := m.Properties["target_type"]; tt != "gauge" && tt != "counter" {
+		return ErrCodeInvalidTargetType, fmt.Sprintf("invalid target_type %q", tt)
+	}
+	if m.Timestamp <= 0 {
+		return ErrCodeInvalidTimestamp, "invalid timestamp"
+	}
+	return 0, ""
+}
+
+func (s *Server) submitMetrics20(w http.ResponseWriter, r *http.Request, body []byte, monitoring bool) {
+	var metrics []Metric20
+	if err := json.Unmarshal(body, &metrics); err != nil {
+		writeError(w, r, http.StatusBadRequest, 0, err.Error())
+		return
+	}
+
+	errs := make([]recordError, 0)
+	accepted := make([]Metric20, 0, len(metrics))
+	for i, m := range metrics {
+		if code, description := validateMetric20(m); code != 0 {
+			errs = append(errs, recordError{Description: description, Error: code, Index: strconv.Itoa(i)})
+			continue
+		}
+		accepted = append(accepted, m)
+	}
+
+	s.mu.Lock()
+	if monitoring {
+		s.monitoring = append(s.monitoring, accepted...)
+	} else {
+		s.metrics = append(s.metrics, accepted...)
+	}
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"errors": errs})
+}
+
+// validateMetric30 must be called with s.mu held.
+func (s *Server) validateMetric30(m Metric30) (int64, string) {
+	schema, ok := s.schemas[m.SchemaId]
+	if !ok {
+		return ErrCodeUnknownSchema, fmt.Sprintf("unknown schema %q", m.SchemaId)
+	}
+	if m.Timestamp <= 0 {
+		return ErrCodeInvalidTimestamp, "invalid timestamp"
+	}
+
+	dims := make(map[string]bool, len(schema.Dimensions))
+	for _, d := range schema.Dimensions {
+		dims[d] = true
+		if _, ok := m.Dimensions[d]; !ok && (schema.MissingDimPolicy == nil || schema.MissingDimPolicy.Action == "fail") {
+			return ErrCodeMissingDimension, fmt.Sprintf("missing dimension %q", d)
+		}
+	}
+	for d := range m.Dimensions {
+		if !dims[d] {
+			return ErrCodeUnknownDimension, fmt.Sprintf("unknown dimension %q", d)
+		}
+	}
+	for name := range m.Measurements {
+		if _, ok := schema.Measurements[name]; !ok {
+			return ErrCodeUnknownMeasure, fmt.Sprintf("unknown measurement %q", name)
+		}
+	}
+	return 0, ""
+}
+
+func (s *Server) submitMetrics30(w http.ResponseWriter, r *http.Request, body []byte) {
+	var metrics []Metric30
+	if err := json.Unmarshal(body, &metrics); err != nil {
+		writeError(w, r, http.StatusBadRequest, 0, err.Error())
+		return
+	}
+
+	errs := make([]recordError, 0)
+
+	s.mu.Lock()
+	for i, m := range metrics {
+		if code, description := s.validateMetric30(m); code != 0 {
+			errs = append(errs, recordError{Description: description, Error: code, Index: strconv.Itoa(i)})
+			continue
+		}
+		s.metrics30 = append(s.metrics30, m)
+	}
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"errors": errs})
+}
+
+func (s *Server) deleteMetrics(w http.ResponseWriter, r *http.Request, body []byte) {
+	req := struct {
+		Expression []struct {
+			Type  string `json:"type"`
+			Key   string `json:"key"`
+			Value string `json:"value"`
+		} `json:"expression"`
+	}{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeError(w, r, http.StatusBadRequest, 0, err.Error())
+		return
+	}
+
+	type failure struct {
+		ID      int    `json:"id"`
+		Message string `json:"message"`
+	}
+	failures := make([]failure, 0)
+	if len(req.Expression) == 0 {
+		failures = append(failures, failure{1, "expression should not be empty"})
+	}
+	for _, e := range req.Expression {
+		if e.Type != "property" {
+			failures = append(failures, failure{2, fmt.Sprintf("unsupported expression type %q", e.Type)})
+		}
+		if e.Key == "" {
+			failures = append(failures, failure{3, "expression key should not be empty"})
+		}
+	}
+
+	s.mu.Lock()
+	id := s.nextId("delete-")
+	if len(failures) == 0 {
+		kept := s.metrics[:0]
+		for _, m := range s.metrics {
+			matched := true
+			for _, e := range req.Expression {
+				if ok, _ := path.Match(e.Value, m.Properties[e.Key]); !ok {
+					matched = false
+					break
+				}
+			}
+			if !matched {
+				kept = append(kept, m)
+			}
+		}
+		s.metrics = kept
+	}
+	s.mu.Unlock()
+
+	resp := map[string]interface{}{
+		"id": id,
+		"validation": map[string]interface{}{
+			"passed":   len(failures) == 0,
+			"failures": failures,
+		},
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) submitWatermark(w http.ResponseWriter, r *http.Request, body []byte) {
+	req := struct {
+		SchemaId  string `json:"schemaId"`
+		Watermark int64  `json:"watermark"`
+	}{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeError(w, r, http.StatusBadRequest, 0, err.Error())
+		return
+	}
+
+	errs := make([]recordError, 0)
+
+	s.mu.Lock()
+	if _, ok := s.schemas[req.SchemaId]; !ok {
+		errs = append(errs, recordError{Description: fmt.Sprintf("unknown schema %q", req.SchemaId), Error: ErrCodeUnknownSchema, Index: "0"})
+	} else if req.Watermark <= 0 {
+		errs = append(errs, recordError{Description: "invalid watermark", Error: ErrCodeInvalidTimestamp, Index: "0"})
+	} else {
+		s.watermarks[req.SchemaId] = append(s.watermarks[req.SchemaId], req.Watermark)
+	}
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"errors": errs})
+}
+
+func (s *Server) createSchema(w http.ResponseWriter, r *http.Request, body []byte) {
+	var schema metrics3.AnodotMetricsSchema
+	if err := json.Unmarshal(body, &schema); err != nil {
+		writeError(w, r, http.StatusBadRequest, 0, err.Error())
+		return
+	}
+	if schema.Name == "" || len(schema.Measurements) == 0 {
+		writeError(w, r, http.StatusBadRequest, 0, "schema should have name and at least one measurement")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.schemas {
+		if existing.Name == schema.Name {
+			writeError(w, r, http.StatusBadRequest, 0, fmt.Sprintf("schema with name %q already exists", schema.Name))
+			return
+		}
+	}
+
+	schema.Id = s.nextId("schema-")
+	s.schemas[schema.Id] = schema
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"schema": schema})
+}
+
+func (s *Server) getSchemas(w http.ResponseWriter) {
+	s.mu.Lock()
+	wrappers := make([]metrics3.StreamSchemaWrapper, 0, len(s.schemas))
+	for _, schema := range s.schemas {
+		wrapper := metrics3.StreamSchemaWrapper{}
+		wrapper.Wrapper.Schema = schema
+		wrappers = append(wrappers, wrapper)
+	}
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, wrappers)
+}
+
+func (s *Server) getSchema(w http.ResponseWriter, r *http.Request, id string) {
+	s.mu.Lock()
+	schema, ok := s.schemas[id]
+	s.mu.Unlock()
+
+	if !ok {
+		writeError(w, r, http.StatusNotFound, 0, fmt.Sprintf("schema %q not found", id))
+		return
+	}
+
+	wrapper := metrics3.StreamSchemaWrapper{}
+	wrapper.Wrapper.Schema = schema
+	writeJSON(w, http.StatusOK, wrapper)
+}
+
+func (s *Server) updateSchema(w http.ResponseWriter, r *http.Request, id string, body []byte) {
+	var schema metrics3.AnodotMetricsSchema
+	if err := json.Unmarshal(body, &schema); err != nil {
+		writeError(w, r, http.StatusBadRequest, 0, err.Error())
+		return
+	}
+	if schema.Name == "" || len(schema.Measurements) == 0 {
+		writeError(w, r, http.StatusBadRequest, 0, "schema should have name and at least one measurement")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.schemas[id]; !ok {
+		writeError(w, r, http.StatusNotFound, 0, fmt.Sprintf("schema %q not found", id))
+		return
+	}
+	for _, existing := range s.schemas {
+		if existing.Name == schema.Name && existing.Id != id {
+			writeError(w, r, http.StatusBadRequest, 0, fmt.Sprintf("schema with name %q already exists", schema.Name))
+			return
+		}
+	}
+
+	schema.Id = id
+	s.schemas[id] = schema
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"schema": schema})
+}
+
+func (s *Server) deleteSchema(w http.ResponseWriter, r *http.Request, id string) {
+	s.mu.Lock()
+	_, ok := s.schemas[id]
+	delete(s.schemas, id)
+	s.mu.Unlock()
+
+	if !ok {
+		writeError(w, r, http.StatusNotFound, 0, fmt.Sprintf("schema %q not found", id))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"deleted": id})
+}
+
+func (s *Server) sendToBC(w http.ResponseWriter, r *http.Request, body []byte) {
+	pipeline := struct {
+		Id string `json:"pipeline_id"`
+	}{}
+	if err := json.Unmarshal(body, &pipeline); err != nil {
+		writeError(w, r, http.StatusBadRequest, 0, err.Error())
+		return
+	}
+	if pipeline.Id == "" {
+		writeError(w, r, http.StatusBadRequest, 0, "pipeline_id should not be empty")
+		return
+	}
+
+	s.mu.Lock()
+	s.pipelines = append(s.pipelines, json.RawMessage(body))
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{})
+}
@@ -0,0 +1,444 @@
+package anodottest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anodot/anodot-common/pkg/apierror"
+	"github.com/anodot/anodot-common/pkg/chunk"
+	"github.com/anodot/anodot-common/pkg/compression"
+	"github.com/anodot/anodot-common/pkg/credentials"
+	"github.com/anodot/anodot-common/pkg/metrics"
+	"github.com/anodot/anodot-common/pkg/metrics3"
+	"github.com/anodot/anodot-common/pkg/ratelimit"
+	"github.com/anodot/anodot-common/pkg/retry"
+)
+
+var testSchema = metrics3.AnodotMetricsSchema{
+	Name:       "requests",
+	Dimensions: []string{"host"},
+	Measurements: map[string]metrics3.MeasurmentBase{
+		"count": {Aggregation: "sum", CountBy: "none"},
+	},
+}
+
+func TestMetrics20(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	client, err := metrics.NewAnodot20Client(*srv.URL(), DataToken, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := metrics.AnodotTimestamp{Time: time.Now()}
+	_, err = client.SubmitMetrics([]metrics.Anodot20Metric{
+		{Properties: map[string]string{"what": "requests", "target_type": "counter", "host": "a"}, Timestamp: ts, Value: 1},
+		{Properties: map[string]string{"target_type": "counter"}, Timestamp: ts, Value: 2},
+		{Properties: map[string]string{"what": "requests", "target_type": "counter", "host": "b"}, Timestamp: ts, Value: 3},
+	})
+
+	var validationErr *apierror.ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("expected validation error, got %v", err)
+	}
+	if len(validationErr.Failures) != 1 || validationErr.Failures[0].Index != 1 || validationErr.Failures[0].Code != ErrCodeMissingWhat {
+		t.Fatalf("unexpected failures: %+v", validationErr.Failures)
+	}
+	if n := len(srv.Metrics()); n != 2 {
+		t.Fatalf("expected 2 accepted metrics, got %d", n)
+	}
+
+	_, err = client.DeleteMetrics(metrics.DeleteExpression{Type: "property", Key: "host", Value: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := srv.Metrics(); len(m) != 1 || m[0].Properties["host"] != "b" {
+		t.Fatalf("unexpected metrics after delete: %+v", m)
+	}
+}
+
+func TestMetrics30(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	accessKey, dataToken := AccessKey, DataToken
+	client, err := metrics3.NewAnodot30Client(*srv.URL(), &accessKey, &dataToken, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created, err := client.CreateSchema(testSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schemaId := *created.SchemaId
+
+	schemas, err := client.GetSchemas()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(schemas.Schemas) != 1 || schemas.Schemas[0].Id != schemaId {
+		t.Fatalf("unexpected schemas: %+v", schemas.Schemas)
+	}
+
+	ts := metrics3.AnodotTimestamp{Time: time.Now()}
+	_, err = client.SubmitMetrics([]metrics3.AnodotMetrics30{
+		{SchemaId: schemaId, Timestamp: ts, Dimensions: map[string]string{"host": "a"}, Measurements: map[string]float64{"count": 1}},
+		{SchemaId: schemaId, Timestamp: ts, Dimensions: map[string]string{}, Measurements: map[string]float64{"count": 1}},
+	})
+	var validationErr *apierror.ValidationError
+	if !errors.As(err, &validationErr) || validationErr.Failures[0].Code != ErrCodeMissingDimension {
+		t.Fatalf("expected missing dimension error, got %v", err)
+	}
+	if n := len(srv.Metrics30()); n != 1 {
+		t.Fatalf("expected 1 accepted metric, got %d", n)
+	}
+
+	watermark := time.Now().Truncate(time.Hour)
+	if _, err := client.SubmitWatermark(schemaId, metrics3.AnodotTimestamp{Time: watermark}); err != nil {
+		t.Fatal(err)
+	}
+	if wm := srv.Watermarks(schemaId); len(wm) != 1 || wm[0] != watermark.Unix() {
+		t.Fatalf("unexpected watermarks: %v", wm)
+	}
+
+	if _, err := client.SendToBC(metrics3.Pipeline{Id: "pipeline-1", SchemaId: schemaId}); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(srv.Pipelines()); n != 1 {
+		t.Fatalf("expected 1 pipeline, got %d", n)
+	}
+
+	if _, err := client.DeleteSchema(schemaId); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(srv.Schemas()); n != 0 {
+		t.Fatalf("expected no schemas after delete, got %d", n)
+	}
+}
+
+func TestCompressedRequests(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	client20, _ := metrics.NewAnodot20Client(*srv.URL(), DataToken, nil)
+	client20.Compression = &compression.Options{}
+
+	ts := metrics.AnodotTimestamp{Time: time.Now()}
+	_, err := client20.SubmitMetrics([]metrics.Anodot20Metric{
+		{Properties: map[string]string{"what": "requests", "target_type": "counter"}, Timestamp: ts, Value: 1},
+	})
+	if err != nil || len(srv.Metrics()) != 1 {
+		t.Fatalf("expected compressed 2.0 metrics to be accepted, got %v", err)
+	}
+
+	accessKey, dataToken := AccessKey, DataToken
+	client30, _ := metrics3.NewAnodot30Client(*srv.URL(), &accessKey, &dataToken, nil)
+	client30.Compression = &compression.Options{}
+
+	created, err := client30.CreateSchema(testSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client30.SubmitMetrics([]metrics3.AnodotMetrics30{
+		{SchemaId: *created.SchemaId, Timestamp: metrics3.AnodotTimestamp{Time: time.Now()}, Dimensions: map[string]string{"host": "a"}, Measurements: map[string]float64{"count": 1}},
+	})
+	if err != nil || len(srv.Metrics30()) != 1 {
+		t.Fatalf("expected compressed 3.0 metrics to be accepted, got %v", err)
+	}
+	if _, err := client30.SubmitWatermark(*created.SchemaId, metrics3.AnodotTimestamp{Time: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChunkedSubmit(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	for _, concurrency := range []int{1, 3} {
+		client, _ := metrics.NewAnodot20Client(*srv.URL(), DataToken, nil)
+		client.Chunking = chunk.Options{MaxRecords: 2, Concurrency: concurrency}
+
+		ts := metrics.AnodotTimestamp{Time: time.Now()}
+		batch := make([]metrics.Anodot20Metric, 5)
+		for i := range batch {
+			batch[i] = metrics.Anodot20Metric{Properties: map[string]string{"what": "requests", "target_type": "counter"}, Timestamp: ts, Value: float64(i)}
+		}
+		delete(batch[3].Properties, "what")
+
+		before := srv.Requests("/api/v1/metrics")
+		resp, err := client.SubmitMetrics(batch)
+
+		var validationErr *apierror.ValidationError
+		if !errors.As(err, &validationErr) || len(validationErr.Failures) != 1 || validationErr.Failures[0].Index != 3 {
+			t.Fatalf("expected validation failure of record 3, got %v", err)
+		}
+		if errs := resp.(*metrics.CreateResponse).Errors; len(errs) != 1 || errs[0].Index != "3" {
+			t.Fatalf("unexpected merged response errors %+v", errs)
+		}
+		if n := srv.Requests("/api/v1/metrics") - before; n != 3 {
+			t.Fatalf("expected 3 chunk requests, got %d", n)
+		}
+	}
+
+	accessKey, dataToken := AccessKey, DataToken
+	client30, _ := metrics3.NewAnodot30Client(*srv.URL(), &accessKey, &dataToken, nil)
+	client30.Chunking = chunk.Options{MaxRecords: 1}
+	created, err := client30.CreateSchema(testSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv.InjectFailure("/api/v1/metrics", Failure{Status: http.StatusInternalServerError, Count: 1})
+	ts := metrics3.AnodotTimestamp{Time: time.Now()}
+	_, err = client30.SubmitMetrics([]metrics3.AnodotMetrics30{
+		{SchemaId: *created.SchemaId, Timestamp: ts, Dimensions: map[string]string{"host": "a"}, Measurements: map[string]float64{"count": 1}},
+		{SchemaId: *created.SchemaId, Timestamp: ts, Dimensions: map[string]string{"host": "b"}, Measurements: map[string]float64{"count": 1}},
+	})
+	var chunkErr *chunk.Error
+	if !errors.As(err, &chunkErr) || len(chunkErr.Failed) != 1 || chunkErr.Failed[0].Start != 0 || chunkErr.Chunks != 2 {
+		t.Fatalf("expected failure of the first chunk, got %v", err)
+	}
+	var apiErr *apierror.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected chunk error to unwrap to api error, got %v", err)
+	}
+	if m := srv.Metrics30(); len(m) != 1 || m[0].Dimensions["host"] != "b" {
+		t.Fatalf("expected the second chunk to be accepted, got %+v", m)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	accessKey, dataToken := AccessKey, DataToken
+	client, _ := metrics3.NewAnodot30Client(*srv.URL(), &accessKey, &dataToken, nil)
+	client.RateLimit, _ = ratelimit.New(ratelimit.Options{MetricsPerSecond: 1, FailFast: true})
+	client.BearerRateLimit, _ = ratelimit.New(ratelimit.Options{RequestsPerSecond: 2, FailFast: true})
+
+	created, err := client.CreateSchema(testSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := metrics3.AnodotTimestamp{Time: time.Now()}
+	m := metrics3.AnodotMetrics30{SchemaId: *created.SchemaId, Timestamp: ts, Dimensions: map[string]string{"host": "a"}, Measurements: map[string]float64{"count": 1}}
+	if _, err := client.SubmitMetrics([]metrics3.AnodotMetrics30{m}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.SubmitMetrics([]metrics3.AnodotMetrics30{m}); !errors.Is(err, ratelimit.ErrLimited) {
+		t.Fatalf("expected metrics budget to be exhausted, got %v", err)
+	}
+
+	// token refresh and schema creation used the whole bearer budget
+	if _, err := client.GetSchemas(); !errors.Is(err, ratelimit.ErrLimited) {
+		t.Fatalf("expected bearer budget to be exhausted, got %v", err)
+	}
+	if n := srv.Requests("/api/v1/metrics"); n != 1 {
+		t.Fatalf("expected 1 metrics request, got %d", n)
+	}
+}
+
+// TestConcurrentClients shares one client of each protocol across goroutines, run with -race.
+func TestConcurrentClients(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	accessKey, dataToken := AccessKey, DataToken
+	client20, _ := metrics.NewAnodot20Client(*srv.URL(), DataToken, nil)
+	client30, _ := metrics3.NewAnodot30Client(*srv.URL(), &accessKey, &dataToken, nil)
+	serverURL := srv.URL().String()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			ts := metrics.AnodotTimestamp{Time: time.Now()}
+			m := metrics.Anodot20Metric{Properties: map[string]string{"what": "requests", "target_type": "counter"}, Timestamp: ts, Value: 1}
+			if _, err := client20.SubmitMetrics([]metrics.Anodot20Metric{m}); err != nil {
+				errs <- err
+			}
+			if _, err := client20.DeleteMetrics(metrics.DeleteExpression{Type: "property", Key: "what", Value: "requests"}); err != nil {
+				errs <- err
+			}
+
+			schema := testSchema
+			schema.Name = fmt.Sprintf("requests_%d", i)
+			created, err := client30.CreateSchema(schema)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if _, err := client30.GetSchemas(); err != nil {
+				errs <- err
+			}
+			m30 := metrics3.AnodotMetrics30{SchemaId: *created.SchemaId, Timestamp: metrics3.AnodotTimestamp{Time: time.Now()}, Dimensions: map[string]string{"host": "a"}, Measurements: map[string]float64{"count": 1}}
+			if _, err := client30.SubmitMetrics([]metrics3.AnodotMetrics30{m30}); err != nil {
+				errs <- err
+			}
+			if _, err := client30.DeleteSchema(*created.SchemaId); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+	if client20.ServerURL.String() != serverURL || client30.ServerURL.String() != serverURL {
+		t.Errorf("client URL was modified: %s, %s", client20.ServerURL, client30.ServerURL)
+	}
+	if n := srv.Requests("/api/v2/access-token"); n != 1 {
+		t.Errorf("expected bearer token to be refreshed once, got %d", n)
+	}
+}
+
+func TestBearerTokenRefresh(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	accessKey := AccessKey
+	client, _ := metrics3.NewAnodot30Client(*srv.URL(), &accessKey, nil, nil)
+	if _, err := client.GetSchemas(); err != nil {
+		t.Fatal(err)
+	}
+
+	// rejected token is refreshed and the request retried once
+	srv.ExpireBearerTokens()
+	if _, err := client.CreateSchema(testSchema); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.Requests("/api/v2/access-token"); n != 2 {
+		t.Fatalf("expected 2 token refreshes, got %d", n)
+	}
+	if n := srv.Requests("/api/v2/stream-schemas"); n != 2 {
+		t.Fatalf("expected schema creation to be retried once, got %d requests", n)
+	}
+	if len(srv.Schemas()) != 1 {
+		t.Fatalf("expected schema to be created once, got %+v", srv.Schemas())
+	}
+
+	// expiry is read from JWT tokens
+	srv.SetBearerTokenTTL(time.Hour)
+	srv.ExpireBearerTokens()
+	for i := 0; i < 3; i++ {
+		if _, err := client.GetSchemas(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	token, err := client.GetBearerToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(*token, ".") != 2 {
+		t.Fatalf("expected JWT token, got %q", *token)
+	}
+	if n := srv.Requests("/api/v2/access-token"); n != 3 {
+		t.Fatalf("expected 3 token refreshes, got %d", n)
+	}
+
+	client.TokenRefreshMargin = 2 * time.Hour
+	srv.SetBearerTokenTTL(2 * time.Second)
+	srv.ExpireBearerTokens()
+	if _, err := client.GetSchemas(); err != nil {
+		t.Fatal(err)
+	}
+	before := srv.Requests("/api/v2/access-token")
+	time.Sleep(1100 * time.Millisecond)
+	if _, err := client.GetSchemas(); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.Requests("/api/v2/access-token") - before; n != 1 {
+		t.Fatalf("expected token to be refreshed before expiry, got %d refreshes", n)
+	}
+}
+
+type rotatingCredentials struct {
+	mu    sync.Mutex
+	creds credentials.Credentials
+}
+
+func (r *rotatingCredentials) Credentials(ctx context.Context) (credentials.Credentials, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.creds, nil
+}
+
+func (r *rotatingCredentials) set(c credentials.Credentials) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.creds = c
+}
+
+func TestCredentialsRotation(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	provider := &rotatingCredentials{creds: credentials.Credentials{DataToken: "revoked", AccessKey: "revoked"}}
+	client20, _ := metrics.NewAnodot20ClientWithCredentials(*srv.URL(), provider, nil)
+	client30, _ := metrics3.NewAnodot30ClientWithCredentials(*srv.URL(), provider, nil)
+
+	m := metrics.Anodot20Metric{Properties: map[string]string{"what": "requests", "target_type": "gauge"}, Timestamp: metrics.AnodotTimestamp{Time: time.Now()}}
+	if _, err := client20.SubmitMetrics([]metrics.Anodot20Metric{m}); !errors.Is(err, apierror.ErrUnauthorized) {
+		t.Fatalf("expected unauthorized error, got %v", err)
+	}
+	if _, err := client30.GetSchemas(); !errors.Is(err, apierror.ErrUnauthorized) {
+		t.Fatalf("expected unauthorized error, got %v", err)
+	}
+
+	provider.set(credentials.Credentials{DataToken: DataToken, AccessKey: AccessKey})
+	if _, err := client20.SubmitMetrics([]metrics.Anodot20Metric{m}); err != nil {
+		t.Fatal(err)
+	}
+	created, err := client30.CreateSchema(testSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m30 := metrics3.AnodotMetrics30{SchemaId: *created.SchemaId, Timestamp: metrics3.AnodotTimestamp{Time: time.Now()}, Dimensions: map[string]string{"host": "a"}, Measurements: map[string]float64{"count": 1}}
+	if _, err := client30.SubmitMetrics([]metrics3.AnodotMetrics30{m30}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInjectFailure(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	client, err := metrics.NewAnodot20Client(*srv.URL(), DataToken, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.RetryPolicy = &retry.Policy{MaxAttempts: 3, InitialInterval: time.Millisecond}
+
+	srv.InjectFailure("/api/v1/metrics", Failure{Status: http.StatusServiceUnavailable, Count: 2})
+
+	m := metrics.Anodot20Metric{Properties: map[string]string{"what": "requests", "target_type": "gauge"}, Timestamp: metrics.AnodotTimestamp{Time: time.Now()}}
+	if _, err := client.SubmitMetrics([]metrics.Anodot20Metric{m}); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.Requests("/api/v1/metrics"); n != 3 {
+		t.Fatalf("expected 3 requests, got %d", n)
+	}
+
+	srv.InjectFailure("/api/v1/metrics", Failure{Status: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"1"}}})
+	client.RetryPolicy = nil
+
+	_, err = client.SubmitMetrics([]metrics.Anodot20Metric{m})
+	var rateErr *apierror.RateLimitError
+	if !errors.As(err, &rateErr) || rateErr.RetryAfter != time.Second {
+		t.Fatalf("expected rate limit error, got %v", err)
+	}
+}
@@ -0,0 +1,272 @@
+// Package apierror contains errors returned by Anodot API clients.
+//
+// Every error returned for unsuccessful API call is *APIError or one of the more
+// specific types embedding it: *AuthError, *RateLimitError and *ValidationError.
+// The specific types unwrap to *APIError, so errors.As(err, &apiErr) matches all of them.
+package apierror
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anodot/anodot-common/pkg/chunk"
+	"github.com/anodot/anodot-common/pkg/httplog"
+	"github.com/anodot/anodot-common/pkg/ratelimit"
+	"github.com/anodot/anodot-common/pkg/retry"
+)
+
+var (
+	// Matched with errors.Is by *AuthError.
+	ErrUnauthorized = errors.New("anodot: unauthorized")
+	// Matched with errors.Is by *RateLimitError.
+	ErrRateLimited = errors.New("anodot: rate limited")
+	// Matched with errors.Is by *ValidationError.
+	ErrValidation = errors.New("anodot: validation failed")
+)
+
+// APIError describes failed Anodot API call.
+type APIError struct {
+	// HTTP status code of the response.
+	StatusCode int
+	// Anodot error code (andtErrorCode), if provided by the server.
+	Code int
+	Name string
+	// Error message provided by the server, or response body if it could not be parsed.
+	Message string
+	// API path of the failed request.
+	Path string
+}
+
+func (e *APIError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "anodot api error: http status %d", e.StatusCode)
+	if e.Code != 0 {
+		fmt.Fprintf(&b, ", code %d", e.Code)
+	}
+	if e.Path != "" {
+		fmt.Fprintf(&b, ", path %s", e.Path)
+	}
+	if e.Message != "" {
+		fmt.Fprintf(&b, ": %s", e.Message)
+	}
+	return b.String()
+}
+
+// Temporary reports whether the failed call is safe to retry.
+func (e *APIError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests ||
+		(e.StatusCode >= 500 && e.StatusCode != http.StatusNotImplemented)
+}
+
+// IsTemporary reports whether err leaves the request undelivered for a reason which may go away:
+// a network failure, ratelimit.ErrLimited or an API error whose Temporary method returns true.
+// Other errors, e.g. failure to encode the request or to parse the response, certificate errors
+// or cancellation of the caller's context, are permanent. Error of partly delivered chunked
+// batch is permanent too, as only its failed chunks may be resent. Returns false for nil.
+func IsTemporary(err error) bool {
+	if err == nil {
+		return false
+	}
+	var chunkErr *chunk.Error
+	if errors.As(err, &chunkErr) {
+		// resending partly delivered batch would duplicate the accepted records
+		if chunkErr.Partial() {
+			return false
+		}
+		for _, e := range chunkErr.Errs {
+			if !IsTemporary(e) {
+				return false
+			}
+		}
+		return true
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Temporary()
+	}
+	// request was not sent, client rate limit budget was exhausted
+	if errors.Is(err, ratelimit.ErrLimited) {
+		return true
+	}
+
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	// request was abandoned by the caller
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var hostnameErr x509.HostnameError
+	var authorityErr x509.UnknownAuthorityError
+	var certErr x509.CertificateInvalidError
+	if errors.As(err, &hostnameErr) || errors.As(err, &authorityErr) || errors.As(err, &certErr) {
+		return false
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		// context.DeadlineExceeded of the caller is net.Error too, http.Client timeouts are temporary
+		return netErr != context.DeadlineExceeded
+	}
+	return false
+}
+
+// AuthError is returned when credentials are missing, invalid or expired.
+type AuthError struct {
+	APIError
+}
+
+func (e *AuthError) Unwrap() error {
+	return &e.APIError
+}
+
+func (e *AuthError) Is(target error) bool {
+	return target == ErrUnauthorized
+}
+
+// RateLimitError is returned when request was throttled by Anodot.
+type RateLimitError struct {
+	APIError
+	// Delay requested by server with Retry-After header, zero if not provided.
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Unwrap() error {
+	return &e.APIError
+}
+
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+// ReauthError is returned when request was rejected as unauthorized and repeating it with
+// refreshed credentials failed. It unwraps to Err, the *AuthError of the rejected request, and
+// errors.Is also matches RefreshErr, the reason the request could not be repeated.
+type ReauthError struct {
+	Err        error
+	RefreshErr error
+}
+
+func (e *ReauthError) Error() string {
+	return fmt.Sprintf("%v; retry with refreshed credentials failed: %v", e.Err, e.RefreshErr)
+}
+
+func (e *ReauthError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ReauthError) Is(target error) bool {
+	return errors.Is(e.RefreshErr, target)
+}
+
+// Failure describes a single rejected record or expression.
+type Failure struct {
+	// Position of rejected record in submitted batch, -1 if not applicable.
+	Index       int
+	Code        int64
+	Description string
+}
+
+// ValidationError is returned when request payload is rejected, either fully or
+// partially. Failures contain details for every rejected record, if provided by the server.
+type ValidationError struct {
+	APIError
+	Failures []Failure
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Failures) == 0 {
+		return e.APIError.Error()
+	}
+
+	descriptions := make([]string, 0, len(e.Failures))
+	for _, f := range e.Failures {
+		if f.Index >= 0 {
+			descriptions = append(descriptions, fmt.Sprintf("[%d] %s", f.Index, f.Description))
+		} else {
+			descriptions = append(descriptions, f.Description)
+		}
+	}
+	return fmt.Sprintf("anodot validation error: %d failures, path %s: %s", len(e.Failures), e.Path, strings.Join(descriptions, "; "))
+}
+
+func (e *ValidationError) Unwrap() error {
+	return &e.APIError
+}
+
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrValidation
+}
+
+// NewValidationError creates error for successful http response which reports rejected records.
+func NewValidationError(resp *http.Response, failures []Failure) *ValidationError {
+	err := &ValidationError{Failures: failures}
+	if resp != nil {
+		err.StatusCode = resp.StatusCode
+		if resp.Request != nil && resp.Request.URL != nil {
+			err.Path = resp.Request.URL.Path
+		}
+	}
+	return err
+}
+
+// ParseIndex converts record index reported by Anodot API to int, returns -1 if index is not a number.
+func ParseIndex(index string) int {
+	i, err := strconv.Atoi(strings.TrimSpace(index))
+	if err != nil {
+		return -1
+	}
+	return i
+}
+
+// FromResponse creates error for unsuccessful http response with the given body.
+// Anodot 3.0 error body ({"status", "name", "message", "andtErrorCode", "path"}) is parsed if present.
+// Secrets echoed by the server in the message are redacted.
+func FromResponse(resp *http.Response, body []byte) error {
+	apiErr := APIError{StatusCode: resp.StatusCode}
+	if resp.Request != nil && resp.Request.URL != nil {
+		apiErr.Path = resp.Request.URL.Path
+	}
+
+	parsed := struct {
+		Name          string `json:"name"`
+		Message       string `json:"message"`
+		AndtErrorCode int    `json:"andtErrorCode"`
+		Path          string `json:"path"`
+	}{}
+	if err := json.Unmarshal(body, &parsed); err == nil && (parsed.Message != "" || parsed.AndtErrorCode != 0) {
+		apiErr.Name = parsed.Name
+		apiErr.Message = httplog.RedactText(parsed.Message)
+		apiErr.Code = parsed.AndtErrorCode
+		if parsed.Path != "" {
+			apiErr.Path = parsed.Path
+		}
+	} else {
+		apiErr.Message = httplog.RedactText(strings.TrimSpace(string(body)))
+	}
+
+	switch resp.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return &AuthError{APIError: apiErr}
+	case http.StatusTooManyRequests:
+		d, _ := retry.RetryAfter(resp)
+		return &RateLimitError{APIError: apiErr, RetryAfter: d}
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		return &ValidationError{APIError: apiErr}
+	default:
+		return &apiErr
+	}
+}
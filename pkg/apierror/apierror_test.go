@@ -0,0 +1,126 @@
+package apierror
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/anodot/anodot-common/pkg/chunk"
+	"github.com/anodot/anodot-common/pkg/ratelimit"
+)
+
+func response(status int, header http.Header) *http.Response {
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{
+		StatusCode: status,
+		Header:     header,
+		Request:    &http.Request{URL: &url.URL{Path: "/api/v2/stream-schemas"}},
+	}
+}
+
+func TestFromResponse(t *testing.T) {
+	body := []byte(`{"status":401,"name":"Unauthorized","message":"token expired","andtErrorCode":1005,"path":"/api/v2/stream-schemas/schemas"}`)
+	err := FromResponse(response(http.StatusUnauthorized, nil), body)
+
+	var authErr *AuthError
+	if !errors.As(err, &authErr) {
+		t.Fatalf("expected *AuthError, got %T", err)
+	}
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatal("expected error to match ErrUnauthorized")
+	}
+
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatal("expected *AuthError to unwrap to *APIError")
+	}
+	if apiErr.StatusCode != 401 || apiErr.Code != 1005 || apiErr.Message != "token expired" || apiErr.Path != "/api/v2/stream-schemas/schemas" {
+		t.Fatalf("unexpected error fields: %+v", apiErr)
+	}
+}
+
+func TestFromResponseTypes(t *testing.T) {
+	err := FromResponse(response(http.StatusTooManyRequests, http.Header{"Retry-After": {"30"}}), []byte("slow down"))
+	var rateErr *RateLimitError
+	if !errors.As(err, &rateErr) || rateErr.RetryAfter != 30*time.Second || !rateErr.Temporary() {
+		t.Fatalf("expected temporary *RateLimitError with 30s delay, got %#v", err)
+	}
+	if rateErr.Message != "slow down" || rateErr.Path != "/api/v2/stream-schemas" {
+		t.Fatalf("unexpected error fields: %+v", rateErr.APIError)
+	}
+
+	err = FromResponse(response(http.StatusBadRequest, nil), nil)
+	if !errors.Is(err, ErrValidation) {
+		t.Fatalf("expected validation error, got %#v", err)
+	}
+
+	err = FromResponse(response(http.StatusInternalServerError, nil), nil)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || !apiErr.Temporary() || errors.Is(err, ErrValidation) {
+		t.Fatalf("expected temporary *APIError, got %#v", err)
+	}
+}
+
+func TestValidationError(t *testing.T) {
+	err := NewValidationError(response(http.StatusOK, nil), []Failure{
+		{Index: ParseIndex("1"), Code: 2001, Description: "invalid what"},
+		{Index: ParseIndex(""), Description: "bad request"},
+	})
+
+	if err.Failures[0].Index != 1 || err.Failures[1].Index != -1 {
+		t.Fatalf("unexpected failure indexes: %+v", err.Failures)
+	}
+
+	expected := "anodot validation error: 2 failures, path /api/v2/stream-schemas: [1] invalid what; bad request"
+	if err.Error() != expected {
+		t.Fatalf("expected %q, got %q", expected, err.Error())
+	}
+}
+
+// clientTimeout mimics error returned on http.Client timeout, which matches context.DeadlineExceeded.
+type clientTimeout struct{}
+
+func (clientTimeout) Error() string        { return "Client.Timeout exceeded while awaiting headers" }
+func (clientTimeout) Timeout() bool        { return true }
+func (clientTimeout) Temporary() bool      { return true }
+func (clientTimeout) Is(target error) bool { return target == context.DeadlineExceeded }
+
+func TestIsTemporary(t *testing.T) {
+	tests := []struct {
+		err       error
+		temporary bool
+	}{
+		{nil, false},
+		{&url.Error{Op: "Post", URL: "http://anodot", Err: io.EOF}, true},
+		{fmt.Errorf("submit: %w", &net.OpError{Op: "dial", Err: errors.New("connection refused")}), true},
+		{&url.Error{Op: "parse", URL: ":", Err: errors.New("missing protocol scheme")}, false},
+		{&url.Error{Op: "Post", URL: "https://anodot", Err: x509.UnknownAuthorityError{}}, false},
+		{&url.Error{Op: "Post", URL: "https://anodot", Err: x509.HostnameError{Host: "anodot"}}, false},
+		{&url.Error{Op: "Post", URL: "http://anodot", Err: context.Canceled}, false},
+		{&url.Error{Op: "Post", URL: "http://anodot", Err: context.DeadlineExceeded}, false},
+		{&url.Error{Op: "Post", URL: "http://anodot", Err: clientTimeout{}}, true},
+		{&url.Error{Op: "Post", URL: "http://anodot", Err: errors.New("unsupported protocol scheme")}, false},
+		{FromResponse(response(http.StatusServiceUnavailable, nil), nil), true},
+		{FromResponse(response(http.StatusUnauthorized, nil), nil), false},
+		{errors.New("json: unsupported value: NaN"), false},
+		{fmt.Errorf("submit: %w", ratelimit.ErrLimited), true},
+		{&chunk.Error{Failed: []chunk.Chunk{{}, {}}, Errs: []error{errors.New("json: unsupported value: NaN"), &net.OpError{Op: "read"}}, Chunks: 2}, false},
+		{&chunk.Error{Failed: []chunk.Chunk{{}, {}}, Errs: []error{&net.OpError{Op: "dial"}, &net.OpError{Op: "read"}}, Chunks: 2}, true},
+		// partly delivered batch can't be resent as a whole
+		{&chunk.Error{Failed: []chunk.Chunk{{}}, Errs: []error{&net.OpError{Op: "dial"}}, Accepted: []chunk.Chunk{{}}, Chunks: 2}, false},
+	}
+	for i, tt := range tests {
+		if got := IsTemporary(tt.err); got != tt.temporary {
+			t.Errorf("%d: IsTemporary(%v) = %v, expected %v", i, tt.err, got, tt.temporary)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package apierror
+
+import (
+	"errors"
+
+	"github.com/anodot/anodot-common/pkg/chunk"
+)
+
+// Records is a submission of a batch of records split by record position, so that
+// clients of every protocol can tell which records were accepted, rejected or not delivered.
+type Records struct {
+	// Positions of accepted records.
+	Accepted []int
+	// Rejected records in position order. Code is zero if the whole request was rejected.
+	Rejected []Failure
+	// Positions of records which did not reach Anodot and errors which caused it.
+	Undelivered []int
+	Errs        []error
+}
+
+// SplitRecords splits n records according to error returned for their submission and record
+// failures reported in the response, merged from all chunks. Failures override the error.
+func SplitRecords(n int, err error, failures []Failure) *Records {
+	records := &Records{}
+	if err == nil {
+		for i := 0; i < n; i++ {
+			records.Accepted = append(records.Accepted, i)
+		}
+		return records
+	}
+
+	rejected := make(map[int]Failure)
+	undelivered := make(map[int]error)
+
+	markRange := func(start, end int, err error) {
+		var validationErr *ValidationError
+		for i := start; i < end && i < n; i++ {
+			if errors.As(err, &validationErr) {
+				// whole request was refused
+				rejected[i] = Failure{Index: i, Description: err.Error()}
+			} else {
+				undelivered[i] = err
+			}
+		}
+	}
+
+	var chunkErr *chunk.Error
+	var validationErr *ValidationError
+	switch {
+	case errors.As(err, &chunkErr):
+		for i, c := range chunkErr.Failed {
+			markRange(c.Start, c.End, chunkErr.Errs[i])
+		}
+	case errors.As(err, &validationErr) && hasRecordFailures(validationErr):
+		failures = append(append([]Failure{}, validationErr.Failures...), failures...)
+	default:
+		markRange(0, n, err)
+	}
+
+	for _, f := range failures {
+		if f.Index >= 0 && f.Index < n {
+			rejected[f.Index] = f
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		if f, ok := rejected[i]; ok {
+			records.Rejected = append(records.Rejected, f)
+		} else if err, ok := undelivered[i]; ok {
+			records.Undelivered = append(records.Undelivered, i)
+			records.Errs = append(records.Errs, err)
+		} else {
+			records.Accepted = append(records.Accepted, i)
+		}
+	}
+	return records
+}
+
+// Retryable returns positions of undelivered records whose error is temporary, so they may be resubmitted.
+func (r *Records) Retryable() []int {
+	var retry []int
+	for i, index := range r.Undelivered {
+		if IsTemporary(r.Errs[i]) {
+			retry = append(retry, index)
+		}
+	}
+	return retry
+}
+
+// Failed returns undelivered records whose error is permanent. They would fail the same
+// way if resubmitted.
+func (r *Records) Failed() []Failure {
+	var failed []Failure
+	for i, index := range r.Undelivered {
+		if err := r.Errs[i]; !IsTemporary(err) {
+			failed = append(failed, Failure{Index: index, Description: err.Error()})
+		}
+	}
+	return failed
+}
+
+// hasRecordFailures reports whether err rejects particular records rather than the whole request.
+func hasRecordFailures(err *ValidationError) bool {
+	for _, f := range err.Failures {
+		if f.Index >= 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package apierror
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/anodot/anodot-common/pkg/chunk"
+)
+
+func TestSplitRecords(t *testing.T) {
+	chunkErr := &chunk.Error{
+		Failed: []chunk.Chunk{{Start: 0, End: 2}, {Start: 4, End: 6}},
+		Errs:   []error{&APIError{StatusCode: 503}, &APIError{StatusCode: 403}},
+		Chunks: 3,
+	}
+	failures := []Failure{{Index: 3, Code: 1001, Description: "bad value"}, {Index: 9}, {Index: -1}}
+
+	r := SplitRecords(7, chunkErr, failures)
+	if !reflect.DeepEqual(r.Accepted, []int{2, 6}) || !reflect.DeepEqual(r.Undelivered, []int{0, 1, 4, 5}) {
+		t.Fatalf("unexpected split: %+v", r)
+	}
+	if !reflect.DeepEqual(r.Rejected, failures[:1]) {
+		t.Errorf("unexpected rejected records: %+v", r.Rejected)
+	}
+	if retry := r.Retryable(); !reflect.DeepEqual(retry, []int{0, 1}) {
+		t.Errorf("unexpected retryable records: %v", retry)
+	}
+	if failed := r.Failed(); len(failed) != 2 || failed[0].Index != 4 || failed[1].Index != 5 || failed[0].Description != chunkErr.Errs[1].Error() {
+		t.Errorf("unexpected failed records: %+v", failed)
+	}
+
+	validationErr := &ValidationError{Failures: []Failure{{Index: 1, Code: 1002, Description: "no what"}}}
+	r = SplitRecords(3, validationErr, nil)
+	if !reflect.DeepEqual(r.Accepted, []int{0, 2}) || !reflect.DeepEqual(r.Rejected, validationErr.Failures) {
+		t.Errorf("expected only record failures to be rejected, got %+v", r)
+	}
+
+	r = SplitRecords(2, &ValidationError{}, nil)
+	if len(r.Rejected) != 2 || r.Rejected[1].Index != 1 || len(r.Undelivered) != 0 {
+		t.Errorf("expected whole request to be rejected, got %+v", r)
+	}
+
+	r = SplitRecords(2, errors.New("bad json"), nil)
+	if len(r.Undelivered) != 2 || r.Retryable() != nil || len(r.Failed()) != 2 {
+		t.Errorf("expected records to fail permanently, got %+v", r)
+	}
+}
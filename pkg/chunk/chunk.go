@@ -0,0 +1,132 @@
+// Package chunk splits large metric batches into requests which respect Anodot API limits.
+package chunk
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// Options limit size of a single request. Zero values mean defaults, negative values disable the limit.
+type Options struct {
+	// Maximum number of records in one request. Defaults to 1000.
+	MaxRecords int
+	// Maximum size of JSON encoded request body, before compression. Defaults to 4MB.
+	// Record larger than the limit is sent in a request of its own.
+	MaxBytes int
+	// Number of chunks sent concurrently. Defaults to 1, which sends chunks sequentially.
+	Concurrency int
+}
+
+// Chunk is JSON array of records [Start, End) of the original batch.
+type Chunk struct {
+	Start int
+	End   int
+	Body  []byte
+}
+
+// Encode encodes every element of records slice to JSON and splits them into chunks.
+// Elements are encoded through a pointer, so pointer receiver MarshalJSON methods are used.
+func Encode(records interface{}, opts Options) ([]Chunk, error) {
+	v := reflect.ValueOf(records)
+	if v.Kind() != reflect.Slice {
+		return nil, fmt.Errorf("records should be a slice, got %T", records)
+	}
+
+	encoded := make([][]byte, v.Len())
+	for i := range encoded {
+		b, err := json.Marshal(v.Index(i).Addr().Interface())
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode record %d: %w", i, err)
+		}
+		encoded[i] = b
+	}
+
+	return Split(encoded, opts), nil
+}
+
+// Split groups JSON encoded records into chunks respecting opts.
+func Split(records [][]byte, opts Options) []Chunk {
+	maxRecords := opts.MaxRecords
+	if maxRecords == 0 {
+		maxRecords = 1000
+	}
+	maxBytes := opts.MaxBytes
+	if maxBytes == 0 {
+		maxBytes = 4 << 20
+	}
+
+	if len(records) == 0 {
+		return []Chunk{{Body: []byte("[]")}}
+	}
+
+	// body size is brackets, records and commas between them: 1 + sum(len(record) + 1)
+	var chunks []Chunk
+	start, size := 0, 1
+	for i, r := range records {
+		recordSize := len(r) + 1
+		full := (maxRecords > 0 && i-start >= maxRecords) || (maxBytes > 0 && i > start && size+recordSize > maxBytes)
+		if full {
+			chunks = append(chunks, newChunk(records, start, i))
+			start, size = i, 1
+		}
+		size += recordSize
+	}
+	return append(chunks, newChunk(records, start, len(records)))
+}
+
+func newChunk(records [][]byte, start, end int) Chunk {
+	return Chunk{Start: start, End: end, Body: append(append([]byte{'['}, bytes.Join(records[start:end], []byte{','})...), ']')}
+}
+
+// Run calls send for every chunk index from 0 to n, running up to concurrency calls at once.
+func Run(n int, concurrency int, send func(i int)) {
+	if concurrency <= 1 || n == 1 {
+		for i := 0; i < n; i++ {
+			send(i)
+		}
+		return
+	}
+
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			send(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// Error is returned when some chunks of a batch could not be sent. Records of the other chunks were submitted.
+// Only the failed chunks should be resubmitted, resending the whole batch would duplicate the accepted records.
+type Error struct {
+	// Chunks which failed and their errors, in batch order.
+	Failed []Chunk
+	Errs   []error
+	// Chunks delivered to Anodot, in batch order. Some of their records may still be rejected.
+	Accepted []Chunk
+	// Total number of chunks.
+	Chunks int
+}
+
+// Partial reports whether some chunks of the batch were delivered.
+func (e *Error) Partial() bool {
+	return len(e.Failed) < e.Chunks
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d of %d chunks failed, first failed chunk has records [%d, %d): %v",
+		len(e.Failed), e.Chunks, e.Failed[0].Start, e.Failed[0].End, e.Errs[0])
+}
+
+// Unwrap returns error of the first failed chunk.
+func (e *Error) Unwrap() error {
+	return e.Errs[0]
+}
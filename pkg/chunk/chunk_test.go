@@ -0,0 +1,64 @@
+package chunk
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	records := [][]byte{[]byte(`1`), []byte(`22`), []byte(`333`), []byte(`4444`), []byte(`55555`)}
+
+	chunks := Split(records, Options{MaxRecords: 2})
+	if len(chunks) != 3 || chunks[1].Start != 2 || chunks[1].End != 4 || string(chunks[1].Body) != "[333,4444]" {
+		t.Fatalf("unexpected chunks by count %+v", chunks)
+	}
+
+	// "[1,22,333]" is 10 bytes
+	chunks = Split(records, Options{MaxBytes: 10, MaxRecords: -1})
+	if len(chunks) != 3 || string(chunks[0].Body) != "[1,22,333]" || string(chunks[2].Body) != "[55555]" {
+		t.Fatalf("unexpected chunks by size %+v", chunks)
+	}
+
+	// record larger than the limit is sent alone
+	chunks = Split(records, Options{MaxBytes: 3})
+	if len(chunks) != 5 {
+		t.Fatalf("expected chunk per record, got %+v", chunks)
+	}
+}
+
+func TestEncode(t *testing.T) {
+	type record struct {
+		Value int `json:"value"`
+	}
+	chunks, err := Encode([]record{{1}, {2}, {3}}, Options{MaxRecords: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded []record
+	if err := json.Unmarshal(chunks[0].Body, &decoded); err != nil || len(decoded) != 2 || decoded[1].Value != 2 {
+		t.Fatalf("unexpected chunk body %s, %v", chunks[0].Body, err)
+	}
+	if _, err := Encode("not a slice", Options{}); err == nil {
+		t.Fatal("expected error for non slice records")
+	}
+}
+
+func TestRun(t *testing.T) {
+	var running, maxRunning, calls int32
+	Run(10, 3, func(i int) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		atomic.AddInt32(&calls, 1)
+		atomic.AddInt32(&running, -1)
+	})
+	if calls != 10 || maxRunning > 3 {
+		t.Fatalf("expected 10 calls with at most 3 concurrent, got %d calls, %d concurrent", calls, maxRunning)
+	}
+}
@@ -0,0 +1,98 @@
+// Package compression implements compression of Anodot API request bodies.
+//
+// Gzip is supported out of the box. Other encodings, e.g. zstd, can be used by implementing
+// Codec on top of a third party library:
+//
+//	type zstdCodec struct{ enc *zstd.Encoder }
+//
+//	func (c zstdCodec) ContentEncoding() string { return "zstd" }
+//	func (c zstdCodec) Compress(data []byte) ([]byte, error) { return c.enc.EncodeAll(data, nil), nil }
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+)
+
+// Codec compresses request bodies.
+type Codec interface {
+	// Value of Content-Encoding header of compressed requests.
+	ContentEncoding() string
+	Compress(data []byte) ([]byte, error)
+}
+
+// Gzip compresses with the given compression level. Zero level means gzip.DefaultCompression.
+type Gzip struct {
+	Level int
+}
+
+func (g Gzip) ContentEncoding() string {
+	return "gzip"
+}
+
+func (g Gzip) Compress(data []byte) ([]byte, error) {
+	level := g.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Options describe which request bodies are compressed and how.
+type Options struct {
+	// Codec used for compression. Defaults to Gzip with default compression level.
+	Codec Codec
+	// Bodies smaller than MinSize bytes are sent uncompressed, as compressing them saves little.
+	MinSize int
+}
+
+// Returns options compressing bodies of at least 1KB with gzip.
+func DefaultOptions() *Options {
+	return &Options{Codec: Gzip{}, MinSize: 1024}
+}
+
+// NewRequest creates http request with the body compressed according to opts and Content-Encoding
+// header set. The body is sent as is if opts is nil or the body is smaller than opts.MinSize.
+func NewRequest(ctx context.Context, opts *Options, method string, url string, body []byte) (*http.Request, error) {
+	encoding := ""
+	if opts != nil && len(body) >= opts.MinSize {
+		codec := opts.Codec
+		if codec == nil {
+			codec = Gzip{}
+		}
+
+		compressed, err := codec.Compress(body)
+		if err != nil {
+			return nil, err
+		}
+		body, encoding = compressed, codec.ContentEncoding()
+	}
+
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, r)
+	if err != nil {
+		return nil, err
+	}
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	return req, nil
+}
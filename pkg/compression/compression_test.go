@@ -0,0 +1,50 @@
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNewRequest(t *testing.T) {
+	body := []byte(strings.Repeat(`{"what":"requests"}`, 100))
+
+	r, err := NewRequest(context.Background(), DefaultOptions(), http.MethodPost, "http://localhost/api/v1/metrics", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected gzip content encoding, got %q", r.Header.Get("Content-Encoding"))
+	}
+	if r.ContentLength >= int64(len(body)) {
+		t.Fatalf("expected compressed body, got %d bytes", r.ContentLength)
+	}
+
+	// body should be readable again for retries
+	rb, err := r.GetBody()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gr, err := gzip.NewReader(rb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := ioutil.ReadAll(gr)
+	if err != nil || !bytes.Equal(decoded, body) {
+		t.Fatalf("unexpected decompressed body, err %v", err)
+	}
+
+	for _, opts := range []*Options{nil, {MinSize: 1 << 20}} {
+		r, err := NewRequest(context.Background(), opts, http.MethodPost, "http://localhost/api/v1/metrics", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Header.Get("Content-Encoding") != "" || r.ContentLength != int64(len(body)) {
+			t.Fatalf("expected uncompressed body with options %+v", opts)
+		}
+	}
+}
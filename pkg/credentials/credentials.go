@@ -0,0 +1,177 @@
+// Package credentials provides Anodot credentials to clients on every request,
+// so they can be rotated without rebuilding the clients.
+package credentials
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoCredentials is returned when a provider has no credentials to offer.
+var ErrNoCredentials = errors.New("no anodot credentials found")
+
+// Credentials used by Anodot clients. Empty value means it is not provided.
+type Credentials struct {
+	// Data collection token, used by 2.0 API and 3.0 metrics and watermarks.
+	DataToken string
+	// Access key exchanged for bearer token of 3.0 API.
+	AccessKey string
+}
+
+// Provider is the credentials provider used by the clients. It is called before requests
+// and should be cheap and safe for concurrent use.
+type Provider interface {
+	Credentials(ctx context.Context) (Credentials, error)
+}
+
+// Static provides fixed credentials.
+type Static Credentials
+
+func (s Static) Credentials(ctx context.Context) (Credentials, error) {
+	if s.DataToken == "" && s.AccessKey == "" {
+		return Credentials{}, ErrNoCredentials
+	}
+	return Credentials(s), nil
+}
+
+// Env reads credentials from environment variables on every call.
+type Env struct {
+	// Variable holding data collection token. Defaults to ANODOT_TOKEN.
+	DataTokenVar string
+	// Variable holding access key. Defaults to ANODOT_ACCESS_KEY.
+	AccessKeyVar string
+}
+
+func (e Env) Credentials(ctx context.Context) (Credentials, error) {
+	dataTokenVar, accessKeyVar := e.DataTokenVar, e.AccessKeyVar
+	if dataTokenVar == "" {
+		dataTokenVar = "ANODOT_TOKEN"
+	}
+	if accessKeyVar == "" {
+		accessKeyVar = "ANODOT_ACCESS_KEY"
+	}
+
+	c := Credentials{DataToken: strings.TrimSpace(os.Getenv(dataTokenVar)), AccessKey: strings.TrimSpace(os.Getenv(accessKeyVar))}
+	if c.DataToken == "" && c.AccessKey == "" {
+		return c, ErrNoCredentials
+	}
+	return c, nil
+}
+
+// File reads credentials from files holding a single secret each, like Kubernetes secret volumes.
+// Files are reloaded when their modification time or size changes, which covers secret remounts.
+type File struct {
+	// Path of file with data collection token. Empty if not provided.
+	DataTokenPath string
+	// Path of file with access key. Empty if not provided.
+	AccessKeyPath string
+	// Files are checked for changes at most once per CheckInterval. Defaults to 10 seconds.
+	CheckInterval time.Duration
+
+	mu        sync.Mutex
+	checked   time.Time
+	dataToken watchedFile
+	accessKey watchedFile
+}
+
+type watchedFile struct {
+	modTime time.Time
+	size    int64
+	value   string
+}
+
+// Constructs new File provider and reads the files, so missing files are reported early.
+func NewFile(dataTokenPath string, accessKeyPath string) (*File, error) {
+	f := &File{DataTokenPath: dataTokenPath, AccessKeyPath: accessKeyPath}
+	if _, err := f.Credentials(context.Background()); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *File) Credentials(ctx context.Context) (Credentials, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	interval := f.CheckInterval
+	if interval == 0 {
+		interval = 10 * time.Second
+	}
+
+	if f.checked.IsZero() || time.Since(f.checked) >= interval {
+		if err := f.dataToken.reload(f.DataTokenPath); err != nil {
+			return Credentials{}, err
+		}
+		if err := f.accessKey.reload(f.AccessKeyPath); err != nil {
+			return Credentials{}, err
+		}
+		f.checked = time.Now()
+	}
+
+	c := Credentials{DataToken: f.dataToken.value, AccessKey: f.accessKey.value}
+	if c.DataToken == "" && c.AccessKey == "" {
+		return c, ErrNoCredentials
+	}
+	return c, nil
+}
+
+func (w *watchedFile) reload(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(w.modTime) && info.Size() == w.size {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	w.modTime, w.size, w.value = info.ModTime(), info.Size(), strings.TrimSpace(string(data))
+	return nil
+}
+
+// Chain takes every credential from the first provider which has it, so different credentials
+// may come from different providers. Errors are ignored as long as some provider succeeds.
+type Chain []Provider
+
+func (c Chain) Credentials(ctx context.Context) (Credentials, error) {
+	var result Credentials
+	var firstErr error
+	for _, p := range c {
+		creds, err := p.Credentials(ctx)
+		if err != nil {
+			if firstErr == nil && err != ErrNoCredentials {
+				firstErr = err
+			}
+			continue
+		}
+		if result.DataToken == "" {
+			result.DataToken = creds.DataToken
+		}
+		if result.AccessKey == "" {
+			result.AccessKey = creds.AccessKey
+		}
+		if result.DataToken != "" && result.AccessKey != "" {
+			break
+		}
+	}
+
+	if result.DataToken == "" && result.AccessKey == "" {
+		if firstErr != nil {
+			return result, firstErr
+		}
+		return result, ErrNoCredentials
+	}
+	return result, nil
+}
@@ -0,0 +1,88 @@
+package credentials
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEnv(t *testing.T) {
+	os.Setenv("TEST_ANODOT_TOKEN", " token\n")
+	defer os.Unsetenv("TEST_ANODOT_TOKEN")
+
+	c, err := Env{DataTokenVar: "TEST_ANODOT_TOKEN", AccessKeyVar: "TEST_ANODOT_MISSING"}.Credentials(context.Background())
+	if err != nil || c.DataToken != "token" || c.AccessKey != "" {
+		t.Fatalf("unexpected credentials %+v, %v", c, err)
+	}
+
+	if _, err := (Env{DataTokenVar: "TEST_ANODOT_MISSING", AccessKeyVar: "TEST_ANODOT_MISSING"}).Credentials(context.Background()); err != ErrNoCredentials {
+		t.Fatalf("expected ErrNoCredentials, got %v", err)
+	}
+}
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(path, []byte("first\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := NewFile(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.CheckInterval = time.Millisecond
+
+	if c, _ := f.Credentials(context.Background()); c.DataToken != "first" {
+		t.Fatalf("unexpected token %q", c.DataToken)
+	}
+
+	// secret remount replaces the file
+	next := filepath.Join(dir, "token.new")
+	if err := ioutil.WriteFile(next, []byte("second-token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(next, path); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+
+	if c, _ := f.Credentials(context.Background()); c.DataToken != "second-token" {
+		t.Fatalf("expected rotated token, got %q", c.DataToken)
+	}
+
+	if _, err := NewFile(filepath.Join(dir, "missing"), ""); !os.IsNotExist(err) {
+		t.Fatalf("expected missing file error, got %v", err)
+	}
+}
+
+type failingProvider struct{}
+
+func (failingProvider) Credentials(ctx context.Context) (Credentials, error) {
+	return Credentials{}, errors.New("unavailable")
+}
+
+func TestChain(t *testing.T) {
+	chain := Chain{
+		failingProvider{},
+		Static{DataToken: "static-token"},
+		Static{DataToken: "ignored", AccessKey: "static-key"},
+	}
+	c, err := chain.Credentials(context.Background())
+	if err != nil || c.DataToken != "static-token" || c.AccessKey != "static-key" {
+		t.Fatalf("unexpected credentials %+v, %v", c, err)
+	}
+
+	if _, err := (Chain{failingProvider{}, Static{}}).Credentials(context.Background()); err == nil || err.Error() != "unavailable" {
+		t.Fatalf("expected provider error, got %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+// Package deadletter defines destinations for metrics rejected by Anodot, so they can be
+// inspected or resubmitted later instead of being lost.
+package deadletter
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// Record is a single rejected metric.
+type Record struct {
+	// metrics.Anodot20Metric or metrics3.AnodotMetrics30.
+	Metric interface{} `json:"metric"`
+	// Position of the metric in the submitted batch.
+	Index int `json:"index"`
+	// Anodot error code, zero if the whole request was rejected.
+	Code   int64     `json:"code,omitempty"`
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+}
+
+// Sink receives rejected metrics. Implementations should be safe for concurrent use.
+type Sink interface {
+	Write(records []Record) error
+}
+
+// SinkFunc adapts function to Sink.
+type SinkFunc func(records []Record) error
+
+func (f SinkFunc) Write(records []Record) error {
+	return f(records)
+}
+
+// ChannelSink sends records to a channel. Records are dropped with ErrChannelFull
+// if the channel has no room for them, so that submitters are never blocked.
+type ChannelSink chan<- Record
+
+var ErrChannelFull = errors.New("dead-letter channel is full")
+
+func (c ChannelSink) Write(records []Record) error {
+	for _, r := range records {
+		select {
+		case c <- r:
+		default:
+			return ErrChannelFull
+		}
+	}
+	return nil
+}
+
+// FileSink appends records to a file as JSON lines.
+type FileSink struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// Constructs new FileSink appending to the file at path, which is created if it does not exist.
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{f: f}, nil
+}
+
+func (s *FileSink) Write(records []Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w := bufio.NewWriter(s.f)
+	enc := json.NewEncoder(w)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.f.Close()
+}
@@ -0,0 +1,73 @@
+package deadletter
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "rejected.jsonl")
+	for i := 0; i < 2; i++ {
+		s, err := NewFileSink(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.Write([]Record{{Metric: map[string]string{"what": "cpu"}, Index: i, Code: 1001, Reason: "bad value", Time: time.Now()}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var lines int
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r struct {
+			Metric map[string]string
+			Index  int
+			Reason string
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		if r.Index != lines || r.Metric["what"] != "cpu" || r.Reason != "bad value" {
+			t.Errorf("unexpected record %s", scanner.Text())
+		}
+		lines++
+	}
+	if lines != 2 {
+		t.Errorf("expected 2 records appended, got %d", lines)
+	}
+}
+
+func TestChannelSink(t *testing.T) {
+	ch := make(chan Record, 1)
+	if err := ChannelSink(ch).Write([]Record{{Index: 0}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ChannelSink(ch).Write([]Record{{Index: 1}}); err != ErrChannelFull {
+		t.Errorf("expected ErrChannelFull, got %v", err)
+	}
+	if r := <-ch; r.Index != 0 {
+		t.Errorf("unexpected record %+v", r)
+	}
+}
@@ -0,0 +1,425 @@
+// Package diskqueue implements durable FIFO queue of byte records stored in a local directory.
+//
+// Records are appended to segment files which are rotated once they reach MaxSegmentSize
+// and deleted once all their records are consumed. Read position is persisted on every Pop,
+// so records which were pushed but not popped are returned again after process restart.
+package diskqueue
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrEmpty  = errors.New("disk queue is empty")
+	ErrFull   = errors.New("disk queue is full")
+	ErrClosed = errors.New("disk queue is closed")
+)
+
+const (
+	segmentExt = ".seg"
+	cursorFile = "cursor"
+	headerSize = 8
+)
+
+type Options struct {
+	// Directory for queue files. Created if it does not exist.
+	Dir string
+	// Segment file is rotated once it reaches this size. Defaults to 16MB.
+	MaxSegmentSize int64
+	// Maximum total size of records in the queue. Push returns ErrFull when the limit
+	// would be exceeded. Zero means no limit.
+	//
+	// Only records which are not popped yet are counted. Popped records stay on disk until
+	// their segment is consumed completely, so disk usage may exceed MaxSize by up to
+	// MaxSegmentSize.
+	MaxSize int64
+	// Sync segment file to disk after every Push.
+	Sync bool
+}
+
+type segment struct {
+	id   uint64
+	size int64
+}
+
+// Queue is durable FIFO queue. It is safe for concurrent use by multiple goroutines,
+// but only one Queue should be opened for a directory at a time.
+type Queue struct {
+	opts Options
+
+	mu       sync.Mutex
+	segments []segment
+	// read position in segments[0]
+	offset int64
+	count  int
+	size   int64
+	writer *os.File
+	closed bool
+}
+
+// Open opens queue in opts.Dir, restoring records left by previous process.
+func Open(opts Options) (*Queue, error) {
+	if opts.Dir == "" {
+		return nil, errors.New("queue directory should be provided")
+	}
+	if opts.MaxSegmentSize <= 0 {
+		opts.MaxSegmentSize = 16 << 20
+	}
+
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	q := &Queue{opts: opts}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+func (q *Queue) segmentPath(id uint64) string {
+	return filepath.Join(q.opts.Dir, fmt.Sprintf("%020d%s", id, segmentExt))
+}
+
+func (q *Queue) load() error {
+	files, err := ioutil.ReadDir(q.opts.Dir)
+	if err != nil {
+		return err
+	}
+
+	var ids []uint64
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), segmentExt) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	cursorId, cursorOffset, err := q.readCursor()
+	if err != nil {
+		return err
+	}
+
+	for i, id := range ids {
+		if id < cursorId {
+			// consumed segment which was not deleted before restart
+			_ = os.Remove(q.segmentPath(id))
+			continue
+		}
+
+		start := int64(0)
+		if id == cursorId {
+			start = cursorOffset
+		}
+
+		size, count, err := q.scan(id, start, i == len(ids)-1)
+		if err != nil {
+			return err
+		}
+		if start > size {
+			start = size
+		}
+
+		if len(q.segments) == 0 {
+			q.offset = start
+		}
+		q.segments = append(q.segments, segment{id: id, size: size})
+		q.count += count
+		q.size += size - start
+	}
+
+	if len(q.segments) == 0 {
+		q.segments = []segment{{id: cursorId}}
+		q.offset = 0
+	}
+
+	last := q.segments[len(q.segments)-1]
+	q.writer, err = os.OpenFile(q.segmentPath(last.id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	return err
+}
+
+// scan counts valid records of segment starting at offset start. Incomplete record at the end
+// of the newest segment is left by interrupted write and is truncated, invalid record anywhere
+// else means the segment is corrupted.
+func (q *Queue) scan(id uint64, start int64, newest bool) (int64, int, error) {
+	f, err := os.OpenFile(q.segmentPath(id), os.O_RDWR, 0644)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	offset, count := int64(0), 0
+	for offset < info.Size() {
+		_, n, err := readRecord(f, offset, info.Size())
+		if err != nil {
+			torn := errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+				offset+headerSize+int64(n) == info.Size()
+			if !newest || !torn {
+				return 0, 0, fmt.Errorf("queue segment %d is corrupted at offset %d: %w", id, offset, err)
+			}
+			break
+		}
+		offset += headerSize + int64(n)
+		if offset > start {
+			count++
+		}
+	}
+
+	if info.Size() != offset {
+		if err := f.Truncate(offset); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return offset, count, nil
+}
+
+// readRecord reads and validates record at offset of segment with the given size.
+// Record length is returned on checksum mismatch too.
+func readRecord(r io.ReaderAt, offset int64, size int64) ([]byte, uint32, error) {
+	header := make([]byte, headerSize)
+	if _, err := r.ReadAt(header, offset); err != nil {
+		return nil, 0, err
+	}
+
+	n := binary.BigEndian.Uint32(header[:4])
+	if offset+headerSize+int64(n) > size {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	data := make([]byte, n)
+	if _, err := r.ReadAt(data, offset+headerSize); err != nil {
+		return nil, 0, err
+	}
+
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, n, errors.New("record checksum mismatch")
+	}
+
+	return data, n, nil
+}
+
+func (q *Queue) readCursor() (uint64, int64, error) {
+	b, err := ioutil.ReadFile(filepath.Join(q.opts.Dir, cursorFile))
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(b) != 16 {
+		return 0, 0, fmt.Errorf("invalid queue cursor file size %d", len(b))
+	}
+	return binary.BigEndian.Uint64(b[:8]), int64(binary.BigEndian.Uint64(b[8:])), nil
+}
+
+func (q *Queue) writeCursor() error {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b[:8], q.segments[0].id)
+	binary.BigEndian.PutUint64(b[8:], uint64(q.offset))
+
+	path := filepath.Join(q.opts.Dir, cursorFile)
+	if err := ioutil.WriteFile(path+".tmp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Push appends record to the end of the queue.
+func (q *Queue) Push(data []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+
+	recordSize := int64(headerSize + len(data))
+	if q.opts.MaxSize > 0 && q.size+recordSize > q.opts.MaxSize {
+		return ErrFull
+	}
+
+	last := &q.segments[len(q.segments)-1]
+	if last.size > 0 && last.size+recordSize > q.opts.MaxSegmentSize {
+		if err := q.rotate(); err != nil {
+			return err
+		}
+		last = &q.segments[len(q.segments)-1]
+	}
+
+	record := make([]byte, recordSize)
+	binary.BigEndian.PutUint32(record[:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(data))
+	copy(record[headerSize:], data)
+
+	if _, err := q.writer.Write(record); err != nil {
+		// drop partially written record so that the segment stays readable
+		_ = q.writer.Truncate(last.size)
+		return err
+	}
+	if q.opts.Sync {
+		if err := q.writer.Sync(); err != nil {
+			return err
+		}
+	}
+
+	last.size += recordSize
+	q.size += recordSize
+	q.count++
+
+	return nil
+}
+
+func (q *Queue) rotate() error {
+	if err := q.writer.Close(); err != nil {
+		return err
+	}
+
+	id := q.segments[len(q.segments)-1].id + 1
+	w, err := os.OpenFile(q.segmentPath(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	q.writer = w
+	q.segments = append(q.segments, segment{id: id})
+	return nil
+}
+
+// Peek returns the oldest record without removing it. Returns ErrEmpty if queue has no records.
+func (q *Queue) Peek() ([]byte, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	data, _, err := q.peek()
+	return data, err
+}
+
+func (q *Queue) peek() ([]byte, int64, error) {
+	if q.closed {
+		return nil, 0, ErrClosed
+	}
+	if q.count == 0 {
+		return nil, 0, ErrEmpty
+	}
+
+	if err := q.skipConsumedSegments(); err != nil {
+		return nil, 0, err
+	}
+
+	f, err := os.Open(q.segmentPath(q.segments[0].id))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	data, n, err := readRecord(f, q.offset, q.segments[0].size)
+	if err != nil {
+		return nil, 0, err
+	}
+	return data, headerSize + int64(n), nil
+}
+
+// Pop removes the oldest record. It should be called once the record returned by Peek is processed.
+func (q *Queue) Pop() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	_, recordSize, err := q.peek()
+	if err != nil {
+		return err
+	}
+
+	q.offset += recordSize
+	q.size -= recordSize
+	q.count--
+
+	if err := q.skipConsumedSegments(); err != nil {
+		return err
+	}
+	return q.writeCursor()
+}
+
+// Replay passes records to send oldest first, removing every record for which send returns true.
+// It stops once the queue is empty, send returns false or the queue fails. Returns the queue error.
+func (q *Queue) Replay(send func(data []byte) bool) error {
+	for {
+		data, err := q.Peek()
+		if err == ErrEmpty {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !send(data) {
+			return nil
+		}
+		if err := q.Pop(); err != nil {
+			return err
+		}
+	}
+}
+
+// skipConsumedSegments deletes fully consumed segments, except the one being written.
+func (q *Queue) skipConsumedSegments() error {
+	for len(q.segments) > 1 && q.offset >= q.segments[0].size {
+		id := q.segments[0].id
+		q.segments = q.segments[1:]
+		q.offset = 0
+		if err := q.writeCursor(); err != nil {
+			return err
+		}
+		if err := os.Remove(q.segmentPath(id)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Len returns number of records in the queue.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.count
+}
+
+// Size returns total size of records in the queue, including record headers.
+// Popped records which are still on disk are not counted.
+func (q *Queue) Size() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size
+}
+
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+	q.closed = true
+	return q.writer.Close()
+}
@@ -0,0 +1,227 @@
+package diskqueue
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "diskqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func segmentFiles(t *testing.T, dir string) int {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(files)
+}
+
+func TestQueueOrderAndRotation(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	q, err := Open(Options{Dir: dir, MaxSegmentSize: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := q.Push([]byte(fmt.Sprintf("record-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if q.Len() != 10 {
+		t.Fatalf("expected 10 records, got %d", q.Len())
+	}
+	if n := segmentFiles(t, dir); n < 2 {
+		t.Fatalf("expected segments to be rotated, got %d segment", n)
+	}
+
+	for i := 0; i < 10; i++ {
+		data, err := q.Peek()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != fmt.Sprintf("record-%d", i) {
+			t.Fatalf("expected record-%d, got %s", i, data)
+		}
+		if err := q.Pop(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := q.Peek(); err != ErrEmpty {
+		t.Fatalf("expected ErrEmpty, got %v", err)
+	}
+	if n := segmentFiles(t, dir); n != 1 {
+		t.Fatalf("expected consumed segments to be deleted, got %d segments", n)
+	}
+	if q.Size() != 0 {
+		t.Fatalf("expected empty queue size, got %d", q.Size())
+	}
+}
+
+func TestQueueRestart(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	q, err := Open(Options{Dir: dir, MaxSegmentSize: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		if err := q.Push([]byte(fmt.Sprintf("record-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		if err := q.Pop(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate write interrupted by crash
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	f, err := os.OpenFile(segments[len(segments)-1], os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.Write([]byte{0, 0, 0, 100, 1, 2})
+	f.Close()
+
+	q, err = Open(Options{Dir: dir, MaxSegmentSize: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	if q.Len() != 2 {
+		t.Fatalf("expected 2 records after restart, got %d", q.Len())
+	}
+	if err := q.Push([]byte("record-6")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{"record-4", "record-5", "record-6"} {
+		data, err := q.Peek()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expected {
+			t.Fatalf("expected %s, got %s", expected, data)
+		}
+		if err := q.Pop(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestQueueMaxSize(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	q, err := Open(Options{Dir: dir, MaxSize: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	if err := q.Push(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Push(make([]byte, 10)); err != ErrFull {
+		t.Fatalf("expected ErrFull, got %v", err)
+	}
+	if err := q.Pop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Push(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueueCorruptedSegment(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	q, err := Open(Options{Dir: dir, MaxSegmentSize: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := q.Push([]byte(fmt.Sprintf("record-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// flipped byte in the first record of the oldest segment is not a torn write
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	before, err := os.Stat(segments[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(segments[0], os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteAt([]byte{'X'}, headerSize)
+	f.Close()
+
+	if _, err := Open(Options{Dir: dir, MaxSegmentSize: 64}); err == nil {
+		t.Fatal("expected error for corrupted segment")
+	}
+	if after, err := os.Stat(segments[0]); err != nil || after.Size() != before.Size() {
+		t.Fatalf("corrupted segment should not be truncated: %v", err)
+	}
+}
+
+func TestQueueReplay(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	q, err := Open(Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := q.Push([]byte(fmt.Sprintf("record-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var sent []string
+	err = q.Replay(func(data []byte) bool {
+		sent = append(sent, string(data))
+		return len(sent) < 2
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 2 || sent[1] != "record-1" || q.Len() != 2 {
+		t.Fatalf("expected replay to stop at record-1 and keep it, sent %v, %d left", sent, q.Len())
+	}
+
+	sent = nil
+	if err := q.Replay(func(data []byte) bool { sent = append(sent, string(data)); return true }); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 2 || sent[0] != "record-1" || q.Len() != 0 {
+		t.Fatalf("expected remaining records to be replayed, sent %v, %d left", sent, q.Len())
+	}
+}
@@ -0,0 +1,187 @@
+// Package graphite converts between Anodot 2.0 metrics and carbon line protocol, both in plain
+// Graphite form ("servers.web1.cpu;dc=eu 0.5 1590000000") and in Metrics 2.0 dotted key=value
+// form ("what=cpu.target_type=gauge.host=web1 0.5 1590000000").
+package graphite
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anodot/anodot-common/pkg/metrics"
+)
+
+type Format int
+
+const (
+	// Graphite plaintext protocol. Metric path is taken from "what" property, other properties
+	// are written as Graphite tags.
+	Plaintext Format = iota
+	// Carbon Metrics 2.0 form where the metric path consists of key=value nodes.
+	Metrics20
+)
+
+// DefaultTargetType is target_type given to parsed metrics whose path does not set it.
+const DefaultTargetType = "gauge"
+
+// ParseLine parses single carbon line "<path> <value> <timestamp>". Metrics 2.0 path, in which
+// every node is key=value, is converted to properties. Any other path becomes "what" property
+// and its Graphite tags (path;tag=value) become the other properties.
+// Timestamp -1 means current time.
+//
+// Anodot requires target_type property, so metrics without it get targetType, or DefaultTargetType
+// if targetType is empty.
+func ParseLine(line string, targetType string) (metrics.Anodot20Metric, error) {
+	var m metrics.Anodot20Metric
+
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return m, fmt.Errorf("invalid carbon line %q", line)
+	}
+
+	props, err := parsePath(fields[0])
+	if err != nil {
+		return m, err
+	}
+
+	v, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return m, fmt.Errorf("invalid value %q of metric %s", fields[1], fields[0])
+	}
+
+	ts, err := strconv.ParseFloat(fields[2], 64)
+	if err != nil {
+		return m, fmt.Errorf("invalid timestamp %q of metric %s", fields[2], fields[0])
+	}
+	t := time.Now()
+	if ts >= 0 {
+		sec, frac := math.Modf(ts)
+		t = time.Unix(int64(sec), int64(frac*1e9))
+	}
+
+	if props["target_type"] == "" {
+		if targetType == "" {
+			targetType = DefaultTargetType
+		}
+		props["target_type"] = targetType
+	}
+
+	m.Properties = props
+	m.Value = v
+	m.Timestamp = metrics.AnodotTimestamp{Time: t}
+	return m, nil
+}
+
+func parsePath(path string) (map[string]string, error) {
+	if IsMetrics20(path) {
+		props := make(map[string]string)
+		for _, node := range strings.Split(path, ".") {
+			i := strings.IndexByte(node, '=')
+			props[node[:i]] = node[i+1:]
+		}
+		if props["what"] == "" {
+			return nil, fmt.Errorf("metrics 2.0 path %s has no what property", path)
+		}
+		return props, nil
+	}
+
+	parts := strings.Split(path, ";")
+	if parts[0] == "" {
+		return nil, fmt.Errorf("invalid metric path %q", path)
+	}
+
+	props := map[string]string{"what": parts[0]}
+	for _, tag := range parts[1:] {
+		i := strings.IndexByte(tag, '=')
+		if i <= 0 || i == len(tag)-1 {
+			return nil, fmt.Errorf("invalid tag %q of metric %s", tag, parts[0])
+		}
+		props[tag[:i]] = tag[i+1:]
+	}
+	return props, nil
+}
+
+// IsMetrics20 reports whether every node of the metric path is key=value pair.
+func IsMetrics20(path string) bool {
+	if path == "" {
+		return false
+	}
+	for _, node := range strings.Split(path, ".") {
+		i := strings.IndexByte(node, '=')
+		if i <= 0 || i == len(node)-1 {
+			return false
+		}
+	}
+	return true
+}
+
+// FormatLine formats metric as carbon line, including the trailing newline.
+// Properties are written in key order, empty ones are skipped; Tags of the metric are not written.
+//
+// Dots, spaces, '=' and ';' in Metrics 2.0 keys and values are replaced with underscores,
+// as done by Anodot20Metric JSON encoding. In Plaintext format, "what" property is used as the
+// metric path as is and other properties are written as Graphite tags.
+func FormatLine(m metrics.Anodot20Metric, format Format) (string, error) {
+	keys := make([]string, 0, len(m.Properties))
+	for k := range m.Properties {
+		if k != "what" && strings.TrimSpace(k) != "" && strings.TrimSpace(m.Properties[k]) != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	what := strings.TrimSpace(m.Properties["what"])
+	if what == "" {
+		return "", fmt.Errorf("metric has no what property")
+	}
+
+	var b strings.Builder
+	switch format {
+	case Metrics20:
+		b.WriteString("what=")
+		b.WriteString(sanitize(what))
+		for _, k := range keys {
+			b.WriteByte('.')
+			b.WriteString(sanitize(k))
+			b.WriteByte('=')
+			b.WriteString(sanitize(m.Properties[k]))
+		}
+	case Plaintext:
+		if strings.ContainsAny(what, " ;") {
+			return "", fmt.Errorf("invalid graphite path %q", what)
+		}
+		b.WriteString(what)
+		for _, k := range keys {
+			b.WriteByte(';')
+			b.WriteString(sanitizeTag(k))
+			b.WriteByte('=')
+			b.WriteString(sanitizeTag(m.Properties[k]))
+		}
+	default:
+		return "", fmt.Errorf("unknown format %d", format)
+	}
+
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatFloat(m.Value, 'f', -1, 64))
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatInt(m.Timestamp.Unix(), 10))
+	b.WriteByte('\n')
+
+	return b.String(), nil
+}
+
+var (
+	metrics20Replacer = strings.NewReplacer(".", "_", "=", "_", " ", "_", ";", "_")
+	tagReplacer       = strings.NewReplacer(" ", "_", ";", "_", "=", "_", "~", "_")
+)
+
+func sanitize(s string) string {
+	return metrics20Replacer.Replace(strings.TrimSpace(s))
+}
+
+func sanitizeTag(s string) string {
+	return tagReplacer.Replace(strings.TrimSpace(s))
+}
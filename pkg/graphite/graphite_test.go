@@ -0,0 +1,85 @@
+package graphite
+
+import (
+	"testing"
+	"time"
+
+	"github.com/anodot/anodot-common/pkg/metrics"
+)
+
+func TestParseLine(t *testing.T) {
+	m, err := ParseLine("what=cpu_usage.target_type=gauge.host=web1 0.5 1590000000", "counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Properties["what"] != "cpu_usage" || m.Properties["target_type"] != "gauge" || m.Properties["host"] != "web1" ||
+		m.Value != 0.5 || m.Timestamp.Unix() != 1590000000 {
+		t.Fatalf("unexpected metric %+v", m)
+	}
+
+	m, err = ParseLine("servers.web1.cpu;dc=eu;role=api 12 1590000000", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Properties) != 4 || m.Properties["what"] != "servers.web1.cpu" || m.Properties["dc"] != "eu" ||
+		m.Properties["target_type"] != DefaultTargetType {
+		t.Fatalf("unexpected properties %v", m.Properties)
+	}
+
+	m, err = ParseLine("what=requests.host=web1 5 1590000000", "counter")
+	if err != nil || m.Properties["target_type"] != "counter" {
+		t.Fatalf("expected default target type, got %+v, %v", m, err)
+	}
+
+	m, err = ParseLine("servers.web1.cpu 1 -1", "")
+	if err != nil || time.Since(m.Timestamp.Time) > time.Minute {
+		t.Fatalf("expected current timestamp, got %+v, %v", m, err)
+	}
+
+	for _, line := range []string{
+		"metric 1",
+		"metric abc 1590000000",
+		"metric NaN 1590000000",
+		"metric 1 abc",
+		"host=web1.target_type=gauge 1 1590000000",
+		"metric;dc 1 1590000000",
+	} {
+		if _, err := ParseLine(line, ""); err == nil {
+			t.Fatalf("expected error for %q", line)
+		}
+	}
+}
+
+func TestFormatLine(t *testing.T) {
+	m := metrics.Anodot20Metric{
+		Properties: map[string]string{"what": "cpu usage", "host": "web1.example.com", "target_type": "gauge", "empty": ""},
+		Timestamp:  metrics.AnodotTimestamp{Time: time.Unix(1590000000, 0)},
+		Value:      0.25,
+	}
+
+	line, err := FormatLine(m, Metrics20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "what=cpu_usage.host=web1_example_com.target_type=gauge 0.25 1590000000\n"; line != expected {
+		t.Fatalf("expected %q, got %q", expected, line)
+	}
+
+	parsed, err := ParseLine(line, "")
+	if err != nil || parsed.Properties["host"] != "web1_example_com" || parsed.Value != m.Value {
+		t.Fatalf("formatted line should parse back, got %+v, %v", parsed, err)
+	}
+
+	if _, err := FormatLine(m, Plaintext); err == nil {
+		t.Fatal("expected error for graphite path with space")
+	}
+
+	m.Properties["what"] = "servers.web1.cpu"
+	line, err = FormatLine(m, Plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "servers.web1.cpu;host=web1.example.com;target_type=gauge 0.25 1590000000\n"; line != expected {
+		t.Fatalf("expected %q, got %q", expected, line)
+	}
+}
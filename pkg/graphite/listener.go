@@ -0,0 +1,163 @@
+package graphite
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/anodot/anodot-common/pkg/metrics"
+)
+
+type ListenerOptions struct {
+	// Maximum number of metrics submitted at once. Defaults to 1000.
+	BatchSize int
+	// Called after every submission.
+	OnResult func(metrics.BatchResult)
+	// Called for every line which could not be parsed.
+	OnParseError func(line string, err error)
+	// target_type of metrics whose path does not set it, gauge or counter. Defaults to DefaultTargetType.
+	TargetType string
+}
+
+// Listener accepts carbon line protocol over TCP, in plain Graphite or Metrics 2.0 form, and submits
+// received metrics with the Submitter. Metrics read from a connection are submitted once BatchSize
+// of them are collected, or when no more data is immediately available on the connection.
+//
+// Listener does not buffer metrics across connections, so wrapping the submitter with
+// metrics.BatchSubmitter is recommended when senders write few metrics at a time.
+type Listener struct {
+	submitter metrics.Submitter
+	opts      ListenerOptions
+	listener  net.Listener
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// Constructs new Listener on TCP address addr, e.g. ":2003", and starts accepting connections.
+// Close should be called to release it.
+func NewListener(addr string, submitter metrics.Submitter, opts ListenerOptions) (*Listener, error) {
+	if submitter == nil {
+		return nil, errors.New("submitter should not be nil")
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 1000
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Listener{
+		submitter: submitter,
+		opts:      opts,
+		listener:  ln,
+		conns:     make(map[net.Conn]struct{}),
+	}
+
+	l.wg.Add(1)
+	go l.accept()
+
+	return l, nil
+}
+
+// Addr returns address the listener accepts connections on.
+func (l *Listener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// Close stops accepting connections, closes the open ones and waits until metrics
+// already read from them are submitted.
+func (l *Listener) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return errors.New("graphite listener is closed")
+	}
+	l.closed = true
+	err := l.listener.Close()
+	for c := range l.conns {
+		_ = c.Close()
+	}
+	l.mu.Unlock()
+
+	l.wg.Wait()
+	return err
+}
+
+func (l *Listener) accept() {
+	defer l.wg.Done()
+
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			l.mu.Lock()
+			closed := l.closed
+			l.mu.Unlock()
+			if closed {
+				return
+			}
+			continue
+		}
+
+		l.mu.Lock()
+		if l.closed {
+			l.mu.Unlock()
+			_ = conn.Close()
+			return
+		}
+		l.conns[conn] = struct{}{}
+		l.wg.Add(1)
+		l.mu.Unlock()
+
+		go l.handle(conn)
+	}
+}
+
+func (l *Listener) handle(conn net.Conn) {
+	defer l.wg.Done()
+	defer func() {
+		l.mu.Lock()
+		delete(l.conns, conn)
+		l.mu.Unlock()
+		_ = conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	batch := make([]metrics.Anodot20Metric, 0, l.opts.BatchSize)
+
+	for {
+		line, err := r.ReadString('\n')
+		if line = strings.TrimSpace(line); line != "" {
+			m, parseErr := ParseLine(line, l.opts.TargetType)
+			if parseErr != nil {
+				if l.opts.OnParseError != nil {
+					l.opts.OnParseError(line, parseErr)
+				}
+			} else {
+				batch = append(batch, m)
+			}
+		}
+
+		if len(batch) > 0 && (len(batch) >= l.opts.BatchSize || r.Buffered() == 0 || err != nil) {
+			l.submit(batch)
+			batch = make([]metrics.Anodot20Metric, 0, l.opts.BatchSize)
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (l *Listener) submit(batch []metrics.Anodot20Metric) {
+	resp, err := l.submitter.SubmitMetrics(batch)
+	if l.opts.OnResult != nil {
+		l.opts.OnResult(metrics.BatchResult{Metrics: batch, Response: resp, Err: err})
+	}
+}
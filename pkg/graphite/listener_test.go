@@ -0,0 +1,127 @@
+package graphite
+
+import (
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anodot/anodot-common/pkg/anodottest"
+	"github.com/anodot/anodot-common/pkg/metrics"
+)
+
+type recordingSubmitter struct {
+	mu      sync.Mutex
+	metrics []metrics.Anodot20Metric
+}
+
+func (s *recordingSubmitter) SubmitMetrics(m []metrics.Anodot20Metric) (metrics.AnodotResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.metrics = append(s.metrics, m...)
+	return &metrics.CreateResponse{}, nil
+}
+
+func (s *recordingSubmitter) AnodotURL() *url.URL {
+	return &url.URL{Scheme: "http", Host: "localhost"}
+}
+
+func TestListener(t *testing.T) {
+	rs := &recordingSubmitter{}
+	var parseErrors []string
+	var mu sync.Mutex
+
+	l, err := NewListener("127.0.0.1:0", rs, ListenerOptions{BatchSize: 2, OnParseError: func(line string, err error) {
+		mu.Lock()
+		parseErrors = append(parseErrors, line)
+		mu.Unlock()
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Write([]byte("servers.web1.cpu 1 1590000000\nwhat=mem.host=web1 2 1590000000\nbroken\nservers.web2.cpu 3 1590000000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// wait until the connection is handled
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		l.mu.Lock()
+		n := len(l.conns)
+		l.mu.Unlock()
+		rs.mu.Lock()
+		received := len(rs.metrics)
+		rs.mu.Unlock()
+		if n == 0 && received == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 3 metrics to be submitted, got %d", received)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if rs.metrics[1].Properties["what"] != "mem" || rs.metrics[2].Value != 3 {
+		t.Fatalf("unexpected metrics %+v", rs.metrics)
+	}
+	if len(parseErrors) != 1 || parseErrors[0] != "broken" {
+		t.Fatalf("unexpected parse errors %v", parseErrors)
+	}
+}
+
+func TestListenerToAnodot(t *testing.T) {
+	srv := anodottest.NewServer()
+	defer srv.Close()
+
+	client, err := metrics.NewAnodot20Client(*srv.URL(), anodottest.DataToken, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := make(chan metrics.BatchResult, 2)
+	l, err := NewListener("127.0.0.1:0", client, ListenerOptions{OnResult: func(r metrics.BatchResult) { results <- r }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// plain graphite and metrics 2.0 lines, as written by existing senders
+	if _, err := conn.Write([]byte("servers.web1.cpu;dc=eu 0.5 1590000000\nwhat=mem.host=web1 2 1590000000\n")); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// lines may be submitted together or one by one
+	for submitted := 0; submitted < 2; {
+		select {
+		case r := <-results:
+			if r.Err != nil {
+				t.Fatalf("expected metrics to be accepted, got %v", r.Err)
+			}
+			submitted += len(r.Metrics)
+		case <-time.After(5 * time.Second):
+			t.Fatal("metrics were not submitted")
+		}
+	}
+
+	m := srv.Metrics()
+	if len(m) != 2 || m[0].Properties["target_type"] != DefaultTargetType || m[1].Properties["target_type"] != DefaultTargetType {
+		t.Fatalf("unexpected metrics %+v", m)
+	}
+}
@@ -0,0 +1,181 @@
+package httplog
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HAR records HTTP exchanges in HTTP Archive 1.2 format, which can be imported into browser
+// dev tools or other HTTP tools. Secrets are redacted, bodies are recorded uncompressed and
+// not truncated.
+type HAR struct {
+	mu      sync.Mutex
+	entries []harEntry
+}
+
+// Constructs new empty HAR recorder.
+func NewHAR() *HAR {
+	return &HAR{}
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	Cookies     []harNameValue `json:"cookies"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Headers     []harNameValue `json:"headers"`
+	Cookies     []harNameValue `json:"cookies"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harTimings struct {
+	Send    int `json:"send"`
+	Wait    int `json:"wait"`
+	Receive int `json:"receive"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            int         `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+func (h *HAR) add(start time.Time, elapsed time.Duration, r *http.Request, reqBody []byte, resp *http.Response, respBody []byte) {
+	ms := int(elapsed / time.Millisecond)
+	e := harEntry{
+		StartedDateTime: start.UTC().Format(time.RFC3339Nano),
+		Time:            ms,
+		Request: harRequest{
+			Method:      r.Method,
+			URL:         RedactURL(r.URL),
+			HTTPVersion: r.Proto,
+			Headers:     harHeaders(RedactHeader(r.Header)),
+			Cookies:     []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    len(reqBody),
+		},
+		Response: harResponse{
+			HTTPVersion: "HTTP/1.1",
+			Headers:     []harNameValue{},
+			Cookies:     []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+		Timings: harTimings{Send: 0, Wait: ms, Receive: 0},
+	}
+	if e.Request.HTTPVersion == "" {
+		e.Request.HTTPVersion = "HTTP/1.1"
+	}
+
+	e.Request.QueryString = []harNameValue{}
+	if r.URL != nil {
+		if u, err := r.URL.Parse(RedactURL(r.URL)); err == nil {
+			for k, values := range u.Query() {
+				for _, v := range values {
+					e.Request.QueryString = append(e.Request.QueryString, harNameValue{k, v})
+				}
+			}
+			sort.Slice(e.Request.QueryString, func(i, j int) bool {
+				return e.Request.QueryString[i].Name < e.Request.QueryString[j].Name
+			})
+		}
+	}
+	if len(reqBody) > 0 {
+		e.Request.PostData = &harPostData{MimeType: r.Header.Get("Content-Type"), Text: RedactText(string(reqBody))}
+	}
+
+	if resp != nil {
+		body := decodedBody(resp.Header, respBody)
+		e.Response.Status = resp.StatusCode
+		e.Response.StatusText = http.StatusText(resp.StatusCode)
+		if resp.Proto != "" {
+			e.Response.HTTPVersion = resp.Proto
+		}
+		e.Response.Headers = harHeaders(RedactHeader(resp.Header))
+		e.Response.BodySize = len(respBody)
+		e.Response.Content = harContent{Size: len(body), MimeType: resp.Header.Get("Content-Type"), Text: RedactText(string(body))}
+	} else {
+		e.Comment = "no response received"
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.entries = append(h.entries, e)
+}
+
+func harHeaders(h http.Header) []harNameValue {
+	headers := make([]harNameValue, 0, len(h))
+	for name, values := range h {
+		for _, v := range values {
+			headers = append(headers, harNameValue{name, v})
+		}
+	}
+	sort.Slice(headers, func(i, j int) bool { return headers[i].Name < headers[j].Name })
+	return headers
+}
+
+// Len returns number of recorded exchanges.
+func (h *HAR) Len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.entries)
+}
+
+// WriteTo writes recorded exchanges as HAR JSON document.
+func (h *HAR) WriteTo(w io.Writer) (int64, error) {
+	h.mu.Lock()
+	entries := append([]harEntry{}, h.entries...)
+	h.mu.Unlock()
+
+	doc := map[string]interface{}{
+		"log": map[string]interface{}{
+			"version": "1.2",
+			"creator": map[string]string{"name": "anodot-common", "version": "1.0"},
+			"entries": entries,
+		},
+	}
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(append(data, '\n'))
+	return int64(n), err
+}
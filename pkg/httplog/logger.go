@@ -0,0 +1,142 @@
+// Package httplog logs HTTP exchanges of Anodot clients with secrets redacted.
+package httplog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	default:
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+}
+
+// Field is a key-value pair attached to a log record.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Logger receives structured log records. Implementations should be safe for concurrent use.
+// It can be implemented on top of any logging library.
+type Logger interface {
+	// Enabled reports whether records of the level are logged, so expensive fields can be skipped.
+	Enabled(level Level) bool
+	Log(level Level, msg string, fields ...Field)
+}
+
+// StreamLogger writes records of at least Level to a writer, one per line.
+type StreamLogger struct {
+	Level Level
+
+	mu   sync.Mutex
+	w    io.Writer
+	json bool
+}
+
+// Constructs new logger writing records in logfmt format: time=... level=info msg="..." key=value.
+func NewTextLogger(w io.Writer, level Level) *StreamLogger {
+	return &StreamLogger{Level: level, w: w}
+}
+
+// Constructs new logger writing records as JSON objects.
+func NewJSONLogger(w io.Writer, level Level) *StreamLogger {
+	return &StreamLogger{Level: level, w: w, json: true}
+}
+
+func (l *StreamLogger) Enabled(level Level) bool {
+	return level >= l.Level
+}
+
+func (l *StreamLogger) Log(level Level, msg string, fields ...Field) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	var line []byte
+	if l.json {
+		record := make(map[string]interface{}, len(fields)+3)
+		for _, f := range fields {
+			record[f.Key] = jsonValue(f.Value)
+		}
+		record["time"], record["level"], record["msg"] = now, level.String(), msg
+		line, _ = json.Marshal(record)
+	} else {
+		var b strings.Builder
+		b.WriteString("time=" + now + " level=" + level.String() + " msg=" + quote(msg))
+		for _, f := range fields {
+			b.WriteString(" " + f.Key + "=" + quote(textValue(f.Value)))
+		}
+		line = []byte(b.String())
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.w.Write(append(line, '\n'))
+}
+
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return v
+	}
+}
+
+func textValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+
+	switch reflect.ValueOf(v).Kind() {
+	case reflect.Map, reflect.Slice, reflect.Struct:
+		if b, err := json.Marshal(v); err == nil {
+			return string(b)
+		}
+	}
+	return fmt.Sprint(v)
+}
+
+// quote quotes s if it is empty or contains characters which would break logfmt parsing.
+func quote(s string) string {
+	if s == "" || strings.ContainsAny(s, " =\"\t\r\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
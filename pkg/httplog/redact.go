@@ -0,0 +1,122 @@
+package httplog
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Redacted replaces secret values.
+const Redacted = "REDACTED"
+
+// Query parameters, headers and JSON keys which hold secrets, lower case.
+var (
+	secretParams  = map[string]bool{"token": true, "access_token": true, "apikey": true, "api_key": true, "key": true, "password": true, "refreshtoken": true}
+	secretHeaders = map[string]bool{"authorization": true, "proxy-authorization": true, "cookie": true, "set-cookie": true, "x-api-key": true}
+
+	secretJSON = regexp.MustCompile(`(?i)("(?:token|refreshToken|accessKey|access_token|apiKey|password|secret)"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+	// JWT tokens anywhere in text
+	jwtToken = regexp.MustCompile(`eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+	// token query parameter in URLs embedded in text, e.g. error messages
+	secretParam = regexp.MustCompile(`(?i)([?&](?:token|access_token|apikey|api_key|key|password|refreshtoken)=)[^&\s"']*`)
+	// bearer token in text
+	bearerToken = regexp.MustCompile(`(Bearer\s+)[A-Za-z0-9._~+/=-]{8,}`)
+)
+
+// RedactURL returns u as string with values of secret query parameters and password replaced.
+func RedactURL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+
+	redacted := *u
+	if _, ok := redacted.User.Password(); ok {
+		redacted.User = url.UserPassword(redacted.User.Username(), Redacted)
+	}
+
+	q := redacted.Query()
+	changed := false
+	for k := range q {
+		if secretParams[strings.ToLower(k)] {
+			q.Set(k, Redacted)
+			changed = true
+		}
+	}
+	if changed {
+		redacted.RawQuery = q.Encode()
+	}
+	return redacted.String()
+}
+
+// RedactHeader returns copy of h with secret header values replaced. Authorization scheme is kept.
+func RedactHeader(h http.Header) http.Header {
+	redacted := make(http.Header, len(h))
+	for k, values := range h {
+		if !secretHeaders[strings.ToLower(k)] {
+			redacted[k] = append([]string(nil), values...)
+			continue
+		}
+
+		for _, v := range values {
+			if i := strings.IndexByte(v, ' '); i > 0 && strings.HasPrefix(strings.ToLower(k), "authorization") {
+				v = v[:i+1] + Redacted
+			} else {
+				v = Redacted
+			}
+			redacted[k] = append(redacted[k], v)
+		}
+	}
+	return redacted
+}
+
+// RedactText replaces secrets found in text: values of secret JSON keys, JWT tokens,
+// bearer tokens and secret query parameters of URLs.
+func RedactText(s string) string {
+	s = secretJSON.ReplaceAllString(s, `$1"`+Redacted+`"`)
+	s = jwtToken.ReplaceAllString(s, Redacted)
+	s = bearerToken.ReplaceAllString(s, "${1}"+Redacted)
+	return secretParam.ReplaceAllString(s, "${1}"+Redacted)
+}
+
+// RedactError returns err with secrets removed from its message, or err itself if there is nothing
+// to redact. *url.Error is copied with redacted URL, so it is still found by errors.As and keeps its
+// Timeout and Temporary methods. Other errors are wrapped, and errors.Unwrap returns the original.
+func RedactError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if urlErr, ok := err.(*url.Error); ok {
+		redacted := *urlErr
+		if u, parseErr := url.Parse(urlErr.URL); parseErr == nil {
+			redacted.URL = RedactURL(u)
+		} else {
+			redacted.URL = RedactText(urlErr.URL)
+		}
+		redacted.Err = RedactError(urlErr.Err)
+		if redacted.URL == urlErr.URL && redacted.Err == urlErr.Err {
+			return err
+		}
+		return &redacted
+	}
+
+	msg := err.Error()
+	if redacted := RedactText(msg); redacted != msg {
+		return &redactedError{msg: redacted, err: err}
+	}
+	return err
+}
+
+type redactedError struct {
+	msg string
+	err error
+}
+
+func (e *redactedError) Error() string {
+	return e.msg
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
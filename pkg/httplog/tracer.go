@@ -0,0 +1,206 @@
+package httplog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Tracer logs HTTP exchanges. Every exchange is logged at info level with method, URL, status
+// and duration, or at warn level if it failed. Debug level adds headers and bodies. Secrets are
+// redacted in all of them.
+type Tracer struct {
+	Logger Logger
+	// Bodies logged at debug level are truncated to MaxBodySize bytes. Defaults to 2048,
+	// negative value disables logging of bodies.
+	MaxBodySize int
+	// Add curl command reproducing the request to debug records.
+	Curl bool
+	// Optional recorder of all exchanges in HAR format, regardless of Logger level.
+	HAR *HAR
+}
+
+// Do sends request using next and logs the exchange. Nil Tracer only calls next.
+func (t *Tracer) Do(r *http.Request, next func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	if t == nil || (t.Logger == nil && t.HAR == nil) {
+		return next(r)
+	}
+
+	debug := t.Logger != nil && t.Logger.Enabled(LevelDebug)
+	capture := debug || t.HAR != nil
+
+	var reqBody []byte
+	if capture {
+		reqBody = requestBody(r)
+	}
+
+	start := time.Now()
+	resp, err := next(r)
+	elapsed := time.Since(start)
+
+	var respBody []byte
+	if capture && resp != nil && resp.Body != nil {
+		respBody, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+	}
+
+	if t.HAR != nil {
+		t.HAR.add(start, elapsed, r, reqBody, resp, respBody)
+	}
+	if t.Logger == nil {
+		return resp, err
+	}
+
+	fields := []Field{
+		{"method", r.Method},
+		{"url", RedactURL(r.URL)},
+		{"duration", elapsed},
+	}
+	level := LevelInfo
+	if err != nil {
+		level = LevelWarn
+		fields = append(fields, Field{"error", RedactText(err.Error())})
+	} else {
+		fields = append(fields, Field{"status", resp.StatusCode})
+		if resp.StatusCode >= 400 {
+			level = LevelWarn
+		}
+	}
+
+	if debug {
+		fields = append(fields, Field{"request_headers", flatHeader(RedactHeader(r.Header))})
+		if body := t.truncate(reqBody); body != "" {
+			fields = append(fields, Field{"request_body", body})
+		}
+		if resp != nil {
+			fields = append(fields, Field{"response_headers", flatHeader(RedactHeader(resp.Header))})
+			if body := t.truncate(decodedBody(resp.Header, respBody)); body != "" {
+				fields = append(fields, Field{"response_body", body})
+			}
+		}
+		if t.Curl {
+			fields = append(fields, Field{"curl", curlCommand(r, reqBody)})
+		}
+	}
+
+	t.Logger.Log(level, "anodot http request", fields...)
+	return resp, err
+}
+
+func (t *Tracer) truncate(body []byte) string {
+	max := t.MaxBodySize
+	if max == 0 {
+		max = 2048
+	}
+	if max < 0 || len(body) == 0 {
+		return ""
+	}
+
+	s := RedactText(string(body))
+	if len(s) > max {
+		s = s[:max] + "...(truncated)"
+	}
+	return s
+}
+
+// requestBody returns uncompressed request body, leaving the request body intact.
+func requestBody(r *http.Request) []byte {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+
+	var data []byte
+	if r.GetBody != nil {
+		body, err := r.GetBody()
+		if err != nil {
+			return nil
+		}
+		data, _ = ioutil.ReadAll(body)
+		body.Close()
+	} else {
+		data, _ = ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(data))
+	}
+	return decodedBody(r.Header, data)
+}
+
+// decodedBody decompresses gzip encoded body, other bodies are returned as is.
+func decodedBody(h http.Header, body []byte) []byte {
+	if !strings.EqualFold(h.Get("Content-Encoding"), "gzip") || len(body) == 0 {
+		return body
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return body
+	}
+	decoded, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return body
+	}
+	return decoded
+}
+
+// flatHeader renders header as "Name: value; Name: value" in name order.
+func flatHeader(h http.Header) string {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, name+": "+strings.Join(h[name], ", "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// curlCommand returns curl command reproducing the request with secrets redacted.
+// Compressed body is sent uncompressed.
+func curlCommand(r *http.Request, body []byte) string {
+	var b strings.Builder
+	b.WriteString("curl -X " + r.Method + " " + shellQuote(RedactURL(r.URL)))
+
+	h := RedactHeader(r.Header)
+	h.Del("Content-Encoding")
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range h[name] {
+			b.WriteString(" -H " + shellQuote(name+": "+v))
+		}
+	}
+
+	if len(body) > 0 {
+		b.WriteString(" --data-binary " + shellQuote(RedactText(string(body))))
+	}
+	return b.String()
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Transport is http.RoundTripper which logs requests with Tracer.
+type Transport struct {
+	// Defaults to http.DefaultTransport.
+	Base   http.RoundTripper
+	Tracer *Tracer
+}
+
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return t.Tracer.Do(r, base.RoundTrip)
+}
@@ -0,0 +1,282 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/anodot/anodot-common/pkg/deadletter"
+	"github.com/anodot/anodot-common/pkg/diskqueue"
+)
+
+var (
+	ErrBufferFull      = errors.New("batch submitter buffer is full")
+	ErrSubmitterClosed = errors.New("batch submitter is closed")
+)
+
+// Result of a single batch submission made by BatchSubmitter.
+type BatchResult struct {
+	Metrics  []Anodot20Metric
+	Response AnodotResponse
+	Err      error
+	// Metrics of partly delivered batch which failed temporarily and were stored in BatchOptions.Queue.
+	// They are reported again once resent.
+	Queued []Anodot20Metric
+	// Error of writing rejected and permanently failed metrics to BatchOptions.DeadLetter.
+	DeadLetterErr error
+}
+
+type BatchOptions struct {
+	// Maximum number of metrics sent in one request. Defaults to 1000.
+	MaxBatchSize int
+	// Maximum time metrics stay in the buffer before being sent. Defaults to 10 seconds.
+	FlushInterval time.Duration
+	// Maximum number of buffered metrics. When the limit is reached, SubmitMetrics
+	// rejects new metrics with ErrBufferFull. Defaults to 10 * MaxBatchSize.
+	BufferSize int
+	// Called from the background goroutine after every submitted batch.
+	OnResult func(BatchResult)
+	// Optional durable queue for batches which could not be delivered because of network
+	// failure or temporary API error. Queued batches are resent oldest first on every flush,
+	// also after process restart, and their results are reported once they are delivered
+	// or rejected permanently. The queue is not closed by BatchSubmitter.
+	Queue *diskqueue.Queue
+	// Optional sink receiving metrics rejected by Anodot or failed permanently, e.g. because they
+	// could not be encoded, before OnResult is called.
+	DeadLetter deadletter.Sink
+}
+
+// BatchSubmitter buffers metrics in memory and sends them in the background using
+// the wrapped Submitter, once MaxBatchSize metrics are collected or FlushInterval passes.
+type BatchSubmitter struct {
+	submitter Submitter
+	opts      BatchOptions
+
+	mu     sync.Mutex
+	buffer []Anodot20Metric
+	closed bool
+
+	wakeup  chan struct{}
+	flushes chan chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// Constructs new BatchSubmitter and starts its background goroutine. Close should be called to release it.
+func NewBatchSubmitter(submitter Submitter, opts BatchOptions) (*BatchSubmitter, error) {
+	if submitter == nil {
+		return nil, errors.New("submitter should not be nil")
+	}
+
+	if opts.MaxBatchSize <= 0 {
+		opts.MaxBatchSize = 1000
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = 10 * time.Second
+	}
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = 10 * opts.MaxBatchSize
+	}
+	if opts.BufferSize < opts.MaxBatchSize {
+		return nil, errors.New("buffer size should not be less than max batch size")
+	}
+
+	b := &BatchSubmitter{
+		submitter: submitter,
+		opts:      opts,
+		buffer:    make([]Anodot20Metric, 0, opts.MaxBatchSize),
+		wakeup:    make(chan struct{}, 1),
+		flushes:   make(chan chan struct{}),
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	go b.run()
+
+	return b, nil
+}
+
+// SubmitMetrics adds metrics to the buffer and returns immediately with a nil response.
+// Delivery results are reported through BatchOptions.OnResult.
+func (b *BatchSubmitter) SubmitMetrics(metrics []Anodot20Metric) (AnodotResponse, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, ErrSubmitterClosed
+	}
+
+	if len(b.buffer)+len(metrics) > b.opts.BufferSize {
+		return nil, ErrBufferFull
+	}
+
+	b.buffer = append(b.buffer, metrics...)
+	if len(b.buffer) >= b.opts.MaxBatchSize {
+		select {
+		case b.wakeup <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil, nil
+}
+
+func (b *BatchSubmitter) AnodotURL() *url.URL {
+	return b.submitter.AnodotURL()
+}
+
+// Flush sends all buffered metrics and blocks until they are submitted.
+func (b *BatchSubmitter) Flush() {
+	ack := make(chan struct{})
+	select {
+	case b.flushes <- ack:
+		<-ack
+	case <-b.stopped:
+	}
+}
+
+// Close stops accepting new metrics, sends everything left in the buffer and
+// waits for the background goroutine to finish.
+func (b *BatchSubmitter) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return ErrSubmitterClosed
+	}
+	b.closed = true
+	b.mu.Unlock()
+
+	close(b.done)
+	<-b.stopped
+
+	return nil
+}
+
+func (b *BatchSubmitter) run() {
+	defer close(b.stopped)
+
+	ticker := time.NewTicker(b.opts.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.wakeup:
+			b.send(false)
+		case <-ticker.C:
+			b.send(true)
+		case ack := <-b.flushes:
+			b.send(true)
+			close(ack)
+		case <-b.done:
+			b.send(true)
+			return
+		}
+	}
+}
+
+// send submits buffered metrics in batches of MaxBatchSize. Incomplete batch is
+// sent only when all is true.
+func (b *BatchSubmitter) send(all bool) {
+	b.replay()
+
+	for {
+		b.mu.Lock()
+		n := len(b.buffer)
+		if n == 0 || (!all && n < b.opts.MaxBatchSize) {
+			b.mu.Unlock()
+			return
+		}
+		if n > b.opts.MaxBatchSize {
+			n = b.opts.MaxBatchSize
+		}
+
+		batch := make([]Anodot20Metric, n)
+		copy(batch, b.buffer[:n])
+		b.buffer = append(b.buffer[:0], b.buffer[n:]...)
+		b.mu.Unlock()
+
+		b.deliver(batch)
+	}
+}
+
+// deliver submits batch, or stores it in the queue if older batches are still waiting
+// there or delivery fails temporarily. Only metrics which were not delivered are queued.
+func (b *BatchSubmitter) deliver(batch []Anodot20Metric) {
+	q := b.opts.Queue
+	if q != nil && q.Len() > 0 && pushBatch(q, batch) == nil {
+		return
+	}
+
+	resp, err := b.submitter.SubmitMetrics(batch)
+	result := BatchResult{Metrics: batch, Response: resp, Err: err}
+	if q != nil && err != nil {
+		retry := NewSubmitResult(batch, resp, err).retryable()
+		if len(retry) > 0 && pushBatch(q, retry) == nil {
+			if len(retry) == len(batch) {
+				// reported once delivered
+				return
+			}
+			result.Queued = retry
+		}
+	}
+	b.report(result)
+}
+
+// replay resends queued batches oldest first, until the queue is empty or delivery fails temporarily.
+// Metrics of partly delivered batch which failed temporarily are queued again at the end.
+func (b *BatchSubmitter) replay() {
+	q := b.opts.Queue
+	if q == nil {
+		return
+	}
+
+	err := q.Replay(func(data []byte) bool {
+		var batch []Anodot20Metric
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&batch); err != nil {
+			b.report(BatchResult{Err: err})
+			return true
+		}
+
+		resp, err := b.submitter.SubmitMetrics(batch)
+		result := BatchResult{Metrics: batch, Response: resp, Err: err}
+		if retry := NewSubmitResult(batch, resp, err).retryable(); len(retry) > 0 {
+			if len(retry) == len(batch) {
+				return false
+			}
+			// requeue failed part of the batch only, before the batch is removed
+			if err := pushBatch(q, retry); err != nil {
+				b.report(BatchResult{Err: err})
+				return false
+			}
+			result.Queued = retry
+		}
+		b.report(result)
+		return true
+	})
+	if err != nil {
+		b.report(BatchResult{Err: err})
+	}
+}
+
+func pushBatch(q *diskqueue.Queue, batch []Anodot20Metric) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(batch); err != nil {
+		return err
+	}
+	return q.Push(buf.Bytes())
+}
+
+func (b *BatchSubmitter) report(r BatchResult) {
+	if b.opts.DeadLetter != nil && r.Err != nil && len(r.Metrics) > 0 {
+		result := NewSubmitResult(r.Metrics, r.Response, r.Err)
+		records := append(result.DeadLetterRecords(time.Now()), result.failedRecords(time.Now())...)
+		if len(records) > 0 {
+			r.DeadLetterErr = b.opts.DeadLetter.Write(records)
+		}
+	}
+	if b.opts.OnResult != nil {
+		b.opts.OnResult(r)
+	}
+}
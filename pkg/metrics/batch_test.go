@@ -0,0 +1,340 @@
+package metrics
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/anodot/anodot-common/pkg/chunk"
+	"github.com/anodot/anodot-common/pkg/deadletter"
+	"github.com/anodot/anodot-common/pkg/diskqueue"
+)
+
+type recordingSubmitter struct {
+	mu      sync.Mutex
+	batches [][]Anodot20Metric
+	// returned instead of recording metrics when set
+	err error
+}
+
+func (s *recordingSubmitter) SubmitMetrics(metrics []Anodot20Metric) (AnodotResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	s.batches = append(s.batches, metrics)
+	return &CreateResponse{}, nil
+}
+
+func (s *recordingSubmitter) AnodotURL() *url.URL {
+	return &url.URL{Scheme: "http", Host: "localhost"}
+}
+
+func (s *recordingSubmitter) sizes() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sizes := make([]int, len(s.batches))
+	for i, b := range s.batches {
+		sizes[i] = len(b)
+	}
+	return sizes
+}
+
+func testMetrics(n int) []Anodot20Metric {
+	metrics := make([]Anodot20Metric, n)
+	for i := range metrics {
+		metrics[i] = Anodot20Metric{Properties: map[string]string{"what": "test", "target_type": "gauge"}, Timestamp: AnodotTimestamp{time.Now()}, Value: float64(i)}
+	}
+	return metrics
+}
+
+func TestBatchSubmitterFlushesOnSize(t *testing.T) {
+	rs := &recordingSubmitter{}
+	results := make(chan BatchResult, 10)
+
+	b, err := NewBatchSubmitter(rs, BatchOptions{MaxBatchSize: 3, FlushInterval: time.Hour, OnResult: func(r BatchResult) { results <- r }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	if _, err := b.SubmitMetrics(testMetrics(7)); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case r := <-results:
+			if len(r.Metrics) != 3 || r.Err != nil {
+				t.Fatalf("unexpected batch result: %d metrics, err %v", len(r.Metrics), r.Err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("batch was not submitted")
+		}
+	}
+
+	if sizes := rs.sizes(); len(sizes) != 2 {
+		t.Fatalf("expected 2 full batches before close, got %v", sizes)
+	}
+}
+
+func TestBatchSubmitterFlushesOnInterval(t *testing.T) {
+	rs := &recordingSubmitter{}
+	results := make(chan BatchResult, 1)
+
+	b, err := NewBatchSubmitter(rs, BatchOptions{MaxBatchSize: 100, FlushInterval: 20 * time.Millisecond, OnResult: func(r BatchResult) { results <- r }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	if _, err := b.SubmitMetrics(testMetrics(2)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case r := <-results:
+		if len(r.Metrics) != 2 {
+			t.Fatalf("expected 2 metrics in batch, got %d", len(r.Metrics))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("batch was not submitted on interval")
+	}
+}
+
+func TestBatchSubmitterClose(t *testing.T) {
+	rs := &recordingSubmitter{}
+	b, err := NewBatchSubmitter(rs, BatchOptions{MaxBatchSize: 4, BufferSize: 10, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := b.SubmitMetrics(testMetrics(11)); err != ErrBufferFull {
+		t.Fatalf("expected ErrBufferFull, got %v", err)
+	}
+	if _, err := b.SubmitMetrics(testMetrics(10)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	total := 0
+	for _, s := range rs.sizes() {
+		total += s
+	}
+	if total != 10 {
+		t.Fatalf("expected 10 metrics to be drained on close, got %d", total)
+	}
+
+	if _, err := b.SubmitMetrics(testMetrics(1)); err != ErrSubmitterClosed {
+		t.Fatalf("expected ErrSubmitterClosed, got %v", err)
+	}
+}
+
+func TestBatchSubmitterQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "batchqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := diskqueue.Open(diskqueue.Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var results []BatchResult
+	onResult := func(r BatchResult) { results = append(results, r) }
+
+	rs := &recordingSubmitter{err: &url.Error{Op: "Post", URL: "http://localhost", Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}}}
+	b, err := NewBatchSubmitter(rs, BatchOptions{MaxBatchSize: 2, FlushInterval: time.Hour, OnResult: onResult, Queue: q})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.SubmitMetrics(testMetrics(3)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 0 || q.Len() != 2 {
+		t.Fatalf("expected both batches to be queued, got %d results and %d queued", len(results), q.Len())
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// restart with the endpoint reachable again
+	q, err = diskqueue.Open(diskqueue.Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	rs = &recordingSubmitter{}
+	b, err = NewBatchSubmitter(rs, BatchOptions{MaxBatchSize: 2, FlushInterval: time.Hour, OnResult: onResult, Queue: q})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Flush()
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sizes := rs.sizes()
+	if len(sizes) != 2 || sizes[0] != 2 || sizes[1] != 1 {
+		t.Fatalf("expected queued batches of sizes [2 1], got %v", sizes)
+	}
+	if rs.batches[0][0].Value != 0 || rs.batches[1][0].Value != 2 {
+		t.Fatal("queued batches were replayed out of order")
+	}
+	if len(results) != 2 || results[0].Err != nil || q.Len() != 0 {
+		t.Fatalf("expected replayed batches to be reported and removed from queue, got %d results, %d queued", len(results), q.Len())
+	}
+}
+
+func TestBatchSubmitterQueueDropsPermanentFailures(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Write([]byte(`{"errors":[]}`))
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	c, err := NewAnodot20Client(*u, "token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "batchqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := diskqueue.Open(diskqueue.Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	// NaN value can't be encoded as JSON, neither queued nor fresh batch may block the others
+	unencodable := testMetrics(1)
+	unencodable[0].Value = math.NaN()
+	if err := pushBatch(q, unencodable); err != nil {
+		t.Fatal(err)
+	}
+
+	var results []BatchResult
+	var records []deadletter.Record
+	b, err := NewBatchSubmitter(c, BatchOptions{
+		MaxBatchSize:  1,
+		FlushInterval: time.Hour,
+		OnResult:      func(r BatchResult) { results = append(results, r) },
+		Queue:         q,
+		DeadLetter: deadletter.SinkFunc(func(r []deadletter.Record) error {
+			records = append(records, r...)
+			return nil
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SubmitMetrics(unencodable)
+	b.SubmitMetrics(testMetrics(1))
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if q.Len() != 0 {
+		t.Fatalf("expected queue to be drained, %d batches left", q.Len())
+	}
+	if atomic.LoadInt32(&calls) != 1 {
+		t.Fatalf("expected valid batch to be sent, got %d requests", calls)
+	}
+	if len(results) != 3 || results[0].Err == nil || results[1].Err == nil || results[2].Err != nil {
+		t.Fatalf("expected 2 failed and 1 delivered batch, got %+v", results)
+	}
+	if len(records) != 2 || records[0].Reason == "" {
+		t.Fatalf("expected unencodable metrics in dead-letter, got %+v", records)
+	}
+}
+
+func TestBatchSubmitterQueuesFailedChunksOnly(t *testing.T) {
+	var mu sync.Mutex
+	received := map[float64]int{}
+	failing := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var metrics []Anodot20Metric
+		json.NewDecoder(r.Body).Decode(&metrics)
+
+		mu.Lock()
+		defer mu.Unlock()
+		if failing && metrics[0].Value == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		for _, m := range metrics {
+			received[m.Value]++
+		}
+		w.Write([]byte(`{"errors":[]}`))
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	c, err := NewAnodot20Client(*u, "token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Chunking = chunk.Options{MaxRecords: 1}
+
+	dir, err := ioutil.TempDir("", "batchqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := diskqueue.Open(diskqueue.Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	var results []BatchResult
+	b, err := NewBatchSubmitter(c, BatchOptions{FlushInterval: time.Hour, OnResult: func(r BatchResult) { results = append(results, r) }, Queue: q})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	b.SubmitMetrics(testMetrics(3))
+	b.Flush()
+
+	if q.Len() != 1 || len(results) != 1 || len(results[0].Queued) != 1 || results[0].Queued[0].Value != 1 {
+		t.Fatalf("expected only the failed chunk to be queued, got %d queued, results %+v", q.Len(), results)
+	}
+
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+	b.Flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if q.Len() != 0 || len(received) != 3 || received[0] != 1 || received[1] != 1 || received[2] != 1 {
+		t.Fatalf("expected every metric to be delivered once, got %v, %d queued", received, q.Len())
+	}
+}
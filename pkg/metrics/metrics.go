@@ -2,17 +2,25 @@ package metrics
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"os"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/anodot/anodot-common/pkg/apierror"
+	"github.com/anodot/anodot-common/pkg/chunk"
+	"github.com/anodot/anodot-common/pkg/compression"
+	"github.com/anodot/anodot-common/pkg/credentials"
+	"github.com/anodot/anodot-common/pkg/httplog"
+	"github.com/anodot/anodot-common/pkg/ratelimit"
+	"github.com/anodot/anodot-common/pkg/retry"
 )
 
 type AnodotTimestamp struct {
@@ -23,6 +31,21 @@ func (t AnodotTimestamp) MarshalJSON() ([]byte, error) {
 	return []byte(fmt.Sprint(t.Unix())), nil
 }
 
+// UnmarshalJSON accepts unix seconds, as written by MarshalJSON, or RFC 3339 string.
+func (t *AnodotTimestamp) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+
+	var seconds float64
+	if err := json.Unmarshal(data, &seconds); err == nil {
+		sec, frac := math.Modf(seconds)
+		t.Time = time.Unix(int64(sec), int64(frac*1e9))
+		return nil
+	}
+	return t.Time.UnmarshalJSON(data)
+}
+
 type Anodot20Metric struct {
 	Properties map[string]string `json:"properties"`
 	Timestamp  AnodotTimestamp   `json:"timestamp"`
@@ -91,6 +114,18 @@ func (r *CreateResponse) RawResponse() *http.Response {
 	return r.HttpResponse
 }
 
+func (r *CreateResponse) validationError() error {
+	return apierror.NewValidationError(r.HttpResponse, r.failures())
+}
+
+func (r *CreateResponse) failures() []apierror.Failure {
+	failures := make([]apierror.Failure, 0, len(r.Errors))
+	for _, e := range r.Errors {
+		failures = append(failures, apierror.Failure{Index: apierror.ParseIndex(e.Index), Code: e.Error, Description: e.Description})
+	}
+	return failures
+}
+
 type DeleteResponse struct {
 	ID         string `json:"id"`
 	Validation struct {
@@ -121,6 +156,14 @@ func (a *DeleteResponse) RawResponse() *http.Response {
 	return a.HttpResponse
 }
 
+func (a *DeleteResponse) validationError() error {
+	failures := make([]apierror.Failure, 0, len(a.Validation.Failures))
+	for _, f := range a.Validation.Failures {
+		failures = append(failures, apierror.Failure{Index: -1, Code: int64(f.ID), Description: f.Message})
+	}
+	return apierror.NewValidationError(a.HttpResponse, failures)
+}
+
 type Submitter interface {
 	SubmitMetrics(metrics []Anodot20Metric) (AnodotResponse, error)
 	AnodotURL() *url.URL
@@ -132,9 +175,27 @@ func (s *Anodot20Client) AnodotURL() *url.URL {
 
 //  Anodot 2.0 Metrics client.
 // See more details at https://support.anodot.com/hc/en-us/articles/360020259354-Posting-2-0-Metrics-
+// Methods are safe for concurrent use by multiple goroutines, exported fields should not be modified
+// once the client is in use.
 type Anodot20Client struct {
 	ServerURL *url.URL
 	Token     string
+	// Optional provider of data collection token queried before every request, takes precedence over Token.
+	Credentials credentials.Provider
+	// Retry policy applied to every request. Nil disables retries.
+	RetryPolicy *retry.Policy
+	// Compression of metrics request bodies. Nil sends them uncompressed.
+	Compression *compression.Options
+	// Limits of a single metrics request. Larger batches are split into chunks, and record
+	// indexes in the merged response refer to positions in the submitted slice.
+	Chunking chunk.Options
+	// Limits request and metric rates of the client. Nil disables limiting.
+	// The same Limiter may be shared by several clients to apply a common budget.
+	RateLimit *ratelimit.Limiter
+	// Logs requests and responses with secrets redacted. Nil disables logging. Set to debug level
+	// text logger writing to stdout if ANODOT_HTTP_DEBUG_ENABLED environment variable is true
+	// and the client is constructed without http.Client of its own.
+	Tracer *httplog.Tracer
 
 	client *http.Client
 }
@@ -146,70 +207,167 @@ func NewAnodot20Client(anodotURL url.URL, apiToken string, httpClient *http.Clie
 		return nil, fmt.Errorf("anodot api token should not be blank")
 	}
 
-	submitter := Anodot20Client{Token: apiToken, ServerURL: &anodotURL, client: httpClient}
+	submitter := newAnodot20Client(anodotURL, httpClient)
+	submitter.Token = apiToken
+	return submitter, nil
+}
+
+// Constructs new Anodot 2.0 submitter which takes data collection token from provider before every request.
+func NewAnodot20ClientWithCredentials(anodotURL url.URL, provider credentials.Provider, httpClient *http.Client) (*Anodot20Client, error) {
+	if provider == nil {
+		return nil, fmt.Errorf("credentials provider should not be nil")
+	}
+
+	submitter := newAnodot20Client(anodotURL, httpClient)
+	submitter.Credentials = provider
+	return submitter, nil
+}
+
+func newAnodot20Client(anodotURL url.URL, httpClient *http.Client) *Anodot20Client {
+	submitter := Anodot20Client{ServerURL: &anodotURL, client: httpClient}
 	if httpClient == nil {
-		client := http.Client{Timeout: 30 * time.Second}
+		submitter.client = &http.Client{Timeout: 30 * time.Second}
 
-		debugHTTP, _ := strconv.ParseBool(os.Getenv("ANODOT_HTTP_DEBUG_ENABLED"))
-		if debugHTTP {
-			client.Transport = &debugHTTPTransport{r: http.DefaultTransport}
+		if debugHTTP, _ := strconv.ParseBool(os.Getenv("ANODOT_HTTP_DEBUG_ENABLED")); debugHTTP {
+			submitter.Tracer = &httplog.Tracer{Logger: httplog.NewTextLogger(os.Stdout, httplog.LevelDebug)}
 		}
-		submitter.client = &client
+	}
+	return &submitter
+}
+
+// token returns data collection token of the next request.
+func (s *Anodot20Client) token(ctx context.Context) (string, error) {
+	if s.Credentials == nil {
+		return s.Token, nil
 	}
 
-	return &submitter, nil
+	creds, err := s.Credentials.Credentials(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get anodot credentials: %w", err)
+	}
+	if creds.DataToken == "" {
+		return "", fmt.Errorf("anodot data token is not provided by credentials")
+	}
+	return creds.DataToken, nil
 }
 
 func (s *Anodot20Client) SubmitMetrics(metrics []Anodot20Metric) (AnodotResponse, error) {
-	return s.sendMetrics(metrics, "/api/v1/metrics")
+	return s.SubmitMetricsContext(context.Background(), metrics)
+}
 
+func (s *Anodot20Client) SubmitMetricsContext(ctx context.Context, metrics []Anodot20Metric) (AnodotResponse, error) {
+	return s.sendMetrics(ctx, metrics, "/api/v1/metrics")
 }
 
 func (s *Anodot20Client) SubmitMonitoringMetrics(metrics []Anodot20Metric) (AnodotResponse, error) {
-	return s.sendMetrics(metrics, "/api/v1/agents")
+	return s.SubmitMonitoringMetricsContext(context.Background(), metrics)
 }
 
-func (s *Anodot20Client) sendMetrics(metrics []Anodot20Metric, endpoint string) (AnodotResponse, error) {
+func (s *Anodot20Client) SubmitMonitoringMetricsContext(ctx context.Context, metrics []Anodot20Metric) (AnodotResponse, error) {
+	return s.sendMetrics(ctx, metrics, "/api/v1/agents")
+}
+
+func (s *Anodot20Client) sendMetrics(ctx context.Context, metrics []Anodot20Metric, endpoint string) (AnodotResponse, error) {
+
+	token, err := s.token(ctx)
+	if err != nil {
+		return nil, err
+	}
 
 	sUrl := *s.ServerURL
 	sUrl.Path = endpoint
 
 	q := sUrl.Query()
-	q.Set("token", s.Token)
+	q.Set("token", token)
 	q.Set("protocol", "anodot20")
 
 	sUrl.RawQuery = q.Encode()
 
-	b, e := json.Marshal(metrics)
+	chunks, e := chunk.Encode(metrics, s.Chunking)
 	if e != nil {
 		return nil, fmt.Errorf("Failed to parse message:" + e.Error())
 	}
 
-	r, _ := http.NewRequest(http.MethodPost, sUrl.String(), bytes.NewBuffer(b))
+	if len(chunks) == 1 {
+		resp, err := s.sendChunk(ctx, sUrl.String(), chunks[0])
+		if resp == nil {
+			return nil, err
+		}
+		return resp, err
+	}
+
+	responses := make([]*CreateResponse, len(chunks))
+	errs := make([]error, len(chunks))
+	chunk.Run(len(chunks), s.Chunking.Concurrency, func(i int) {
+		responses[i], errs[i] = s.sendChunk(ctx, sUrl.String(), chunks[i])
+	})
+
+	// merge chunk responses, shifting record indexes to positions in metrics
+	merged := &CreateResponse{}
+	chunkErr := &chunk.Error{Chunks: len(chunks)}
+	for i, c := range chunks {
+		resp := responses[i]
+		if resp != nil {
+			if resp.HttpResponse != nil {
+				merged.HttpResponse = resp.HttpResponse
+			}
+			for _, e := range resp.Errors {
+				if index := apierror.ParseIndex(e.Index); index >= 0 {
+					e.Index = strconv.Itoa(index + c.Start)
+				}
+				merged.Errors = append(merged.Errors, e)
+			}
+		}
+
+		if errs[i] != nil && (resp == nil || !resp.HasErrors()) {
+			c.Body = nil
+			chunkErr.Failed = append(chunkErr.Failed, c)
+			chunkErr.Errs = append(chunkErr.Errs, errs[i])
+		} else {
+			c.Body = nil
+			chunkErr.Accepted = append(chunkErr.Accepted, c)
+		}
+	}
+
+	if len(chunkErr.Failed) > 0 {
+		return merged, chunkErr
+	}
+	if merged.HasErrors() {
+		return merged, merged.validationError()
+	}
+	return merged, nil
+}
+
+func (s *Anodot20Client) sendChunk(ctx context.Context, url string, c chunk.Chunk) (*CreateResponse, error) {
+	r, err := compression.NewRequest(ctx, s.Compression, http.MethodPost, url, c.Body)
+	if err != nil {
+		return nil, httplog.RedactError(err)
+	}
 	r.Header.Add("Content-Type", "application/json")
 
-	resp, err := s.client.Do(r)
+	resp, err := s.do(r, c.End-c.Start)
 	anodotResponse := &CreateResponse{HttpResponse: resp}
 	if err != nil {
 		return anodotResponse, err
 	}
-
-	if resp.StatusCode != 200 {
-		return anodotResponse, fmt.Errorf("http error: %d", resp.StatusCode)
-	}
+	defer resp.Body.Close()
 
 	if resp.Body == nil {
 		return anodotResponse, fmt.Errorf("empty response body")
 	}
 
 	bodyBytes, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		return anodotResponse, apierror.FromResponse(resp, bodyBytes)
+	}
+
 	err = json.Unmarshal(bodyBytes, anodotResponse)
 	if err != nil {
 		return anodotResponse, fmt.Errorf("failed to parse Anodot sever response: %w ", err)
 	}
 
 	if anodotResponse.HasErrors() {
-		return anodotResponse, errors.New(anodotResponse.ErrorMessage())
+		return anodotResponse, anodotResponse.validationError()
 	} else {
 		return anodotResponse, nil
 	}
@@ -217,6 +375,11 @@ func (s *Anodot20Client) sendMetrics(metrics []Anodot20Metric, endpoint string)
 
 //DO NOT USE THIS METHOD. USED FOR INTERNAL PURPOSES
 func (s *Anodot20Client) FlushMetricsBucket(metrics []Anodot20Metric, rollup string, loc *time.Location) (AnodotResponse, error) {
+	return s.FlushMetricsBucketContext(context.Background(), metrics, rollup, loc)
+}
+
+//DO NOT USE THIS METHOD. USED FOR INTERNAL PURPOSES
+func (s *Anodot20Client) FlushMetricsBucketContext(ctx context.Context, metrics []Anodot20Metric, rollup string, loc *time.Location) (AnodotResponse, error) {
 	type FlushBucket struct {
 		Properties map[string]string `json:"properties"`
 		Timestamp  AnodotTimestamp   `json:"timestamp"`
@@ -249,11 +412,16 @@ func (s *Anodot20Client) FlushMetricsBucket(metrics []Anodot20Metric, rollup str
 		flReq = append(flReq, FlushBucket{Properties: v.Properties, Timestamp: t, Value: 0, Tags: v.Tags, Flush: true, Rollup: rollup})
 	}
 
+	token, err := s.token(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	sUrl := *s.ServerURL
 	sUrl.Path = "/api/v1/metrics"
 
 	q := sUrl.Query()
-	q.Set("token", s.Token)
+	q.Set("token", token)
 	q.Set("protocol", "anodot20")
 
 	sUrl.RawQuery = q.Encode()
@@ -263,43 +431,57 @@ func (s *Anodot20Client) FlushMetricsBucket(metrics []Anodot20Metric, rollup str
 		return nil, fmt.Errorf("Failed to parse message:" + e.Error())
 	}
 
-	r, _ := http.NewRequest(http.MethodPost, sUrl.String(), bytes.NewBuffer(b))
+	r, err := compression.NewRequest(ctx, s.Compression, http.MethodPost, sUrl.String(), b)
+	if err != nil {
+		return nil, httplog.RedactError(err)
+	}
 	r.Header.Add("Content-Type", "application/json")
 
-	resp, err := s.client.Do(r)
+	resp, err := s.do(r, len(flReq))
 	anodotResponse := &CreateResponse{HttpResponse: resp}
 	if err != nil {
 		return anodotResponse, err
 	}
-
-	if resp.StatusCode != 200 {
-		return anodotResponse, fmt.Errorf("http error: %d", resp.StatusCode)
-	}
+	defer resp.Body.Close()
 
 	if resp.Body == nil {
 		return anodotResponse, fmt.Errorf("empty response body")
 	}
 
 	bodyBytes, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		return anodotResponse, apierror.FromResponse(resp, bodyBytes)
+	}
+
 	err = json.Unmarshal(bodyBytes, anodotResponse)
 	if err != nil {
 		return anodotResponse, fmt.Errorf("failed to parse Anodot sever response: %w ", err)
 	}
 
 	if anodotResponse.HasErrors() {
-		return anodotResponse, errors.New(anodotResponse.ErrorMessage())
+		return anodotResponse, anodotResponse.validationError()
 	} else {
 		return anodotResponse, nil
 	}
 }
 
 func (s *Anodot20Client) DeleteMetrics(expressions ...DeleteExpression) (AnodotResponse, error) {
-	s.ServerURL.Path = "/api/v1/metrics"
+	return s.DeleteMetricsContext(context.Background(), expressions...)
+}
 
-	q := s.ServerURL.Query()
-	q.Set("token", s.Token)
+func (s *Anodot20Client) DeleteMetricsContext(ctx context.Context, expressions ...DeleteExpression) (AnodotResponse, error) {
+	token, err := s.token(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	sUrl := *s.ServerURL
+	sUrl.Path = "/api/v1/metrics"
+
+	q := sUrl.Query()
+	q.Set("token", token)
 
-	s.ServerURL.RawQuery = q.Encode()
+	sUrl.RawQuery = q.Encode()
 
 	deleteStruct := struct {
 		Expression []DeleteExpression `json:"expression"`
@@ -311,51 +493,48 @@ func (s *Anodot20Client) DeleteMetrics(expressions ...DeleteExpression) (AnodotR
 		return nil, fmt.Errorf("failed to parse delete expression:" + e.Error())
 	}
 
-	r, _ := http.NewRequest(http.MethodDelete, s.ServerURL.String(), bytes.NewBuffer(b))
+	r, _ := http.NewRequestWithContext(ctx, http.MethodDelete, sUrl.String(), bytes.NewBuffer(b))
 	r.Header.Add("Content-Type", "application/json")
 
-	resp, err := s.client.Do(r)
+	resp, err := s.do(r, 0)
 	anodotResponse := &DeleteResponse{HttpResponse: resp}
 	if err != nil {
 		return anodotResponse, err
 	}
+	defer resp.Body.Close()
 
-	statusCode := resp.StatusCode
-	if statusCode < 200 && statusCode >= 300 {
-		return anodotResponse, fmt.Errorf("http error: %d", statusCode)
+	if resp.Body == nil {
+		return anodotResponse, fmt.Errorf("empty response body")
 	}
 
 	bodyBytes, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return anodotResponse, apierror.FromResponse(resp, bodyBytes)
+	}
+
 	err = json.Unmarshal(bodyBytes, anodotResponse)
 	if err != nil {
 		return anodotResponse, fmt.Errorf("failed to parse Anodot sever response: %w ", err)
 	}
 
-	if resp.Body == nil {
-		return anodotResponse, fmt.Errorf("empty response body")
-	}
-
 	if anodotResponse.HasErrors() {
-		return anodotResponse, errors.New(anodotResponse.ErrorMessage())
+		return anodotResponse, anodotResponse.validationError()
 	} else {
 		return anodotResponse, nil
 	}
 }
 
-type debugHTTPTransport struct {
-	r http.RoundTripper
-}
-
-func (d *debugHTTPTransport) RoundTrip(h *http.Request) (*http.Response, error) {
-	dump, _ := httputil.DumpRequestOut(h, true)
-	fmt.Printf("----------------------------------REQUEST----------------------------------\n%s\n", string(dump))
-	resp, err := d.r.RoundTrip(h)
-	if err != nil {
-		fmt.Println("failed to obtain response: ", err.Error())
-		return resp, err
-	}
-
-	dump, _ = httputil.DumpResponse(resp, true)
-	fmt.Printf("----------------------------------RESPONSE----------------------------------\n%s\n----------------------------------\n\n", string(dump))
-	return resp, err
+// do sends request carrying the given number of metrics, waiting for RateLimit budget before every attempt.
+// Returned error has credentials redacted.
+func (s *Anodot20Client) do(r *http.Request, metrics int) (*http.Response, error) {
+	resp, err := retry.Do(s.RetryPolicy, r, func(r *http.Request) (*http.Response, error) {
+		release, err := s.RateLimit.Acquire(r.Context(), metrics)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		return s.Tracer.Do(r, s.client.Do)
+	})
+	// *url.Error carries request URL, including data collection token
+	return resp, httplog.RedactError(err)
 }
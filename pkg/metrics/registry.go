@@ -0,0 +1,357 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	targetTypeCounter = "counter"
+	targetTypeGauge   = "gauge"
+)
+
+// Percentiles reported for timers and histograms.
+var DefaultPercentiles = []float64{50, 90, 99}
+
+// Number of values kept per interval by timers and histograms to calculate percentiles.
+const reservoirSize = 1028
+
+// Counter counts events. Reported with target_type "counter" as the increase since the previous report.
+type Counter struct {
+	count int64
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *Counter) Add(n int64) {
+	atomic.AddInt64(&c.count, n)
+}
+
+// Count returns the increase since the previous report.
+func (c *Counter) Count() int64 {
+	return atomic.LoadInt64(&c.count)
+}
+
+// Gauge holds the last set value. Reported with target_type "gauge".
+type Gauge struct {
+	bits uint64
+}
+
+func (g *Gauge) Update(v float64) {
+	atomic.StoreUint64(&g.bits, math.Float64bits(v))
+}
+
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&g.bits))
+}
+
+// Meter counts events and measures their rate. Reported as "count" stat with target_type "counter",
+// and "rate" stat, number of events per second since the previous report, with target_type "gauge".
+type Meter struct {
+	mu    sync.Mutex
+	count int64
+	since time.Time
+}
+
+func (m *Meter) Mark(n int64) {
+	m.mu.Lock()
+	m.count += n
+	m.mu.Unlock()
+}
+
+// Histogram tracks distribution of values. Reported as "count" stat with target_type "counter",
+// and "min", "max", "mean" and percentile stats (e.g. "p99") with target_type "gauge", all calculated
+// from the values recorded since the previous report. Percentiles are estimated from a random sample
+// of the values when there are more than 1028 of them.
+type Histogram struct {
+	mu       sync.Mutex
+	count    int64
+	sum      float64
+	min, max float64
+	values   []float64
+	rnd      *rand.Rand
+}
+
+func newHistogram() *Histogram {
+	return &Histogram{rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (h *Histogram) Update(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.count == 0 || v < h.min {
+		h.min = v
+	}
+	if h.count == 0 || v > h.max {
+		h.max = v
+	}
+	h.count++
+	h.sum += v
+
+	// reservoir sampling, every value is kept with equal probability
+	if len(h.values) < reservoirSize {
+		h.values = append(h.values, v)
+	} else if i := h.rnd.Int63n(h.count); i < reservoirSize {
+		h.values[i] = v
+	}
+}
+
+type histogramSnapshot struct {
+	count    int64
+	sum      float64
+	min, max float64
+	values   []float64
+}
+
+func (h *Histogram) snapshot() histogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := histogramSnapshot{count: h.count, sum: h.sum, min: h.min, max: h.max, values: h.values}
+	h.count, h.sum, h.min, h.max, h.values = 0, 0, 0, 0, nil
+	return s
+}
+
+// Timer is Histogram of durations, reported in milliseconds.
+type Timer struct {
+	h *Histogram
+}
+
+func (t *Timer) Update(d time.Duration) {
+	t.h.Update(float64(d) / float64(time.Millisecond))
+}
+
+// UpdateSince records time passed since start.
+func (t *Timer) UpdateSince(start time.Time) {
+	t.Update(time.Since(start))
+}
+
+// Time records duration of f.
+func (t *Timer) Time(f func()) {
+	start := time.Now()
+	f()
+	t.UpdateSince(start)
+}
+
+type entry struct {
+	what       string
+	properties map[string]string
+	instrument interface{}
+}
+
+// Registry holds instruments identified by "what" and properties. Instruments are created on
+// first use and reported by Snapshot. Registry and instruments are safe for concurrent use.
+type Registry struct {
+	Percentiles []float64
+
+	mu      sync.Mutex
+	entries map[string]*entry
+}
+
+// Constructs new Registry reporting DefaultPercentiles.
+func NewRegistry() *Registry {
+	return &Registry{Percentiles: DefaultPercentiles, entries: make(map[string]*entry)}
+}
+
+func (r *Registry) Counter(what string, properties map[string]string) (*Counter, error) {
+	i, err := r.getOrCreate(what, properties, func() interface{} { return &Counter{} })
+	if err != nil {
+		return nil, err
+	}
+	c, ok := i.(*Counter)
+	if !ok {
+		return nil, registeredError(what, properties, i)
+	}
+	return c, nil
+}
+
+func (r *Registry) Gauge(what string, properties map[string]string) (*Gauge, error) {
+	i, err := r.getOrCreate(what, properties, func() interface{} { return &Gauge{} })
+	if err != nil {
+		return nil, err
+	}
+	g, ok := i.(*Gauge)
+	if !ok {
+		return nil, registeredError(what, properties, i)
+	}
+	return g, nil
+}
+
+func (r *Registry) Meter(what string, properties map[string]string) (*Meter, error) {
+	i, err := r.getOrCreate(what, properties, func() interface{} { return &Meter{since: time.Now()} })
+	if err != nil {
+		return nil, err
+	}
+	m, ok := i.(*Meter)
+	if !ok {
+		return nil, registeredError(what, properties, i)
+	}
+	return m, nil
+}
+
+func (r *Registry) Histogram(what string, properties map[string]string) (*Histogram, error) {
+	i, err := r.getOrCreate(what, properties, func() interface{} { return newHistogram() })
+	if err != nil {
+		return nil, err
+	}
+	h, ok := i.(*Histogram)
+	if !ok {
+		return nil, registeredError(what, properties, i)
+	}
+	return h, nil
+}
+
+func (r *Registry) Timer(what string, properties map[string]string) (*Timer, error) {
+	i, err := r.getOrCreate(what, properties, func() interface{} { return &Timer{h: newHistogram()} })
+	if err != nil {
+		return nil, err
+	}
+	t, ok := i.(*Timer)
+	if !ok {
+		return nil, registeredError(what, properties, i)
+	}
+	return t, nil
+}
+
+// Unregister removes instrument, it is not reported anymore.
+func (r *Registry) Unregister(what string, properties map[string]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.entries, registryKey(what, properties))
+}
+
+func (r *Registry) getOrCreate(what string, properties map[string]string, create func() interface{}) (interface{}, error) {
+	if strings.TrimSpace(what) == "" {
+		return nil, fmt.Errorf("metric what should not be empty")
+	}
+	if _, ok := properties["what"]; ok {
+		return nil, fmt.Errorf("metric %s: what should not be set in properties", what)
+	}
+
+	key := registryKey(what, properties)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if e, ok := r.entries[key]; ok {
+		return e.instrument, nil
+	}
+
+	props := make(map[string]string, len(properties))
+	for k, v := range properties {
+		props[k] = v
+	}
+	e := &entry{what: what, properties: props, instrument: create()}
+	r.entries[key] = e
+	return e.instrument, nil
+}
+
+func registeredError(what string, properties map[string]string, i interface{}) error {
+	return fmt.Errorf("metric %s %v is already registered as %T", what, properties, i)
+}
+
+func registryKey(what string, properties map[string]string) string {
+	keys := make([]string, 0, len(properties))
+	for k := range properties {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(what)
+	for _, k := range keys {
+		b.WriteByte(0)
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(properties[k])
+	}
+	return b.String()
+}
+
+// Snapshot returns current values of all instruments as metrics with timestamp now,
+// and resets counters, meters, timers and histograms for the next interval.
+// Values which are NaN or infinite are skipped.
+func (r *Registry) Snapshot(now time.Time) []Anodot20Metric {
+	r.mu.Lock()
+	entries := make([]*entry, 0, len(r.entries))
+	for _, e := range r.entries {
+		entries = append(entries, e)
+	}
+	r.mu.Unlock()
+
+	var result []Anodot20Metric
+	for _, e := range entries {
+		metric := func(stat string, targetType string, value float64) {
+			// NaN and infinity can't be encoded, and would fail the whole report
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				return
+			}
+			props := make(map[string]string, len(e.properties)+3)
+			for k, v := range e.properties {
+				props[k] = v
+			}
+			props["what"] = e.what
+			props["target_type"] = targetType
+			if stat != "" {
+				props["stat"] = stat
+			}
+			result = append(result, Anodot20Metric{Properties: props, Timestamp: AnodotTimestamp{now}, Value: value})
+		}
+
+		switch i := e.instrument.(type) {
+		case *Counter:
+			metric("", targetTypeCounter, float64(atomic.SwapInt64(&i.count, 0)))
+		case *Gauge:
+			metric("", targetTypeGauge, i.Value())
+		case *Meter:
+			i.mu.Lock()
+			count, elapsed := i.count, now.Sub(i.since)
+			i.count, i.since = 0, now
+			i.mu.Unlock()
+
+			metric("count", targetTypeCounter, float64(count))
+			if elapsed > 0 {
+				metric("rate", targetTypeGauge, float64(count)/elapsed.Seconds())
+			}
+		case *Histogram:
+			r.histogramMetrics(i.snapshot(), metric)
+		case *Timer:
+			r.histogramMetrics(i.h.snapshot(), metric)
+		}
+	}
+
+	return result
+}
+
+func (r *Registry) histogramMetrics(s histogramSnapshot, metric func(stat string, targetType string, value float64)) {
+	metric("count", targetTypeCounter, float64(s.count))
+	if s.count == 0 {
+		return
+	}
+
+	metric("min", targetTypeGauge, s.min)
+	metric("max", targetTypeGauge, s.max)
+	metric("mean", targetTypeGauge, s.sum/float64(s.count))
+
+	sort.Float64s(s.values)
+	for _, p := range r.Percentiles {
+		rank := int(math.Ceil(p/100*float64(len(s.values)))) - 1
+		if rank < 0 {
+			rank = 0
+		}
+		if rank >= len(s.values) {
+			rank = len(s.values) - 1
+		}
+		metric("p"+strings.Replace(strconv.FormatFloat(p, 'f', -1, 64), ".", "_", 1), targetTypeGauge, s.values[rank])
+	}
+}
@@ -0,0 +1,139 @@
+package metrics
+
+import (
+	"encoding/json"
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+func findMetric(metrics []Anodot20Metric, what, stat string) (Anodot20Metric, bool) {
+	for _, m := range metrics {
+		if m.Properties["what"] == what && m.Properties["stat"] == stat {
+			return m, true
+		}
+	}
+	return Anodot20Metric{}, false
+}
+
+func TestRegistrySnapshot(t *testing.T) {
+	r := NewRegistry()
+	props := map[string]string{"host": "web1"}
+
+	c, err := r.Counter("requests", props)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Inc()
+		}()
+	}
+	wg.Wait()
+
+	same, _ := r.Counter("requests", map[string]string{"host": "web1"})
+	if same != c {
+		t.Fatal("expected the same counter for the same properties")
+	}
+	if _, err := r.Gauge("requests", props); err == nil {
+		t.Fatal("expected error for instrument registered with another type")
+	}
+
+	g, _ := r.Gauge("queue_size", nil)
+	g.Update(7)
+
+	timer, _ := r.Timer("latency", nil)
+	for i := 1; i <= 100; i++ {
+		timer.Update(time.Duration(i) * time.Millisecond)
+	}
+
+	meter, _ := r.Meter("events", nil)
+	meter.Mark(5)
+
+	snapshot := r.Snapshot(time.Now().Add(time.Second))
+
+	checks := []struct {
+		what, stat, targetType string
+		value                  float64
+	}{
+		{"requests", "", "counter", 10},
+		{"queue_size", "", "gauge", 7},
+		{"latency", "count", "counter", 100},
+		{"latency", "max", "gauge", 100},
+		{"latency", "mean", "gauge", 50.5},
+		{"latency", "p90", "gauge", 90},
+		{"events", "count", "counter", 5},
+	}
+	for _, c := range checks {
+		m, ok := findMetric(snapshot, c.what, c.stat)
+		if !ok || m.Value != c.value || m.Properties["target_type"] != c.targetType {
+			t.Fatalf("%s %s: expected %v %s, got %+v", c.what, c.stat, c.value, c.targetType, m)
+		}
+	}
+	if m, _ := findMetric(snapshot, "requests", ""); m.Properties["host"] != "web1" {
+		t.Fatalf("expected instrument properties, got %v", m.Properties)
+	}
+	if m, ok := findMetric(snapshot, "events", "rate"); !ok || m.Value <= 0 {
+		t.Fatalf("expected meter rate, got %+v", m)
+	}
+
+	// interval state is reset
+	snapshot = r.Snapshot(time.Now())
+	if m, _ := findMetric(snapshot, "requests", ""); m.Value != 0 {
+		t.Fatalf("expected counter to be reset, got %v", m.Value)
+	}
+	if m, _ := findMetric(snapshot, "queue_size", ""); m.Value != 7 {
+		t.Fatalf("expected gauge to keep its value, got %v", m.Value)
+	}
+	if _, ok := findMetric(snapshot, "latency", "mean"); ok {
+		t.Fatal("expected empty timer to report count only")
+	}
+}
+
+func TestRegistrySnapshotSkipsNonFinite(t *testing.T) {
+	r := NewRegistry()
+	for what, v := range map[string]float64{"nan": math.NaN(), "inf": math.Inf(1), "neg_inf": math.Inf(-1), "ok": 1} {
+		g, _ := r.Gauge(what, nil)
+		g.Update(v)
+	}
+
+	snapshot := r.Snapshot(time.Now())
+	if len(snapshot) != 1 || snapshot[0].Properties["what"] != "ok" {
+		t.Fatalf("expected only finite gauge, got %+v", snapshot)
+	}
+	if _, err := json.Marshal(snapshot); err != nil {
+		t.Fatalf("snapshot should be encodable: %v", err)
+	}
+}
+
+func TestReporter(t *testing.T) {
+	r := NewRegistry()
+	c, _ := r.Counter("requests", map[string]string{"host": "web1"})
+	c.Add(3)
+
+	rs := &recordingSubmitter{}
+	reporter, err := NewReporter(r, rs, ReporterOptions{Interval: time.Hour, Properties: map[string]string{"host": "default", "app": "api"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reporter.Report()
+	c.Inc()
+	if err := reporter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rs.batches) != 2 {
+		t.Fatalf("expected 2 reports, got %d", len(rs.batches))
+	}
+	m := rs.batches[0][0]
+	if m.Value != 3 || m.Properties["host"] != "web1" || m.Properties["app"] != "api" {
+		t.Fatalf("unexpected reported metric %+v", m)
+	}
+	if rs.batches[1][0].Value != 1 {
+		t.Fatalf("expected counter increase to be reported on close, got %+v", rs.batches[1][0])
+	}
+}
@@ -0,0 +1,120 @@
+package metrics
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+type ReporterOptions struct {
+	// How often registry snapshot is submitted. Defaults to 1 minute.
+	Interval time.Duration
+	// Properties added to every reported metric. Instrument properties with the same name take precedence.
+	Properties map[string]string
+	// Called from the background goroutine after every report.
+	OnResult func(BatchResult)
+}
+
+// Reporter periodically submits snapshot of the Registry.
+type Reporter struct {
+	registry  *Registry
+	submitter Submitter
+	opts      ReporterOptions
+
+	mu      sync.Mutex
+	closed  bool
+	reports chan chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// Constructs new Reporter and starts its background goroutine. Close should be called to release it.
+func NewReporter(registry *Registry, submitter Submitter, opts ReporterOptions) (*Reporter, error) {
+	if registry == nil {
+		return nil, errors.New("registry should not be nil")
+	}
+	if submitter == nil {
+		return nil, errors.New("submitter should not be nil")
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = time.Minute
+	}
+
+	r := &Reporter{
+		registry:  registry,
+		submitter: submitter,
+		opts:      opts,
+		reports:   make(chan chan struct{}),
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	go r.run()
+
+	return r, nil
+}
+
+// Report submits registry snapshot immediately and blocks until it is submitted.
+func (r *Reporter) Report() {
+	ack := make(chan struct{})
+	select {
+	case r.reports <- ack:
+		<-ack
+	case <-r.stopped:
+	}
+}
+
+// Close submits the last snapshot and waits for the background goroutine to finish.
+func (r *Reporter) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return errors.New("reporter is closed")
+	}
+	r.closed = true
+	r.mu.Unlock()
+
+	close(r.done)
+	<-r.stopped
+
+	return nil
+}
+
+func (r *Reporter) run() {
+	defer close(r.stopped)
+
+	ticker := time.NewTicker(r.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.report()
+		case ack := <-r.reports:
+			r.report()
+			close(ack)
+		case <-r.done:
+			r.report()
+			return
+		}
+	}
+}
+
+func (r *Reporter) report() {
+	snapshot := r.registry.Snapshot(time.Now())
+	if len(snapshot) == 0 {
+		return
+	}
+
+	for _, m := range snapshot {
+		for k, v := range r.opts.Properties {
+			if _, ok := m.Properties[k]; !ok {
+				m.Properties[k] = v
+			}
+		}
+	}
+
+	resp, err := r.submitter.SubmitMetrics(snapshot)
+	if r.opts.OnResult != nil {
+		r.opts.OnResult(BatchResult{Metrics: snapshot, Response: resp, Err: err})
+	}
+}
@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/anodot/anodot-common/pkg/apierror"
+	"github.com/anodot/anodot-common/pkg/deadletter"
+)
+
+// RejectedMetric is a metric which Anodot refused to accept.
+type RejectedMetric struct {
+	Metric Anodot20Metric
+	// Position of the metric in the submitted slice.
+	Index int
+	// Anodot error code, zero if the whole request was rejected.
+	Code   int64
+	Reason string
+}
+
+// SubmitResult is a metrics submission split by record.
+type SubmitResult struct {
+	Accepted []Anodot20Metric
+	Rejected []RejectedMetric
+	// Metrics which did not reach Anodot because of network failure or API error
+	// other than validation, e.g. unauthorized or server error. They can be resubmitted.
+	Undelivered []Anodot20Metric
+	// Error which caused metrics to be undelivered.
+	Err error
+
+	metrics []Anodot20Metric
+	records *apierror.Records
+}
+
+// NewSubmitResult splits metrics according to response and error returned by SubmitMetrics for them.
+func NewSubmitResult(metrics []Anodot20Metric, resp AnodotResponse, err error) *SubmitResult {
+	var failures []apierror.Failure
+	if r, ok := resp.(*CreateResponse); ok && r != nil && err != nil {
+		failures = r.failures()
+	}
+
+	result := &SubmitResult{metrics: metrics, records: apierror.SplitRecords(len(metrics), err, failures)}
+	if err == nil {
+		result.Accepted = metrics
+		return result
+	}
+	for _, i := range result.records.Accepted {
+		result.Accepted = append(result.Accepted, metrics[i])
+	}
+	for _, f := range result.records.Rejected {
+		result.Rejected = append(result.Rejected, RejectedMetric{Metric: metrics[f.Index], Index: f.Index, Code: f.Code, Reason: f.Description})
+	}
+	for _, i := range result.records.Undelivered {
+		result.Undelivered = append(result.Undelivered, metrics[i])
+	}
+	if len(result.Undelivered) > 0 {
+		result.Err = err
+	}
+
+	return result
+}
+
+// DeadLetterRecords converts rejected metrics to dead-letter records.
+func (r *SubmitResult) DeadLetterRecords(now time.Time) []deadletter.Record {
+	records := make([]deadletter.Record, len(r.Rejected))
+	for i, rm := range r.Rejected {
+		records[i] = deadletter.Record{Metric: rm.Metric, Index: rm.Index, Code: rm.Code, Reason: rm.Reason, Time: now}
+	}
+	return records
+}
+
+// failedRecords converts undelivered metrics whose error is permanent to dead-letter records.
+// They would fail the same way if resubmitted.
+func (r *SubmitResult) failedRecords(now time.Time) []deadletter.Record {
+	var records []deadletter.Record
+	for _, f := range r.records.Failed() {
+		records = append(records, deadletter.Record{Metric: r.metrics[f.Index], Index: f.Index, Reason: f.Description, Time: now})
+	}
+	return records
+}
+
+// retryable returns undelivered metrics whose error is temporary, so they may be resubmitted.
+func (r *SubmitResult) retryable() []Anodot20Metric {
+	var metrics []Anodot20Metric
+	for _, i := range r.records.Retryable() {
+		metrics = append(metrics, r.metrics[i])
+	}
+	return metrics
+}
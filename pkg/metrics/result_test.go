@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/anodot/anodot-common/pkg/apierror"
+	"github.com/anodot/anodot-common/pkg/chunk"
+	"github.com/anodot/anodot-common/pkg/deadletter"
+)
+
+func TestNewSubmitResult(t *testing.T) {
+	metrics := testMetrics(5)
+
+	resp := &CreateResponse{}
+	resp.Errors = append(resp.Errors, struct {
+		Description string
+		Error       int64
+		Index       string
+	}{Description: "bad value", Error: 1001, Index: "3"})
+	chunkErr := &chunk.Error{
+		Failed: []chunk.Chunk{{Start: 0, End: 2}},
+		Errs:   []error{&apierror.APIError{StatusCode: 503}},
+		Chunks: 3,
+	}
+
+	r := NewSubmitResult(metrics, resp, chunkErr)
+	if len(r.Accepted) != 2 || len(r.Undelivered) != 2 || len(r.Rejected) != 1 {
+		t.Fatalf("unexpected split: %d accepted, %d undelivered, %d rejected", len(r.Accepted), len(r.Undelivered), len(r.Rejected))
+	}
+	if rm := r.Rejected[0]; rm.Index != 3 || rm.Code != 1001 || rm.Reason != "bad value" || rm.Metric.Value != 3 {
+		t.Errorf("unexpected rejected metric: %+v", rm)
+	}
+	if r.Err != chunkErr {
+		t.Errorf("expected chunk error, got %v", r.Err)
+	}
+
+	r = NewSubmitResult(metrics, nil, &apierror.ValidationError{APIError: apierror.APIError{StatusCode: 400}})
+	if len(r.Rejected) != 5 || r.Err != nil {
+		t.Errorf("expected whole request to be rejected, got %+v", r)
+	}
+
+	r = NewSubmitResult(metrics, nil, errors.New("connection refused"))
+	if len(r.Undelivered) != 5 || r.Err == nil {
+		t.Errorf("expected all metrics to be undelivered, got %+v", r)
+	}
+
+	r = NewSubmitResult(metrics, nil, nil)
+	if len(r.Accepted) != 5 {
+		t.Errorf("expected all metrics to be accepted, got %+v", r)
+	}
+}
+
+func TestBatchSubmitterDeadLetter(t *testing.T) {
+	failures := []apierror.Failure{{Index: 1, Code: 1002, Description: "missing what"}}
+	rs := &recordingSubmitter{err: apierror.NewValidationError(nil, failures)}
+
+	var records []deadletter.Record
+	results := make(chan BatchResult, 1)
+	b, err := NewBatchSubmitter(rs, BatchOptions{
+		FlushInterval: time.Hour,
+		OnResult:      func(r BatchResult) { results <- r },
+		DeadLetter: deadletter.SinkFunc(func(r []deadletter.Record) error {
+			records = append(records, r...)
+			return nil
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	if _, err := b.SubmitMetrics(testMetrics(3)); err != nil {
+		t.Fatal(err)
+	}
+	b.Flush()
+	<-results
+
+	if len(records) != 1 {
+		t.Fatalf("expected 1 dead-letter record, got %d", len(records))
+	}
+	if r := records[0]; r.Index != 1 || r.Code != 1002 || r.Metric.(Anodot20Metric).Value != 1 {
+		t.Errorf("unexpected dead-letter record: %+v", r)
+	}
+}
@@ -1,11 +1,22 @@
 package metrics
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
 	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/anodot/anodot-common/pkg/retry"
 )
 
 func TestSubmitter(t *testing.T) {
@@ -85,6 +96,89 @@ func TestSpecialChars(t *testing.T) {
 	}
 }
 
+func TestSubmitMetricsContextCancel(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	u, _ := url.Parse(srv.URL)
+	c, err := NewAnodot20Client(*u, "token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.RetryPolicy = retry.DefaultPolicy()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = c.SubmitMetricsContext(ctx, testMetrics(1))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded error, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("request was not cancelled")
+	}
+}
+
+func TestErrorsRedactToken(t *testing.T) {
+	const secret = "s3cr3t-d4t4-t0k3n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "invalid request %s", r.URL.String())
+			return
+		}
+		// drop connection, so client returns *url.Error
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	c, err := NewAnodot20Client(*u, secret, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.SubmitMetrics(testMetrics(1))
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) {
+		t.Fatalf("expected *url.Error, got %T: %v", err, err)
+	}
+	if strings.Contains(err.Error(), secret) || strings.Contains(urlErr.URL, secret) {
+		t.Fatalf("token in error: %v", err)
+	}
+	if errors.Unwrap(err) == nil {
+		t.Fatal("redacted error does not unwrap")
+	}
+
+	_, err = c.DeleteMetrics(DeleteExpression{Type: "property", Key: "what", Value: "cpu"})
+	if err == nil || strings.Contains(err.Error(), secret) {
+		t.Fatalf("expected redacted error, got %v", err)
+	}
+}
+
+func TestHTTPDebugScope(t *testing.T) {
+	os.Setenv("ANODOT_HTTP_DEBUG_ENABLED", "true")
+	defer os.Unsetenv("ANODOT_HTTP_DEBUG_ENABLED")
+
+	u, _ := url.Parse("http://localhost")
+	c, _ := NewAnodot20Client(*u, "token", nil)
+	if c.Tracer == nil {
+		t.Fatal("expected debug tracer for default http client")
+	}
+
+	c, _ = NewAnodot20Client(*u, "token", &http.Client{})
+	if c.Tracer != nil {
+		t.Fatal("debug tracer should not be set for caller's http client")
+	}
+}
+
 func equalJson(s1, s2 string) (bool, error) {
 	var o1 interface{}
 	var o2 interface{}
@@ -109,3 +203,52 @@ type MockSubmitter struct {
 func (s *MockSubmitter) SubmitMetrics(metrics []Anodot20Metric) {
 	s.f(metrics)
 }
+
+// closeTracker is http.RoundTripper counting response bodies which were not closed.
+type closeTracker struct {
+	open int32
+}
+
+type trackedBody struct {
+	io.Reader
+	t *closeTracker
+}
+
+func (b *trackedBody) Close() error {
+	atomic.AddInt32(&b.t.open, -1)
+	return nil
+}
+
+func (t *closeTracker) RoundTrip(r *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&t.open, 1)
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: r,
+		Body: &trackedBody{Reader: strings.NewReader(`{"errors":[],"validation":{"passed":true}}`), t: t}}, nil
+}
+
+func TestResponseBodiesClosed(t *testing.T) {
+	tracker := &closeTracker{}
+	u, _ := url.Parse("http://anodot")
+	c, err := NewAnodot20Client(*u, "token", &http.Client{Transport: tracker})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Chunking.MaxRecords = 1
+
+	metrics := []Anodot20Metric{
+		{Properties: map[string]string{"what": "a"}, Timestamp: AnodotTimestamp{time.Now()}, Value: 1},
+		{Properties: map[string]string{"what": "b"}, Timestamp: AnodotTimestamp{time.Now()}, Value: 2},
+	}
+	if _, err := c.SubmitMetrics(metrics); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.FlushMetricsBucketContext(context.Background(), metrics, "shortRollup", time.UTC); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.DeleteMetricsContext(context.Background(), DeleteExpression{Type: "property", Key: "what", Value: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := atomic.LoadInt32(&tracker.open); n != 0 {
+		t.Fatalf("%d response bodies were not closed", n)
+	}
+}
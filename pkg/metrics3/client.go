@@ -2,15 +2,25 @@ package metrics3
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"os"
 	"strconv"
+	"sync"
 	"time"
+
+	"github.com/anodot/anodot-common/pkg/apierror"
+	"github.com/anodot/anodot-common/pkg/chunk"
+	"github.com/anodot/anodot-common/pkg/compression"
+	"github.com/anodot/anodot-common/pkg/credentials"
+	"github.com/anodot/anodot-common/pkg/httplog"
+	"github.com/anodot/anodot-common/pkg/ratelimit"
+	"github.com/anodot/anodot-common/pkg/retry"
 )
 
 type AnodotResponse interface {
@@ -48,15 +58,39 @@ type refreshBearerResponse struct {
 	Api30Response
 }
 
+// Anodot 3.0 client. Methods are safe for concurrent use by multiple goroutines,
+// exported fields should not be modified once the client is in use.
 type Anodot30Client struct {
 	ServerURL           *url.URL
 	AccessKey           *string
 	DataCollectionToken *string
-	client              *http.Client
-	bearerToken         *struct {
-		timestemp time.Time
-		token     string
-	}
+	// Retry policy applied to every request. Nil disables retries.
+	RetryPolicy *retry.Policy
+	// Compression of metrics and watermark request bodies. Nil sends them uncompressed.
+	Compression *compression.Options
+	// Limits of a single metrics request. Larger batches are split into chunks, and record
+	// indexes in the merged response refer to positions in the submitted slice.
+	Chunking chunk.Options
+	// Limits requests to data collection APIs, metrics and watermarks. Nil disables limiting.
+	// The same Limiter may be shared by several clients to apply a common budget.
+	RateLimit *ratelimit.Limiter
+	// Limits requests to APIs authenticated with bearer token, including the token refresh.
+	BearerRateLimit *ratelimit.Limiter
+	// Optional provider queried before every request, takes precedence over AccessKey and
+	// DataCollectionToken. Bearer token is refreshed once the provider returns a new access key.
+	Credentials credentials.Provider
+	// How long before expiry bearer token is refreshed. Zero means DefaultTokenRefreshMargin.
+	TokenRefreshMargin time.Duration
+	// Logs requests and responses with secrets redacted. Nil disables logging. Set to debug level
+	// text logger writing to stdout if ANODOT_HTTP_DEBUG_ENABLED environment variable is true
+	// and the client is constructed without http.Client of its own.
+	Tracer *httplog.Tracer
+
+	client *http.Client
+	tokens tokenManager
+
+	registry     *SchemaRegistry
+	registryOnce sync.Once
 }
 
 func NewAnodot30Client(anodotURL url.URL, accessKey *string, dataToken *string, httpClient *http.Client) (*Anodot30Client, error) {
@@ -64,48 +98,95 @@ func NewAnodot30Client(anodotURL url.URL, accessKey *string, dataToken *string,
 		return nil, fmt.Errorf("anodot token can't be nil")
 	}
 
-	submitter := Anodot30Client{AccessKey: accessKey, DataCollectionToken: dataToken, ServerURL: &anodotURL, client: httpClient, bearerToken: nil}
+	submitter := newAnodot30Client(anodotURL, httpClient)
+	submitter.AccessKey, submitter.DataCollectionToken = accessKey, dataToken
+	return submitter, nil
+}
+
+// Constructs new client which takes access key and data collection token from provider before every request.
+func NewAnodot30ClientWithCredentials(anodotURL url.URL, provider credentials.Provider, httpClient *http.Client) (*Anodot30Client, error) {
+	if provider == nil {
+		return nil, fmt.Errorf("credentials provider can't be nil")
+	}
+
+	submitter := newAnodot30Client(anodotURL, httpClient)
+	submitter.Credentials = provider
+	return submitter, nil
+}
+
+func newAnodot30Client(anodotURL url.URL, httpClient *http.Client) *Anodot30Client {
+	submitter := Anodot30Client{ServerURL: &anodotURL, client: httpClient}
 	if httpClient == nil {
-		client := http.Client{Timeout: 30 * time.Second}
+		submitter.client = &http.Client{Timeout: 30 * time.Second}
 
-		debugHTTP, _ := strconv.ParseBool(os.Getenv("ANODOT_HTTP_DEBUG_ENABLED"))
-		if debugHTTP {
-			client.Transport = &debugHTTPTransport{r: http.DefaultTransport}
+		if debugHTTP, _ := strconv.ParseBool(os.Getenv("ANODOT_HTTP_DEBUG_ENABLED")); debugHTTP {
+			submitter.Tracer = &httplog.Tracer{Logger: httplog.NewTextLogger(os.Stdout, httplog.LevelDebug)}
 		}
-		submitter.client = &client
+	}
+	return &submitter
+}
+
+// credentials returns access key and data collection token of the next request, nil if not provided.
+func (c *Anodot30Client) credentials(ctx context.Context) (accessKey *string, dataToken *string, err error) {
+	if c.Credentials == nil {
+		return c.AccessKey, c.DataCollectionToken, nil
 	}
 
-	return &submitter, nil
+	creds, err := c.Credentials.Credentials(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get anodot credentials: %w", err)
+	}
+	if creds.AccessKey != "" {
+		accessKey = &creds.AccessKey
+	}
+	if creds.DataToken != "" {
+		dataToken = &creds.DataToken
+	}
+	return accessKey, dataToken, nil
 }
 
 func (c *Anodot30Client) GetBearerToken() (*string, error) {
-	// Token valid 24 hours, so if BearerToken field is null or token expired
-	// needs to refresh it, otherwise, returns existed token
-
-	if c.bearerToken == nil || time.Since(c.bearerToken.timestemp) > 24*time.Hour {
-		resp, err := c.refreshBearerToken()
-		if err != nil {
-			return nil, err
-		}
+	return c.GetBearerTokenContext(context.Background())
+}
 
-		if resp.HasErrors() {
-			return nil, fmt.Errorf("failed to refresh toke: %v", resp.ErrorMessage())
-		}
+// GetBearerTokenContext returns cached bearer token, refreshing it shortly before it expires.
+// Expiry is read from the token if it is JWT, otherwise token is assumed valid for 24 hours.
+// Concurrent callers share a single refresh.
+func (c *Anodot30Client) GetBearerTokenContext(ctx context.Context) (*string, error) {
+	margin := c.TokenRefreshMargin
+	if margin == 0 {
+		margin = DefaultTokenRefreshMargin
+	}
 
-		c.bearerToken = &struct {
-			timestemp time.Time
-			token     string
-		}{resp.refreshTime, resp.bearer}
+	accessKey, _, err := c.credentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if accessKey == nil {
+		return nil, fmt.Errorf("please provide AccesKey for obtain bearer token")
+	}
 
+	token, err := c.tokens.get(ctx, margin, *accessKey, c.newBearerToken)
+	if err != nil {
+		return nil, err
 	}
-	return &c.bearerToken.token, nil
+	return &token, nil
 }
 
-func (c *Anodot30Client) refreshBearerToken() (*refreshBearerResponse, error) {
+func (c *Anodot30Client) newBearerToken(ctx context.Context, accessKey string) (bearerToken, error) {
+	resp, err := c.refreshBearerToken(ctx, accessKey)
+	if err != nil {
+		return bearerToken{}, err
+	}
 
-	if c.AccessKey == nil {
-		return nil, fmt.Errorf("please provide AccesKey for obtain bearer token")
+	expires, ok := tokenExpiry(resp.bearer)
+	if !ok {
+		expires = resp.refreshTime.Add(defaultBearerLifetime)
 	}
+	return bearerToken{token: resp.bearer, issued: resp.refreshTime, expires: expires}, nil
+}
+
+func (c *Anodot30Client) refreshBearerToken(ctx context.Context, accessKey string) (*refreshBearerResponse, error) {
 	sUrl := *c.ServerURL
 	sUrl.Path = "api/v2/access-token"
 
@@ -118,29 +199,26 @@ func (c *Anodot30Client) refreshBearerToken() (*refreshBearerResponse, error) {
 		struct {
 			RefreshToken string `json:"refreshToken"`
 		}{
-			*c.AccessKey,
+			accessKey,
 		},
 	)
 
-	r, _ := http.NewRequest(http.MethodPost, sUrl.String(), bytes.NewBuffer(b))
+	r, _ := http.NewRequestWithContext(ctx, http.MethodPost, sUrl.String(), bytes.NewBuffer(b))
 	r.Header.Add("Content-Type", "application/json")
 
-	resp, err := c.client.Do(r)
+	resp, err := c.do(r, c.BearerRateLimit, 0)
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 	bodyBytes, _ := ioutil.ReadAll(resp.Body)
 
 	refreshResponse := refreshBearerResponse{}
 	refreshResponse.HttpResponse = resp
 
 	if resp.StatusCode/100 != 2 {
-		err = json.Unmarshal(bodyBytes, &refreshResponse.Error)
-		if err != nil {
-			return &refreshResponse,
-				fmt.Errorf("failed to parse reponse body: %v \n%s", err, string(bodyBytes))
-		}
-		return &refreshResponse, nil
+		_ = json.Unmarshal(bodyBytes, &refreshResponse.Error)
+		return &refreshResponse, apierror.FromResponse(resp, bodyBytes)
 	}
 
 	responseJson := struct{ Token string }{}
@@ -148,7 +226,7 @@ func (c *Anodot30Client) refreshBearerToken() (*refreshBearerResponse, error) {
 	err = json.Unmarshal(bodyBytes, &responseJson)
 	if err != nil {
 		return &refreshResponse,
-			fmt.Errorf("failed to parse reponse body: %v \n%s", err, string(bodyBytes))
+			fmt.Errorf("failed to parse reponse body: %v \n%s", err, httplog.RedactText(string(bodyBytes)))
 	}
 
 	refreshResponse.bearer = responseJson.Token
@@ -157,7 +235,27 @@ func (c *Anodot30Client) refreshBearerToken() (*refreshBearerResponse, error) {
 }
 
 func (c *Anodot30Client) SubmitMetrics(metrics []AnodotMetrics30) (*SubmitMetricsResponse, error) {
-	if c.DataCollectionToken == nil {
+	return c.SubmitMetricsContext(context.Background(), metrics)
+}
+
+func (c *Anodot30Client) SubmitMetricsContext(ctx context.Context, metrics []AnodotMetrics30) (*SubmitMetricsResponse, error) {
+	resp, err := c.submitMetrics(ctx, metrics)
+	if err != nil {
+		schemaIds := make([]string, len(metrics))
+		for i, m := range metrics {
+			schemaIds[i] = m.SchemaId
+		}
+		c.Schemas().invalidate(schemaIds, err)
+	}
+	return resp, err
+}
+
+func (c *Anodot30Client) submitMetrics(ctx context.Context, metrics []AnodotMetrics30) (*SubmitMetricsResponse, error) {
+	_, dataToken, err := c.credentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if dataToken == nil {
 		return nil,
 			fmt.Errorf("DataCollectionToken should be provided for metrics submit ")
 	}
@@ -166,21 +264,73 @@ func (c *Anodot30Client) SubmitMetrics(metrics []AnodotMetrics30) (*SubmitMetric
 	sUrl.Path = "api/v1/metrics"
 
 	q := sUrl.Query()
-	q.Set("token", *c.DataCollectionToken)
+	q.Set("token", *dataToken)
 	q.Set("protocol", "anodot30")
 	sUrl.RawQuery = q.Encode()
 
-	b, err := json.Marshal(metrics)
+	chunks, err := chunk.Encode(metrics, c.Chunking)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to parse schema:" + err.Error())
 	}
-	r, _ := http.NewRequest(http.MethodPost, sUrl.String(), bytes.NewBuffer(b))
+
+	if len(chunks) == 1 {
+		return c.submitChunk(ctx, sUrl.String(), chunks[0])
+	}
+
+	responses := make([]*SubmitMetricsResponse, len(chunks))
+	errs := make([]error, len(chunks))
+	chunk.Run(len(chunks), c.Chunking.Concurrency, func(i int) {
+		responses[i], errs[i] = c.submitChunk(ctx, sUrl.String(), chunks[i])
+	})
+
+	// merge chunk responses, shifting record indexes to positions in metrics
+	merged := &SubmitMetricsResponse{}
+	chunkErr := &chunk.Error{Chunks: len(chunks)}
+	for i, ch := range chunks {
+		resp := responses[i]
+		if resp != nil {
+			if resp.HttpResponse != nil {
+				merged.HttpResponse = resp.HttpResponse
+			}
+			for _, e := range resp.Errors {
+				if index := apierror.ParseIndex(e.Index); index >= 0 {
+					e.Index = strconv.Itoa(index + ch.Start)
+				}
+				merged.Errors = append(merged.Errors, e)
+			}
+		}
+
+		if errs[i] != nil && (resp == nil || !resp.HasErrors()) {
+			ch.Body = nil
+			chunkErr.Failed = append(chunkErr.Failed, ch)
+			chunkErr.Errs = append(chunkErr.Errs, errs[i])
+		} else {
+			ch.Body = nil
+			chunkErr.Accepted = append(chunkErr.Accepted, ch)
+		}
+	}
+
+	if len(chunkErr.Failed) > 0 {
+		return merged, chunkErr
+	}
+	if merged.HasErrors() {
+		return merged, merged.validationError()
+	}
+	return merged, nil
+}
+
+func (c *Anodot30Client) submitChunk(ctx context.Context, url string, ch chunk.Chunk) (*SubmitMetricsResponse, error) {
+	r, err := compression.NewRequest(ctx, c.Compression, http.MethodPost, url, ch.Body)
+	if err != nil {
+		return nil, httplog.RedactError(err)
+	}
 	r.Header.Add("Content-Type", "application/json")
 
-	resp, err := c.client.Do(r)
+	resp, err := c.do(r, c.RateLimit, ch.End-ch.Start)
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 	anodotResponse := &SubmitMetricsResponse{}
 	anodotResponse.HttpResponse = resp
 
@@ -190,28 +340,28 @@ func (c *Anodot30Client) SubmitMetrics(metrics []AnodotMetrics30) (*SubmitMetric
 
 	bodyBytes, _ := ioutil.ReadAll(resp.Body)
 	if resp.StatusCode/100 != 2 {
-		err = json.Unmarshal(bodyBytes, &anodotResponse)
-		if err != nil {
-			return anodotResponse, fmt.Errorf("http response is differ from 2xx\nfalied to parse response body: %v \n%s", err, string(bodyBytes))
-		}
+		_ = json.Unmarshal(bodyBytes, anodotResponse)
+		return anodotResponse, apierror.FromResponse(resp, bodyBytes)
 	}
 
 	err = json.Unmarshal(bodyBytes, anodotResponse)
 	if err != nil {
 		return anodotResponse,
-			fmt.Errorf("failed to parse reponse body: %v \n%s", err, string(bodyBytes))
+			fmt.Errorf("failed to parse reponse body: %v \n%s", err, httplog.RedactText(string(bodyBytes)))
+	}
+
+	if anodotResponse.HasErrors() {
+		return anodotResponse, anodotResponse.validationError()
 	}
 	return anodotResponse, nil
 }
 
 func (c *Anodot30Client) CreateSchema(schema AnodotMetricsSchema) (*CreateSchemaResponse, error) {
-	token, err := c.GetBearerToken()
-	if err != nil {
-		return nil, err
-	}
+	return c.CreateSchemaContext(context.Background(), schema)
+}
 
-	var bearer = "Bearer " + *token
-	sUrl := c.ServerURL
+func (c *Anodot30Client) CreateSchemaContext(ctx context.Context, schema AnodotMetricsSchema) (*CreateSchemaResponse, error) {
+	sUrl := *c.ServerURL
 	sUrl.Path = "/api/v2/stream-schemas"
 
 	b, e := json.Marshal(schema)
@@ -220,15 +370,17 @@ func (c *Anodot30Client) CreateSchema(schema AnodotMetricsSchema) (*CreateSchema
 			fmt.Errorf("Failed to parse schema:" + e.Error())
 	}
 
-	r, _ := http.NewRequest(http.MethodPost, sUrl.String(), bytes.NewBuffer(b))
+	r, _ := http.NewRequestWithContext(ctx, http.MethodPost, sUrl.String(), bytes.NewBuffer(b))
+	// Repeated request may create duplicate schema
+	r = retry.NonIdempotent(r)
 
-	r.Header.Set("Authorization", bearer)
 	r.Header.Add("Content-Type", "application/json")
 
-	resp, err := c.client.Do(r)
+	resp, err := c.doBearer(r)
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 
 	anodotResponse := &CreateSchemaResponse{}
 	anodotResponse.HttpResponse = resp
@@ -240,12 +392,8 @@ func (c *Anodot30Client) CreateSchema(schema AnodotMetricsSchema) (*CreateSchema
 	bodyBytes, _ := ioutil.ReadAll(resp.Body)
 
 	if resp.StatusCode/100 != 2 {
-		err = json.Unmarshal(bodyBytes, &anodotResponse.Error)
-		if err != nil {
-			return anodotResponse,
-				fmt.Errorf("failed to parse reponse body: %v \n%s", err, string(bodyBytes))
-		}
-		return anodotResponse, nil
+		_ = json.Unmarshal(bodyBytes, &anodotResponse.Error)
+		return anodotResponse, apierror.FromResponse(resp, bodyBytes)
 	}
 
 	schemaCreated := struct {
@@ -264,24 +412,22 @@ func (c *Anodot30Client) CreateSchema(schema AnodotMetricsSchema) (*CreateSchema
 }
 
 func (c *Anodot30Client) DeleteSchema(schemaId string) (*DeleteSchemaResponse, error) {
-	token, err := c.GetBearerToken()
-	if err != nil {
-		return nil, err
-	}
+	return c.DeleteSchemaContext(context.Background(), schemaId)
+}
 
-	var bearer = "Bearer " + *token
-	sUrl := c.ServerURL
+func (c *Anodot30Client) DeleteSchemaContext(ctx context.Context, schemaId string) (*DeleteSchemaResponse, error) {
+	sUrl := *c.ServerURL
 	sUrl.Path = "api/v2/stream-schemas/" + schemaId
 
-	r, _ := http.NewRequest(http.MethodDelete, sUrl.String(), nil)
+	r, _ := http.NewRequestWithContext(ctx, http.MethodDelete, sUrl.String(), nil)
 
-	r.Header.Set("Authorization", bearer)
 	r.Header.Add("Content-Type", "application/json")
 
-	resp, err := c.client.Do(r)
+	resp, err := c.doBearer(r)
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 
 	anodotResponse := &DeleteSchemaResponse{}
 	anodotResponse.HttpResponse = resp
@@ -293,13 +439,8 @@ func (c *Anodot30Client) DeleteSchema(schemaId string) (*DeleteSchemaResponse, e
 	bodyBytes, _ := ioutil.ReadAll(resp.Body)
 
 	if resp.StatusCode/100 != 2 {
-		err = json.Unmarshal(bodyBytes, &anodotResponse.Error)
-		fmt.Println(anodotResponse.Error)
-		if err != nil {
-			return anodotResponse,
-				fmt.Errorf("failed to parse reponse body: %v \n%s", err, string(bodyBytes))
-		}
-		return anodotResponse, nil
+		_ = json.Unmarshal(bodyBytes, &anodotResponse.Error)
+		return anodotResponse, apierror.FromResponse(resp, bodyBytes)
 	}
 
 	schemaDeleted := struct {
@@ -312,29 +453,26 @@ func (c *Anodot30Client) DeleteSchema(schemaId string) (*DeleteSchemaResponse, e
 	}
 
 	anodotResponse.SchemaId = &schemaDeleted.Deleted
+	c.Schemas().remove(schemaId)
 	return anodotResponse, nil
 }
 
 func (c *Anodot30Client) GetSchemas() (*GetSchemaResponse, error) {
+	return c.GetSchemasContext(context.Background())
+}
 
-	token, err := c.GetBearerToken()
-	if err != nil {
-		return nil, err
-	}
-
-	var bearer = "Bearer " + *token
+func (c *Anodot30Client) GetSchemasContext(ctx context.Context) (*GetSchemaResponse, error) {
 
-	sUrl := c.ServerURL
+	sUrl := *c.ServerURL
 	sUrl.Path = "/api/v2/stream-schemas/schemas"
 
-	r, _ := http.NewRequest(http.MethodGet, sUrl.String(), nil)
-
-	r.Header.Set("Authorization", bearer)
+	r, _ := http.NewRequestWithContext(ctx, http.MethodGet, sUrl.String(), nil)
 
-	resp, err := c.client.Do(r)
+	resp, err := c.doBearer(r)
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 
 	anodotResponse := &GetSchemaResponse{}
 	anodotResponse.HttpResponse = resp
@@ -350,11 +488,8 @@ func (c *Anodot30Client) GetSchemas() (*GetSchemaResponse, error) {
 	}
 
 	if resp.StatusCode/100 != 2 {
-		err = json.Unmarshal(bodyBytes, &anodotResponse.Error)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse reponse body: %v \n%s", err, string(bodyBytes))
-		}
-		return anodotResponse, nil
+		_ = json.Unmarshal(bodyBytes, &anodotResponse.Error)
+		return anodotResponse, apierror.FromResponse(resp, bodyBytes)
 	}
 
 	schemasTmp := make([]StreamSchemaWrapper, 0)
@@ -374,8 +509,122 @@ func (c *Anodot30Client) GetSchemas() (*GetSchemaResponse, error) {
 	return anodotResponse, nil
 }
 
+func (c *Anodot30Client) GetSchema(schemaId string) (*GetSchemaByIdResponse, error) {
+	return c.GetSchemaContext(context.Background(), schemaId)
+}
+
+func (c *Anodot30Client) GetSchemaContext(ctx context.Context, schemaId string) (*GetSchemaByIdResponse, error) {
+	sUrl := *c.ServerURL
+	sUrl.Path = "/api/v2/stream-schemas/" + schemaId
+
+	r, _ := http.NewRequestWithContext(ctx, http.MethodGet, sUrl.String(), nil)
+
+	resp, err := c.doBearer(r)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	anodotResponse := &GetSchemaByIdResponse{}
+	anodotResponse.HttpResponse = resp
+
+	if resp.Body == nil {
+		return anodotResponse, fmt.Errorf("empty response body")
+	}
+
+	bodyBytes, _ := ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		_ = json.Unmarshal(bodyBytes, &anodotResponse.Error)
+		return anodotResponse, apierror.FromResponse(resp, bodyBytes)
+	}
+
+	wrapper := StreamSchemaWrapper{}
+	err = json.Unmarshal(bodyBytes, &wrapper)
+	if err != nil {
+		return anodotResponse, err
+	}
+
+	anodotResponse.Schema = &wrapper.Wrapper.Schema
+	return anodotResponse, nil
+}
+
+// UpdateSchema replaces definition of existing schema with schema.Id. Use CheckCompatibility
+// before the update to find out whether the change breaks metrics which are already sent.
+func (c *Anodot30Client) UpdateSchema(schema AnodotMetricsSchema) (*UpdateSchemaResponse, error) {
+	return c.UpdateSchemaContext(context.Background(), schema)
+}
+
+func (c *Anodot30Client) UpdateSchemaContext(ctx context.Context, schema AnodotMetricsSchema) (*UpdateSchemaResponse, error) {
+	if schema.Id == "" {
+		return nil, fmt.Errorf("schema id should be provided for schema update")
+	}
+
+	sUrl := *c.ServerURL
+	sUrl.Path = "/api/v2/stream-schemas/" + schema.Id
+
+	b, e := json.Marshal(schema)
+	if e != nil {
+		return nil,
+			fmt.Errorf("Failed to parse schema:" + e.Error())
+	}
+
+	r, _ := http.NewRequestWithContext(ctx, http.MethodPut, sUrl.String(), bytes.NewBuffer(b))
+
+	r.Header.Add("Content-Type", "application/json")
+
+	resp, err := c.doBearer(r)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	anodotResponse := &UpdateSchemaResponse{}
+	anodotResponse.HttpResponse = resp
+
+	if resp.Body == nil {
+		return anodotResponse, fmt.Errorf("empty response body")
+	}
+
+	bodyBytes, _ := ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		_ = json.Unmarshal(bodyBytes, &anodotResponse.Error)
+		return anodotResponse, apierror.FromResponse(resp, bodyBytes)
+	}
+
+	schemaUpdated := struct {
+		Schema AnodotMetricsSchema `json:"schema"`
+	}{}
+
+	err = json.Unmarshal(bodyBytes, &schemaUpdated)
+	if err != nil {
+		return anodotResponse, err
+	}
+
+	anodotResponse.Schema = &schemaUpdated.Schema
+	c.Schemas().add(schemaUpdated.Schema)
+	return anodotResponse, nil
+}
+
 func (c *Anodot30Client) SubmitWatermark(schemaId string, watermark AnodotTimestamp) (*SubmitWatermarkResponse, error) {
-	if c.DataCollectionToken == nil {
+	return c.SubmitWatermarkContext(context.Background(), schemaId, watermark)
+}
+
+func (c *Anodot30Client) SubmitWatermarkContext(ctx context.Context, schemaId string, watermark AnodotTimestamp) (*SubmitWatermarkResponse, error) {
+	resp, err := c.submitWatermark(ctx, schemaId, watermark)
+	if err != nil {
+		c.Schemas().invalidate([]string{schemaId}, err)
+	}
+	return resp, err
+}
+
+func (c *Anodot30Client) submitWatermark(ctx context.Context, schemaId string, watermark AnodotTimestamp) (*SubmitWatermarkResponse, error) {
+	_, dataToken, err := c.credentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if dataToken == nil {
 		return nil,
 			fmt.Errorf("DataCollectionToken should be provided for watermark submit ")
 	}
@@ -384,7 +633,7 @@ func (c *Anodot30Client) SubmitWatermark(schemaId string, watermark AnodotTimest
 	sUrl.Path = "api/v1/metrics/watermark"
 
 	q := sUrl.Query()
-	q.Set("token", *c.DataCollectionToken)
+	q.Set("token", *dataToken)
 	q.Set("protocol", "anodot30")
 	sUrl.RawQuery = q.Encode()
 
@@ -394,13 +643,17 @@ func (c *Anodot30Client) SubmitWatermark(schemaId string, watermark AnodotTimest
 			Watermark AnodotTimestamp `json:"watermark"`
 		}{schemaId, watermark},
 	)
-	r, _ := http.NewRequest(http.MethodPost, sUrl.String(), bytes.NewBuffer(b))
+	r, err := compression.NewRequest(ctx, c.Compression, http.MethodPost, sUrl.String(), b)
+	if err != nil {
+		return nil, httplog.RedactError(err)
+	}
 	r.Header.Add("Content-Type", "application/json")
 
-	resp, err := c.client.Do(r)
+	resp, err := c.do(r, c.RateLimit, 0)
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 	anodotResponse := SubmitWatermarkResponse{}
 	anodotResponse.HttpResponse = resp
 
@@ -411,28 +664,27 @@ func (c *Anodot30Client) SubmitWatermark(schemaId string, watermark AnodotTimest
 	bodyBytes, _ := ioutil.ReadAll(resp.Body)
 
 	if resp.StatusCode/100 != 2 {
-		err = json.Unmarshal(bodyBytes, &anodotResponse)
-		if err != nil {
-			return &anodotResponse, fmt.Errorf("http response is differ from 2xx\nfalied to parse response body: %v \n%s", err, string(bodyBytes))
-		}
+		_ = json.Unmarshal(bodyBytes, &anodotResponse)
+		return &anodotResponse, apierror.FromResponse(resp, bodyBytes)
 	}
 
 	err = json.Unmarshal(bodyBytes, &anodotResponse)
 	if err != nil {
 		return &anodotResponse,
-			fmt.Errorf("failed to parse reponse body: %v \n%s", err, string(bodyBytes))
+			fmt.Errorf("failed to parse reponse body: %v \n%s", err, httplog.RedactText(string(bodyBytes)))
 	}
 
+	if anodotResponse.HasErrors() {
+		return &anodotResponse, anodotResponse.validationError()
+	}
 	return &anodotResponse, nil
 }
 
 func (c *Anodot30Client) SendToBC(bcData Pipeline) (*Api30Response, error) {
-	token, err := c.GetBearerToken()
-	if err != nil {
-		return nil, err
-	}
+	return c.SendToBCContext(context.Background(), bcData)
+}
 
-	var bearer = "Bearer " + *token
+func (c *Anodot30Client) SendToBCContext(ctx context.Context, bcData Pipeline) (*Api30Response, error) {
 	sUrl := *c.ServerURL
 	sUrl.Path = "api/v2/bc/agents"
 
@@ -441,15 +693,15 @@ func (c *Anodot30Client) SendToBC(bcData Pipeline) (*Api30Response, error) {
 		return nil, fmt.Errorf("Failed to parse bc data:" + e.Error())
 	}
 
-	r, _ := http.NewRequest(http.MethodPost, sUrl.String(), bytes.NewBuffer(b))
+	r, _ := http.NewRequestWithContext(ctx, http.MethodPost, sUrl.String(), bytes.NewBuffer(b))
 
-	r.Header.Set("Authorization", bearer)
 	r.Header.Add("Content-Type", "application/json")
 
-	resp, err := c.client.Do(r)
+	resp, err := c.doBearer(r)
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 
 	anodotResponse := &Api30Response{}
 	anodotResponse.HttpResponse = resp
@@ -461,30 +713,65 @@ func (c *Anodot30Client) SendToBC(bcData Pipeline) (*Api30Response, error) {
 	bodyBytes, _ := ioutil.ReadAll(resp.Body)
 
 	if resp.StatusCode/100 != 2 {
-		err = json.Unmarshal(bodyBytes, &anodotResponse.Error)
-		if err != nil {
-			return anodotResponse, fmt.Errorf("failed to parse reponse body: %v \n%s", err, string(bodyBytes))
-		}
-		return anodotResponse, nil
+		_ = json.Unmarshal(bodyBytes, &anodotResponse.Error)
+		return anodotResponse, apierror.FromResponse(resp, bodyBytes)
 	}
 
 	return anodotResponse, nil
 }
 
-type debugHTTPTransport struct {
-	r http.RoundTripper
-}
-
-func (d *debugHTTPTransport) RoundTrip(h *http.Request) (*http.Response, error) {
-	dump, _ := httputil.DumpRequestOut(h, true)
-	fmt.Printf("----------------------------------REQUEST----------------------------------\n%s\n", string(dump))
-	resp, err := d.r.RoundTrip(h)
+// doBearer sends request to API authenticated with bearer token. If the server rejects
+// the token, it is refreshed and the request is retried once. If that fails, *apierror.ReauthError
+// is returned.
+func (c *Anodot30Client) doBearer(r *http.Request) (*http.Response, error) {
+	token, err := c.GetBearerTokenContext(r.Context())
 	if err != nil {
-		fmt.Println("failed to obtain response: ", err.Error())
+		return nil, err
+	}
+	r.Header.Set("Authorization", "Bearer "+*token)
+
+	resp, err := c.do(r, c.BearerRateLimit, 0)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || (r.Body != nil && r.GetBody == nil) {
 		return resp, err
 	}
 
-	dump, _ = httputil.DumpResponse(resp, true)
-	fmt.Printf("----------------------------------RESPONSE----------------------------------\n%s\n----------------------------------\n\n", string(dump))
-	return resp, err
+	c.tokens.invalidate(*token)
+	token, err = c.GetBearerTokenContext(r.Context())
+	if err != nil {
+		return nil, reauthError(resp, err)
+	}
+
+	retry := r.Clone(r.Context())
+	if r.GetBody != nil {
+		if retry.Body, err = r.GetBody(); err != nil {
+			return nil, reauthError(resp, fmt.Errorf("failed to reset request body: %w", err))
+		}
+	}
+	retry.Header.Set("Authorization", "Bearer "+*token)
+
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return c.do(retry, c.BearerRateLimit, 0)
+}
+
+// reauthError consumes unauthorized response and returns its error along with the reason the request could not be repeated.
+func reauthError(resp *http.Response, err error) error {
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	return &apierror.ReauthError{Err: apierror.FromResponse(resp, body), RefreshErr: err}
+}
+
+// do sends request carrying the given number of metrics, waiting for limiter budget before every attempt.
+// Returned error has credentials redacted.
+func (c *Anodot30Client) do(r *http.Request, limiter *ratelimit.Limiter, metrics int) (*http.Response, error) {
+	resp, err := retry.Do(c.RetryPolicy, r, func(r *http.Request) (*http.Response, error) {
+		release, err := limiter.Acquire(r.Context(), metrics)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		return c.Tracer.Do(r, c.client.Do)
+	})
+	// *url.Error carries request URL, including data collection token
+	return resp, httplog.RedactError(err)
 }
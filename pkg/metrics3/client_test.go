@@ -0,0 +1,217 @@
+package metrics3
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/anodot/anodot-common/pkg/apierror"
+	"github.com/anodot/anodot-common/pkg/retry"
+)
+
+func TestGetSchemasContextCancelsTokenRefresh(t *testing.T) {
+	started := make(chan struct{}, 1)
+	refreshCancelled := make(chan struct{})
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) > 1 {
+			t.Errorf("unexpected request %s", r.URL.Path)
+			return
+		}
+		// client disconnect is noticed once the body is read
+		_, _ = ioutil.ReadAll(r.Body)
+		started <- struct{}{}
+		<-r.Context().Done()
+		close(refreshCancelled)
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	accessKey := "key"
+	c, err := NewAnodot30Client(*u, &accessKey, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.GetSchemasContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context canceled error, got %v", err)
+	}
+	if atomic.LoadInt32(&calls) != 0 {
+		t.Fatal("no requests expected with cancelled context")
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		_, err := c.GetSchemasContext(ctx)
+		errs <- err
+	}()
+	<-started
+	cancel()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context canceled error, got %v", err)
+	}
+	select {
+	case <-refreshCancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("token refresh request was not cancelled")
+	}
+}
+
+func TestGetSchemasAuthError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"status":401,"name":"Unauthorized","message":"invalid refresh token","andtErrorCode":1001}`))
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	accessKey := "key"
+	c, err := NewAnodot30Client(*u, &accessKey, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.GetSchemas()
+	var authErr *apierror.AuthError
+	if !errors.As(err, &authErr) {
+		t.Fatalf("expected *apierror.AuthError, got %v", err)
+	}
+	if authErr.Code != 1001 || authErr.Path != "/api/v2/access-token" {
+		t.Fatalf("unexpected error fields: %+v", authErr.APIError)
+	}
+}
+
+func TestGetSchemasReauthError(t *testing.T) {
+	var refreshes int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v2/access-token" {
+			if atomic.AddInt32(&refreshes, 1) > 1 {
+				w.WriteHeader(http.StatusForbidden)
+				_, _ = w.Write([]byte(`{"status":403,"name":"Forbidden","message":"access key revoked","andtErrorCode":1002}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"token":"bearer"}`))
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"status":401,"name":"Unauthorized","message":"token expired","andtErrorCode":1005}`))
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	accessKey := "key"
+	c, err := NewAnodot30Client(*u, &accessKey, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.GetSchemas()
+	var reauthErr *apierror.ReauthError
+	if !errors.As(err, &reauthErr) {
+		t.Fatalf("expected *apierror.ReauthError, got %v", err)
+	}
+
+	// rejected request and the failed refresh are both inspectable
+	var authErr *apierror.AuthError
+	if !errors.As(err, &authErr) || authErr.Code != 1005 || !errors.Is(err, apierror.ErrUnauthorized) {
+		t.Fatalf("expected error to unwrap to 401 of the request, got %+v", authErr)
+	}
+	if !errors.As(reauthErr.RefreshErr, &authErr) || authErr.Code != 1002 {
+		t.Fatalf("expected refresh error, got %v", reauthErr.RefreshErr)
+	}
+}
+
+func TestCreateSchemaNotRetried(t *testing.T) {
+	var creates int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v2/access-token" {
+			_, _ = w.Write([]byte(`{"token":"bearer"}`))
+			return
+		}
+		atomic.AddInt32(&creates, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	accessKey := "key"
+	c, err := NewAnodot30Client(*u, &accessKey, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.RetryPolicy = &retry.Policy{MaxAttempts: 3}
+
+	if _, err := c.CreateSchema(AnodotMetricsSchema{Name: "s"}); err == nil {
+		t.Fatal("expected error")
+	}
+	if n := atomic.LoadInt32(&creates); n != 1 {
+		t.Fatalf("expected schema creation not to be retried, got %d attempts", n)
+	}
+
+	c.RetryPolicy.RetryCreates = true
+	if _, err := c.CreateSchema(AnodotMetricsSchema{Name: "s"}); err == nil {
+		t.Fatal("expected error")
+	}
+	if n := atomic.LoadInt32(&creates); n != 4 {
+		t.Fatalf("expected schema creation to be retried with opt-in, got %d attempts", n-1)
+	}
+}
+
+// closeTracker is http.RoundTripper counting response bodies which were not closed.
+type closeTracker struct {
+	open int32
+}
+
+type trackedBody struct {
+	io.Reader
+	t *closeTracker
+}
+
+func (b *trackedBody) Close() error {
+	atomic.AddInt32(&b.t.open, -1)
+	return nil
+}
+
+func (t *closeTracker) RoundTrip(r *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&t.open, 1)
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: r,
+		Body: &trackedBody{Reader: strings.NewReader(`{"errors":[]}`), t: t}}, nil
+}
+
+func TestResponseBodiesClosed(t *testing.T) {
+	tracker := &closeTracker{}
+	u, _ := url.Parse("http://anodot")
+	token := "token"
+	c, err := NewAnodot30Client(*u, nil, &token, &http.Client{Transport: tracker})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Chunking.MaxRecords = 1
+
+	ts := AnodotTimestamp{time.Now()}
+	metrics := []AnodotMetrics30{
+		{SchemaId: "s1", Timestamp: ts, Measurements: map[string]float64{"value": 1}},
+		{SchemaId: "s1", Timestamp: ts, Measurements: map[string]float64{"value": 2}},
+	}
+	if _, err := c.SubmitMetrics(metrics); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.SubmitWatermark("s1", ts); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := atomic.LoadInt32(&tracker.open); n != 0 {
+		t.Fatalf("%d response bodies were not closed", n)
+	}
+}
@@ -0,0 +1,84 @@
+package metrics3
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Compatibility of a new schema definition with the existing one.
+type Compatibility struct {
+	// Changes which keep metrics sent with existing definition valid: new measurements,
+	// new dimensions which are filled when missing, changed units.
+	Additive []SchemaDifference
+	// Changes which make metrics sent with existing definition invalid or change their meaning.
+	Breaking []SchemaDifference
+}
+
+func (c Compatibility) IsBreaking() bool {
+	return len(c.Breaking) > 0
+}
+
+// CheckCompatibility tells whether desired schema definition could replace the existing one without breaking it.
+func CheckCompatibility(existing, desired AnodotMetricsSchema) Compatibility {
+	var c Compatibility
+
+	filled := existing.MissingDimPolicy != nil && existing.MissingDimPolicy.Action == MissingDimFill
+	fillsMissing := desired.MissingDimPolicy != nil && desired.MissingDimPolicy.Action == MissingDimFill
+
+	for _, d := range DiffSchemas(existing, desired) {
+		additive := false
+		switch {
+		case strings.HasPrefix(d.Field, "dimensions."):
+			// new dimension is optional only if records without it are still accepted
+			additive = d.Existing == "" && fillsMissing
+		case strings.HasPrefix(d.Field, "measurements."):
+			added := d.Existing == "" && d.Field == "measurements."+d.Desired
+			removed := d.Desired == "" && d.Field == "measurements."+d.Existing
+			additive = added || (!removed && strings.HasSuffix(d.Field, ".units"))
+		case d.Field == "missingDimPolicy.action":
+			additive = d.Desired == MissingDimFill
+		case d.Field == "missingDimPolicy.fill":
+			// fill value changes meaning of already filled records only
+			additive = !filled
+		}
+
+		if additive {
+			c.Additive = append(c.Additive, d)
+		} else {
+			c.Breaking = append(c.Breaking, d)
+		}
+	}
+
+	return c
+}
+
+// NextVersion returns schema version following v: last numeric dot-separated part is
+// incremented, "1" is returned for empty version and ".1" is appended to non-numeric one.
+func NextVersion(v string) string {
+	if v == "" {
+		return "1"
+	}
+
+	parts := strings.Split(v, ".")
+	n, err := strconv.Atoi(parts[len(parts)-1])
+	if err != nil {
+		return v + ".1"
+	}
+	parts[len(parts)-1] = strconv.Itoa(n + 1)
+	return strings.Join(parts, ".")
+}
+
+// BreakingChangeError is returned when schema update is refused because it is not backward compatible.
+type BreakingChangeError struct {
+	Schema  string
+	Changes []SchemaDifference
+}
+
+func (e *BreakingChangeError) Error() string {
+	changes := make([]string, len(e.Changes))
+	for i, c := range e.Changes {
+		changes[i] = c.String()
+	}
+	return fmt.Sprintf("breaking changes in schema %q: %s", e.Schema, strings.Join(changes, "; "))
+}
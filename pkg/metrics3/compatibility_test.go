@@ -0,0 +1,76 @@
+package metrics3
+
+import (
+	"testing"
+)
+
+func TestCheckCompatibility(t *testing.T) {
+	existing := AnodotMetricsSchema{
+		Name:       "requests",
+		Dimensions: []string{"host"},
+		Measurements: map[string]MeasurmentBase{
+			"count":   {Aggregation: "sum", CountBy: "none"},
+			"latency": {Aggregation: "average", CountBy: "none", Units: "ms"},
+		},
+	}
+
+	testData := []struct {
+		description string
+		change      func(s *AnodotMetricsSchema)
+		additive    int
+		breaking    int
+	}{
+		{"same", func(s *AnodotMetricsSchema) {}, 0, 0},
+		{"new measurement", func(s *AnodotMetricsSchema) {
+			s.Measurements["errors"] = MeasurmentBase{Aggregation: "sum", CountBy: "none"}
+		}, 1, 0},
+		{"changed units", func(s *AnodotMetricsSchema) {
+			s.Measurements["latency"] = MeasurmentBase{Aggregation: "average", CountBy: "none", Units: "s"}
+		}, 1, 0},
+		{"new filled dimension", func(s *AnodotMetricsSchema) {
+			s.Dimensions = append(s.Dimensions, "region")
+			s.MissingDimPolicy = &DimensionPolicy{Action: MissingDimFill, Fill: "NONE"}
+		}, 3, 0},
+		{"new required dimension", func(s *AnodotMetricsSchema) {
+			s.Dimensions = append(s.Dimensions, "region")
+		}, 0, 1},
+		{"removed measurement", func(s *AnodotMetricsSchema) {
+			delete(s.Measurements, "count")
+		}, 0, 1},
+		{"changed aggregation", func(s *AnodotMetricsSchema) {
+			s.Measurements["count"] = MeasurmentBase{Aggregation: "average", CountBy: "none"}
+		}, 0, 1},
+		{"removed dimension", func(s *AnodotMetricsSchema) {
+			s.Dimensions = nil
+		}, 0, 1},
+	}
+
+	for _, v := range testData {
+		t.Run(v.description, func(t *testing.T) {
+			desired := existing
+			desired.Dimensions = append([]string(nil), existing.Dimensions...)
+			desired.Measurements = make(map[string]MeasurmentBase)
+			for k, m := range existing.Measurements {
+				desired.Measurements[k] = m
+			}
+			v.change(&desired)
+
+			c := CheckCompatibility(existing, desired)
+			if len(c.Additive) != v.additive || len(c.Breaking) != v.breaking {
+				t.Fatalf("expected %d additive and %d breaking changes, got %v and %v", v.additive, v.breaking, c.Additive, c.Breaking)
+			}
+			if c.IsBreaking() != (v.breaking > 0) {
+				t.Fatal("unexpected IsBreaking result")
+			}
+		})
+	}
+}
+
+func TestNextVersion(t *testing.T) {
+	testData := map[string]string{"": "1", "1": "2", "1.9": "1.10", "v1": "v1.1", "2.0.0": "2.0.1"}
+	for in, out := range testData {
+		if got := NextVersion(in); got != out {
+			t.Fatalf("NextVersion(%q): expected %q, got %q", in, out, got)
+		}
+	}
+}
@@ -3,9 +3,12 @@ package metrics3
 import (
 	"encoding/json"
 	"fmt"
+	"math"
 	"net/http"
 	"strings"
 	"time"
+
+	"github.com/anodot/anodot-common/pkg/apierror"
 )
 
 type AnodotTimestamp struct {
@@ -16,6 +19,21 @@ func (t AnodotTimestamp) MarshalJSON() ([]byte, error) {
 	return []byte(fmt.Sprint(t.Unix())), nil
 }
 
+// UnmarshalJSON accepts unix seconds, as written by MarshalJSON, or RFC 3339 string.
+func (t *AnodotTimestamp) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+
+	var seconds float64
+	if err := json.Unmarshal(data, &seconds); err == nil {
+		sec, frac := math.Modf(seconds)
+		t.Time = time.Unix(int64(sec), int64(frac*1e9))
+		return nil
+	}
+	return t.Time.UnmarshalJSON(data)
+}
+
 type AnodotMetrics30 struct {
 	SchemaId     string              `json:"schemaId"`
 	Timestamp    AnodotTimestamp     `json:"timestamp"`
@@ -81,6 +99,18 @@ func (r *Anodot20Response) RawResponse() *http.Response {
 	return r.HttpResponse
 }
 
+func (r *Anodot20Response) validationError() error {
+	return apierror.NewValidationError(r.HttpResponse, r.failures())
+}
+
+func (r *Anodot20Response) failures() []apierror.Failure {
+	failures := make([]apierror.Failure, 0, len(r.Errors))
+	for _, e := range r.Errors {
+		failures = append(failures, apierror.Failure{Index: apierror.ParseIndex(e.Index), Code: e.Error, Description: e.Description})
+	}
+	return failures
+}
+
 type SubmitMetricsResponse struct {
 	Anodot20Response
 }
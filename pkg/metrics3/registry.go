@@ -0,0 +1,333 @@
+package metrics3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/anodot/anodot-common/pkg/apierror"
+	"github.com/anodot/anodot-common/pkg/chunk"
+)
+
+// SchemaDifference describes a field which differs between existing and desired schema.
+type SchemaDifference struct {
+	// Path of the field, e.g. "dimensions.host" or "measurements.count.aggregation".
+	Field    string
+	Existing string
+	Desired  string
+}
+
+func (d SchemaDifference) String() string {
+	return fmt.Sprintf("%s: existing %q, desired %q", d.Field, d.Existing, d.Desired)
+}
+
+// DiffSchemas compares schema definitions, ignoring id and order of dimensions.
+func DiffSchemas(existing, desired AnodotMetricsSchema) []SchemaDifference {
+	var diff []SchemaDifference
+
+	dims := make(map[string]int)
+	for _, d := range existing.Dimensions {
+		dims[d] |= 1
+	}
+	for _, d := range desired.Dimensions {
+		dims[d] |= 2
+	}
+	for _, d := range sortedNames(dims) {
+		switch dims[d] {
+		case 1:
+			diff = append(diff, SchemaDifference{Field: "dimensions." + d, Existing: d})
+		case 2:
+			diff = append(diff, SchemaDifference{Field: "dimensions." + d, Desired: d})
+		}
+	}
+
+	measurements := make(map[string]int)
+	for name := range existing.Measurements {
+		measurements[name] |= 1
+	}
+	for name := range desired.Measurements {
+		measurements[name] |= 2
+	}
+	for _, name := range sortedNames(measurements) {
+		e, d := existing.Measurements[name], desired.Measurements[name]
+		switch measurements[name] {
+		case 1:
+			diff = append(diff, SchemaDifference{Field: "measurements." + name, Existing: name})
+		case 2:
+			diff = append(diff, SchemaDifference{Field: "measurements." + name, Desired: name})
+		default:
+			field := "measurements." + name + "."
+			if e.Aggregation != d.Aggregation {
+				diff = append(diff, SchemaDifference{Field: field + "aggregation", Existing: e.Aggregation, Desired: d.Aggregation})
+			}
+			if e.CountBy != d.CountBy {
+				diff = append(diff, SchemaDifference{Field: field + "countBy", Existing: e.CountBy, Desired: d.CountBy})
+			}
+			if e.Units != d.Units {
+				diff = append(diff, SchemaDifference{Field: field + "units", Existing: e.Units, Desired: d.Units})
+			}
+		}
+	}
+
+	var ep, dp DimensionPolicy
+	if existing.MissingDimPolicy != nil {
+		ep = *existing.MissingDimPolicy
+	}
+	if desired.MissingDimPolicy != nil {
+		dp = *desired.MissingDimPolicy
+	}
+	if ep.Action != dp.Action {
+		diff = append(diff, SchemaDifference{Field: "missingDimPolicy.action", Existing: ep.Action, Desired: dp.Action})
+	}
+	if ep.Fill != dp.Fill {
+		diff = append(diff, SchemaDifference{Field: "missingDimPolicy.fill", Existing: ep.Fill, Desired: dp.Fill})
+	}
+
+	return diff
+}
+
+func sortedNames(m map[string]int) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type EnsureSchemaResult struct {
+	// Schema registered in Anodot.
+	Schema AnodotMetricsSchema
+	// True if the schema was created by this call.
+	Created bool
+	// True if existing schema was updated by this call.
+	Updated bool
+	// Differences between existing schema and the desired one. Existing schema is not modified.
+	Differences []SchemaDifference
+}
+
+// SchemaRegistry keeps schemas of the account cached by name and id. Cache is
+// reloaded from GetSchemas only when lookup misses. Schemas of metrics and watermarks
+// rejected by the client as not found or invalid are dropped from the cache, so the next
+// lookup reloads them. It is safe for concurrent use.
+type SchemaRegistry struct {
+	client *Anodot30Client
+
+	mu     sync.RWMutex
+	byName map[string]AnodotMetricsSchema
+	byId   map[string]AnodotMetricsSchema
+
+	ensureMu sync.Mutex
+}
+
+func NewSchemaRegistry(client *Anodot30Client) *SchemaRegistry {
+	return &SchemaRegistry{
+		client: client,
+		byName: make(map[string]AnodotMetricsSchema),
+		byId:   make(map[string]AnodotMetricsSchema),
+	}
+}
+
+// Refresh reloads all schemas of the account.
+func (r *SchemaRegistry) Refresh(ctx context.Context) error {
+	resp, err := r.client.GetSchemasContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	byName := make(map[string]AnodotMetricsSchema, len(resp.Schemas))
+	byId := make(map[string]AnodotMetricsSchema, len(resp.Schemas))
+	for _, s := range resp.Schemas {
+		byName[s.Name] = s
+		byId[s.Id] = s
+	}
+
+	r.mu.Lock()
+	r.byName, r.byId = byName, byId
+	r.mu.Unlock()
+
+	return nil
+}
+
+// ByName returns schema with the given name. The second value is false if there is no such schema.
+func (r *SchemaRegistry) ByName(ctx context.Context, name string) (AnodotMetricsSchema, bool, error) {
+	return r.lookup(ctx, func() (AnodotMetricsSchema, bool) {
+		s, ok := r.byName[name]
+		return s, ok
+	})
+}
+
+// ById returns schema with the given id. The second value is false if there is no such schema.
+func (r *SchemaRegistry) ById(ctx context.Context, id string) (AnodotMetricsSchema, bool, error) {
+	return r.lookup(ctx, func() (AnodotMetricsSchema, bool) {
+		s, ok := r.byId[id]
+		return s, ok
+	})
+}
+
+func (r *SchemaRegistry) lookup(ctx context.Context, get func() (AnodotMetricsSchema, bool)) (AnodotMetricsSchema, bool, error) {
+	r.mu.RLock()
+	s, ok := get()
+	r.mu.RUnlock()
+	if ok {
+		return s, true, nil
+	}
+
+	if err := r.Refresh(ctx); err != nil {
+		return AnodotMetricsSchema{}, false, err
+	}
+
+	r.mu.RLock()
+	s, ok = get()
+	r.mu.RUnlock()
+	return s, ok, nil
+}
+
+func (r *SchemaRegistry) add(s AnodotMetricsSchema) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.byName[s.Name] = s
+	r.byId[s.Id] = s
+}
+
+func (r *SchemaRegistry) remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s, ok := r.byId[id]; ok {
+		delete(r.byName, s.Name)
+		delete(r.byId, id)
+	}
+}
+
+// invalidate drops cached schemas of submitted records which failed with err, if the schema could
+// be deleted or changed: not found or validation error. schemaIds[i] is schema id of record i.
+func (r *SchemaRegistry) invalidate(schemaIds []string, err error) {
+	var chunkErr *chunk.Error
+	if errors.As(err, &chunkErr) {
+		for i, ch := range chunkErr.Failed {
+			if ch.End <= len(schemaIds) {
+				r.invalidate(schemaIds[ch.Start:ch.End], chunkErr.Errs[i])
+			}
+		}
+		return
+	}
+
+	var valErr *apierror.ValidationError
+	var apiErr *apierror.APIError
+	switch {
+	case errors.As(err, &valErr) && len(valErr.Failures) > 0:
+		for _, f := range valErr.Failures {
+			if f.Index < 0 || f.Index >= len(schemaIds) {
+				r.removeAll(schemaIds)
+				return
+			}
+			r.remove(schemaIds[f.Index])
+		}
+	case valErr != nil || (errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound):
+		r.removeAll(schemaIds)
+	}
+}
+
+func (r *SchemaRegistry) removeAll(ids []string) {
+	for _, id := range ids {
+		r.remove(id)
+	}
+}
+
+// EnsureSchema returns schema with the name of desired one, creating it if it does not exist.
+// If another process creates the schema concurrently, the existing schema is returned.
+func (r *SchemaRegistry) EnsureSchema(ctx context.Context, desired AnodotMetricsSchema) (*EnsureSchemaResult, error) {
+	if strings.TrimSpace(desired.Name) == "" {
+		return nil, errors.New("schema name should not be empty")
+	}
+
+	r.ensureMu.Lock()
+	defer r.ensureMu.Unlock()
+
+	existing, ok, err := r.ByName(ctx, desired.Name)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return &EnsureSchemaResult{Schema: existing, Differences: DiffSchemas(existing, desired)}, nil
+	}
+
+	resp, createErr := r.client.CreateSchemaContext(ctx, desired)
+	if createErr == nil {
+		created := desired
+		created.Id = *resp.SchemaId
+		r.add(created)
+		return &EnsureSchemaResult{Schema: created, Created: true}, nil
+	}
+
+	// schema could be created by another replica in the meantime
+	var apiErr *apierror.APIError
+	if !errors.As(createErr, &apiErr) || apiErr.Temporary() {
+		return nil, createErr
+	}
+
+	existing, ok, err = r.ByName(ctx, desired.Name)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, createErr
+	}
+	return &EnsureSchemaResult{Schema: existing, Differences: DiffSchemas(existing, desired)}, nil
+}
+
+// Evolve creates schema or updates existing schema with the same name to the desired
+// definition, bumping its version with NextVersion. Update is refused with *BreakingChangeError
+// if the change is not backward compatible, see CheckCompatibility.
+func (r *SchemaRegistry) Evolve(ctx context.Context, desired AnodotMetricsSchema) (*EnsureSchemaResult, error) {
+	res, err := r.EnsureSchema(ctx, desired)
+	if err != nil || res.Created || len(res.Differences) == 0 {
+		return res, err
+	}
+
+	r.ensureMu.Lock()
+	defer r.ensureMu.Unlock()
+
+	// always compare with the current definition, not the cached one
+	current, err := r.client.GetSchemaContext(ctx, res.Schema.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	compatibility := CheckCompatibility(*current.Schema, desired)
+	if compatibility.IsBreaking() {
+		return nil, &BreakingChangeError{Schema: desired.Name, Changes: compatibility.Breaking}
+	}
+
+	update := desired
+	update.Id = current.Schema.Id
+	update.Version = NextVersion(current.Schema.Version)
+
+	updated, err := r.client.UpdateSchemaContext(ctx, update)
+	if err != nil {
+		return nil, err
+	}
+
+	return &EnsureSchemaResult{Schema: *updated.Schema, Updated: true, Differences: DiffSchemas(*current.Schema, desired)}, nil
+}
+
+// Schemas returns schema registry of the client.
+func (c *Anodot30Client) Schemas() *SchemaRegistry {
+	c.registryOnce.Do(func() {
+		c.registry = NewSchemaRegistry(c)
+	})
+	return c.registry
+}
+
+// EnsureSchema creates schema if schema with the same name does not exist. See SchemaRegistry.EnsureSchema.
+func (c *Anodot30Client) EnsureSchema(schema AnodotMetricsSchema) (*EnsureSchemaResult, error) {
+	return c.EnsureSchemaContext(context.Background(), schema)
+}
+
+func (c *Anodot30Client) EnsureSchemaContext(ctx context.Context, schema AnodotMetricsSchema) (*EnsureSchemaResult, error) {
+	return c.Schemas().EnsureSchema(ctx, schema)
+}
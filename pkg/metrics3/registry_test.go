@@ -0,0 +1,193 @@
+package metrics3_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anodot/anodot-common/pkg/anodottest"
+	"github.com/anodot/anodot-common/pkg/apierror"
+	"github.com/anodot/anodot-common/pkg/metrics3"
+)
+
+var registrySchema = metrics3.AnodotMetricsSchema{
+	Name:       "requests",
+	Dimensions: []string{"host", "region"},
+	Measurements: map[string]metrics3.MeasurmentBase{
+		"count": {Aggregation: "sum", CountBy: "none"},
+	},
+}
+
+func newTestClient(t *testing.T, srv *anodottest.Server) *metrics3.Anodot30Client {
+	accessKey, dataToken := anodottest.AccessKey, anodottest.DataToken
+	c, err := metrics3.NewAnodot30Client(*srv.URL(), &accessKey, &dataToken, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestEnsureSchema(t *testing.T) {
+	srv := anodottest.NewServer()
+	defer srv.Close()
+
+	c := newTestClient(t, srv)
+
+	res, err := c.EnsureSchema(registrySchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Created || res.Schema.Id == "" {
+		t.Fatalf("expected schema to be created, got %+v", res)
+	}
+
+	changed := registrySchema
+	changed.Dimensions = []string{"region", "os"}
+	res2, err := c.EnsureSchema(changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res2.Created || res2.Schema.Id != res.Schema.Id {
+		t.Fatalf("expected existing schema, got %+v", res2)
+	}
+
+	expected := []metrics3.SchemaDifference{
+		{Field: "dimensions.host", Existing: "host"},
+		{Field: "dimensions.os", Desired: "os"},
+	}
+	if len(res2.Differences) != len(expected) || res2.Differences[0] != expected[0] || res2.Differences[1] != expected[1] {
+		t.Fatalf("expected differences %v, got %v", expected, res2.Differences)
+	}
+
+	if n := srv.Requests("/api/v2/stream-schemas/schemas"); n != 1 {
+		t.Fatalf("expected single schema list request, got %d", n)
+	}
+
+	s, ok, err := c.Schemas().ById(context.Background(), res.Schema.Id)
+	if err != nil || !ok || s.Name != registrySchema.Name {
+		t.Fatalf("expected cached schema, got %+v %v %v", s, ok, err)
+	}
+
+	if _, err := c.DeleteSchema(res.Schema.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := c.Schemas().ByName(context.Background(), registrySchema.Name); ok {
+		t.Fatal("deleted schema should be removed from registry")
+	}
+}
+
+func TestEnsureSchemaConcurrentReplicas(t *testing.T) {
+	srv := anodottest.NewServer()
+	defer srv.Close()
+
+	const replicas = 5
+	ids := make([]string, replicas)
+	errs := make([]error, replicas)
+
+	var wg sync.WaitGroup
+	for i := 0; i < replicas; i++ {
+		c := newTestClient(t, srv)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res, err := c.EnsureSchema(registrySchema)
+			errs[i] = err
+			if err == nil {
+				ids[i] = res.Schema.Id
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range ids {
+		if errs[i] != nil {
+			t.Fatalf("replica %d: %v", i, errs[i])
+		}
+		if ids[i] != ids[0] {
+			t.Fatalf("replicas got different schemas: %v", ids)
+		}
+	}
+	if n := len(srv.Schemas()); n != 1 {
+		t.Fatalf("expected single schema, got %d", n)
+	}
+}
+
+func TestEvolveSchema(t *testing.T) {
+	srv := anodottest.NewServer()
+	defer srv.Close()
+
+	c := newTestClient(t, srv)
+	ctx := context.Background()
+
+	res, err := c.Schemas().Evolve(ctx, registrySchema)
+	if err != nil || !res.Created {
+		t.Fatalf("expected schema to be created, got %+v, %v", res, err)
+	}
+
+	additive := registrySchema
+	additive.Measurements = map[string]metrics3.MeasurmentBase{
+		"count":   {Aggregation: "sum", CountBy: "none"},
+		"latency": {Aggregation: "average", CountBy: "none", Units: "ms"},
+	}
+	res, err = c.Schemas().Evolve(ctx, additive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Updated || res.Schema.Version != "1" {
+		t.Fatalf("expected schema update to version 1, got %+v", res)
+	}
+
+	got, err := c.GetSchema(res.Schema.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := got.Schema.Measurements["latency"]; !ok || got.Schema.Version != "1" {
+		t.Fatalf("schema was not updated: %+v", got.Schema)
+	}
+
+	breaking := additive
+	breaking.Dimensions = []string{"host"}
+	_, err = c.Schemas().Evolve(ctx, breaking)
+	breakingErr, ok := err.(*metrics3.BreakingChangeError)
+	if !ok || len(breakingErr.Changes) != 1 || breakingErr.Changes[0].Field != "dimensions.region" {
+		t.Fatalf("expected breaking change error, got %v", err)
+	}
+}
+
+func TestRegistryInvalidatesRejectedSchema(t *testing.T) {
+	srv := anodottest.NewServer()
+	defer srv.Close()
+
+	c := newTestClient(t, srv)
+	res, err := c.EnsureSchema(registrySchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// schema deleted by another process stays cached until submit is rejected
+	if _, err := newTestClient(t, srv).DeleteSchema(res.Schema.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := c.Schemas().ById(context.Background(), res.Schema.Id); !ok {
+		t.Fatal("expected schema to be cached")
+	}
+
+	_, err = c.SubmitMetrics([]metrics3.AnodotMetrics30{{
+		SchemaId:     res.Schema.Id,
+		Timestamp:    metrics3.AnodotTimestamp{Time: time.Now()},
+		Dimensions:   map[string]string{"host": "a", "region": "eu"},
+		Measurements: map[string]float64{"count": 1},
+	}})
+	if !errors.Is(err, apierror.ErrValidation) {
+		t.Fatalf("expected validation error, got %v", err)
+	}
+
+	if _, ok, err := c.Schemas().ById(context.Background(), res.Schema.Id); ok || err != nil {
+		t.Fatalf("expected rejected schema to be reloaded, got %v %v", ok, err)
+	}
+	if n := srv.Requests("/api/v2/stream-schemas/schemas"); n != 2 {
+		t.Fatalf("expected schema list to be reloaded once, got %d requests", n)
+	}
+}
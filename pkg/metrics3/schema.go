@@ -47,3 +47,13 @@ type CreateSchemaResponse struct {
 	SchemaId *string
 	Api30Response
 }
+
+type GetSchemaByIdResponse struct {
+	Schema *AnodotMetricsSchema
+	Api30Response
+}
+
+type UpdateSchemaResponse struct {
+	Schema *AnodotMetricsSchema
+	Api30Response
+}
@@ -0,0 +1,146 @@
+package metrics3
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Lifetime assumed for bearer tokens which do not carry their expiry.
+const defaultBearerLifetime = 24 * time.Hour
+
+// DefaultTokenRefreshMargin is how long before expiry bearer token is refreshed, unless set by the client.
+const DefaultTokenRefreshMargin = 5 * time.Minute
+
+// bearerToken is cached bearer token.
+type bearerToken struct {
+	token   string
+	issued  time.Time
+	expires time.Time
+	// access key the token was obtained with
+	key string
+}
+
+// tokenRefresh is a refresh in progress, shared by all callers which need a token meanwhile.
+type tokenRefresh struct {
+	done  chan struct{}
+	token bearerToken
+	err   error
+	// callers waiting for the refresh, it is cancelled once all of them are gone
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// tokenManager caches bearer token and collapses concurrent refreshes into one.
+type tokenManager struct {
+	mu      sync.Mutex
+	current *bearerToken
+	pending *tokenRefresh
+}
+
+// get returns cached token obtained with access key, unless it expires within margin. Otherwise
+// it waits for refresh, starting one if there is none in progress. Refresh is cancelled once
+// ctx of every caller waiting for it is done.
+func (m *tokenManager) get(ctx context.Context, margin time.Duration, key string, refresh func(ctx context.Context, key string) (bearerToken, error)) (string, error) {
+	for {
+		m.mu.Lock()
+		if t := m.current; t != nil && t.key == key && time.Now().Before(refreshTime(*t, margin)) {
+			m.mu.Unlock()
+			return t.token, nil
+		}
+		if err := ctx.Err(); err != nil {
+			m.mu.Unlock()
+			return "", err
+		}
+
+		p := m.pending
+		if p == nil {
+			refreshCtx, cancel := context.WithCancel(context.Background())
+			p = &tokenRefresh{done: make(chan struct{}), cancel: cancel}
+			m.pending = p
+			go func() {
+				defer cancel()
+				token, err := refresh(refreshCtx, key)
+				token.key = key
+
+				m.mu.Lock()
+				p.token, p.err = token, err
+				if err == nil {
+					m.current = &p.token
+				}
+				if m.pending == p {
+					m.pending = nil
+				}
+				m.mu.Unlock()
+				close(p.done)
+			}()
+		}
+		p.waiters++
+		m.mu.Unlock()
+
+		select {
+		case <-p.done:
+			if p.err != nil {
+				return "", p.err
+			}
+			if p.token.key == key {
+				return p.token.token, nil
+			}
+			// refresh was made with access key which has been rotated since
+		case <-ctx.Done():
+			m.mu.Lock()
+			p.waiters--
+			if p.waiters == 0 {
+				// nobody needs the token anymore, later callers start a new refresh
+				p.cancel()
+				if m.pending == p {
+					m.pending = nil
+				}
+			}
+			m.mu.Unlock()
+			return "", ctx.Err()
+		}
+	}
+}
+
+// invalidate drops token rejected by the server, unless it was already replaced.
+func (m *tokenManager) invalidate(token string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.current != nil && m.current.token == token {
+		m.current = nil
+	}
+}
+
+// refreshTime returns when token should be refreshed. Margin is capped at half of the
+// token lifetime, so short lived tokens are still used.
+func refreshTime(t bearerToken, margin time.Duration) time.Time {
+	if lifetime := t.expires.Sub(t.issued); margin > lifetime/2 {
+		margin = lifetime / 2
+	}
+	return t.expires.Add(-margin)
+}
+
+// tokenExpiry reads exp claim of JWT token, ok is false if token is not JWT or has no expiry.
+func tokenExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	claims := struct {
+		Exp *float64 `json:"exp"`
+	}{}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(*claims.Exp), 0), true
+}
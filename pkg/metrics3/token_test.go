@@ -0,0 +1,194 @@
+package metrics3
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func jwt(claims string) string {
+	return "eyJhbGciOiJIUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".c2lnbmF0dXJl"
+}
+
+func TestTokenExpiry(t *testing.T) {
+	expires, ok := tokenExpiry(jwt(`{"sub": "user", "exp": 1600000000}`))
+	if !ok || expires.Unix() != 1600000000 {
+		t.Errorf("unexpected expiry %v, %v", expires, ok)
+	}
+
+	for _, token := range []string{"opaque-token", jwt(`{"sub": "user"}`), "a.!!!.c"} {
+		if _, ok := tokenExpiry(token); ok {
+			t.Errorf("expected no expiry for %q", token)
+		}
+	}
+}
+
+func TestTokenManagerSingleFlight(t *testing.T) {
+	var m tokenManager
+	var refreshes int32
+	refresh := func(ctx context.Context, key string) (bearerToken, error) {
+		n := atomic.AddInt32(&refreshes, 1)
+		time.Sleep(20 * time.Millisecond)
+		return bearerToken{token: fmt.Sprintf("token-%d", n), issued: time.Now(), expires: time.Now().Add(time.Hour)}, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if token, err := m.get(context.Background(), time.Minute, "key", refresh); err != nil || token != "token-1" {
+				t.Errorf("unexpected token %q, %v", token, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if refreshes != 1 {
+		t.Fatalf("expected 1 refresh, got %d", refreshes)
+	}
+
+	// stale token is not invalidated
+	m.invalidate("token-0")
+	if token, _ := m.get(context.Background(), time.Minute, "key", refresh); token != "token-1" {
+		t.Fatalf("expected cached token, got %q", token)
+	}
+
+	m.invalidate("token-1")
+	if token, _ := m.get(context.Background(), time.Minute, "key", refresh); token != "token-2" {
+		t.Fatalf("expected refreshed token, got %q", token)
+	}
+}
+
+func TestTokenManagerMargin(t *testing.T) {
+	var m tokenManager
+	var refreshes int32
+	issued := time.Now()
+	refresh := func(ctx context.Context, key string) (bearerToken, error) {
+		atomic.AddInt32(&refreshes, 1)
+		return bearerToken{token: "token", issued: issued, expires: issued.Add(10 * time.Minute)}, nil
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := m.get(context.Background(), 2*time.Minute, "key", refresh); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if refreshes != 1 {
+		t.Fatalf("expected token to be reused, got %d refreshes", refreshes)
+	}
+
+	// token issued 9 minutes ago expires within margin and is refreshed
+	issued = time.Now().Add(-9 * time.Minute)
+	m.invalidate("token")
+	for i := 0; i < 2; i++ {
+		if _, err := m.get(context.Background(), 2*time.Minute, "key", refresh); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if refreshes != 3 {
+		t.Fatalf("expected token to be refreshed early, got %d refreshes", refreshes)
+	}
+
+	// margin is capped at half of the lifetime
+	issued = time.Now()
+	m.invalidate("token")
+	for i := 0; i < 2; i++ {
+		if _, err := m.get(context.Background(), time.Hour, "key", refresh); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if refreshes != 4 {
+		t.Fatalf("expected short lived token to be reused, got %d refreshes", refreshes)
+	}
+}
+
+func TestTokenManagerKeyRotation(t *testing.T) {
+	var m tokenManager
+	refresh := func(ctx context.Context, key string) (bearerToken, error) {
+		return bearerToken{token: "token-" + key, issued: time.Now(), expires: time.Now().Add(time.Hour)}, nil
+	}
+
+	for _, key := range []string{"a", "a", "b"} {
+		if token, err := m.get(context.Background(), time.Minute, key, refresh); err != nil || token != "token-"+key {
+			t.Fatalf("unexpected token %q, %v", token, err)
+		}
+	}
+}
+
+func TestTokenManagerContext(t *testing.T) {
+	var m tokenManager
+	started := make(chan struct{}, 2)
+	cancelled := make(chan struct{}, 2)
+	release := make(chan struct{})
+	refresh := func(ctx context.Context, key string) (bearerToken, error) {
+		started <- struct{}{}
+		select {
+		case <-ctx.Done():
+			cancelled <- struct{}{}
+			return bearerToken{}, ctx.Err()
+		case <-release:
+			return bearerToken{token: "token", issued: time.Now(), expires: time.Now().Add(time.Hour)}, nil
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := m.get(ctx, time.Minute, "key", refresh); err != context.Canceled {
+		t.Fatalf("expected canceled, got %v", err)
+	}
+	if len(started) != 0 {
+		t.Fatal("refresh started for cancelled caller")
+	}
+
+	// refresh is cancelled once its only caller is gone
+	ctx, cancel = context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		_, err := m.get(ctx, time.Minute, "key", refresh)
+		errs <- err
+	}()
+	<-started
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Fatalf("expected canceled, got %v", err)
+	}
+	<-cancelled
+
+	// refresh is kept while other callers wait for it
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_, err := m.get(ctx, time.Minute, "key", refresh)
+		errs <- err
+	}()
+	<-started
+	tokens := make(chan string, 1)
+	go func() {
+		token, _ := m.get(context.Background(), time.Minute, "key", refresh)
+		tokens <- token
+	}()
+	for {
+		m.mu.Lock()
+		waiters := m.pending.waiters
+		m.mu.Unlock()
+		if waiters == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Fatalf("expected canceled, got %v", err)
+	}
+	close(release)
+	if token := <-tokens; token != "token" {
+		t.Fatalf("unexpected token %q", token)
+	}
+	if len(cancelled) != 0 || len(started) != 0 {
+		t.Fatal("shared refresh was cancelled or repeated")
+	}
+}
@@ -0,0 +1,191 @@
+package metrics3
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Actions of schema MissingDimPolicy.
+const (
+	// Missing dimensions are set to DimensionPolicy.Fill value.
+	MissingDimFill = "fill"
+	// Records with missing dimensions are dropped.
+	MissingDimIgnore = "ignore"
+	// Records with missing dimensions are rejected. Used when schema has no MissingDimPolicy.
+	MissingDimFail = "fail"
+)
+
+// Value used for missing dimensions by MissingDimFill action when DimensionPolicy.Fill is empty.
+const DefaultDimensionFill = "NONE"
+
+// RecordProblem describes why a record did not pass validation.
+type RecordProblem struct {
+	// Position of the record in validated slice.
+	Index  int
+	Errors []string
+	// Dropped is true when the record was silently dropped according to MissingDimIgnore
+	// action, and false when it was rejected.
+	Dropped bool
+}
+
+func (p RecordProblem) String() string {
+	return fmt.Sprintf("record %d: %s", p.Index, strings.Join(p.Errors, "; "))
+}
+
+type ValidationResult struct {
+	// Records which passed validation, with missing dimensions filled according to schema policy.
+	Valid []AnodotMetrics30
+	// Position of every valid record in validated slice.
+	ValidIndexes []int
+	Problems     []RecordProblem
+}
+
+// Validator checks AnodotMetrics30 records against the schema before they are submitted.
+type Validator struct {
+	schema       AnodotMetricsSchema
+	dimensions   map[string]bool
+	policyAction string
+	fill         string
+}
+
+func NewValidator(schema AnodotMetricsSchema) (*Validator, error) {
+	if len(schema.Measurements) == 0 {
+		return nil, fmt.Errorf("schema %q has no measurements", schema.Name)
+	}
+
+	v := &Validator{schema: schema, dimensions: make(map[string]bool, len(schema.Dimensions)), policyAction: MissingDimFail}
+	for _, d := range schema.Dimensions {
+		v.dimensions[wireName(d)] = true
+	}
+
+	if p := schema.MissingDimPolicy; p != nil {
+		switch p.Action {
+		case MissingDimFill:
+			v.fill = p.Fill
+			if v.fill == "" {
+				v.fill = DefaultDimensionFill
+			}
+		case MissingDimIgnore, MissingDimFail:
+		default:
+			return nil, fmt.Errorf("unknown missing dimension policy action %q", p.Action)
+		}
+		v.policyAction = p.Action
+	}
+
+	return v, nil
+}
+
+// Validate checks every record and returns the ones which can be submitted.
+// Records are not modified; records with filled dimensions are returned as copies.
+func (v *Validator) Validate(metrics []AnodotMetrics30) ValidationResult {
+	result := ValidationResult{Valid: make([]AnodotMetrics30, 0, len(metrics)), ValidIndexes: make([]int, 0, len(metrics))}
+
+	for i, m := range metrics {
+		filled, errs, missing := v.check(m)
+
+		switch {
+		case len(errs) > 0:
+			result.Problems = append(result.Problems, RecordProblem{Index: i, Errors: errs})
+		case len(missing) > 0 && v.policyAction == MissingDimIgnore:
+			result.Problems = append(result.Problems, RecordProblem{Index: i, Errors: missingErrors(missing), Dropped: true})
+		default:
+			result.Valid = append(result.Valid, filled)
+			result.ValidIndexes = append(result.ValidIndexes, i)
+		}
+	}
+
+	return result
+}
+
+// check returns record with missing dimensions filled, if policy allows it, validation
+// errors and names of missing dimensions.
+func (v *Validator) check(m AnodotMetrics30) (AnodotMetrics30, []string, []string) {
+	var errs []string
+
+	if v.schema.Id != "" && m.SchemaId != v.schema.Id {
+		errs = append(errs, fmt.Sprintf("schema id %q does not match schema %q", m.SchemaId, v.schema.Id))
+	}
+	if m.Timestamp.IsZero() {
+		errs = append(errs, "timestamp is not set")
+	}
+
+	if len(m.Measurements) == 0 {
+		errs = append(errs, "no measurements")
+	}
+	// Names are compared the way they are sent, see AnodotMetrics30.MarshalJSON.
+	measurements := make(map[string]bool, len(v.schema.Measurements))
+	for name := range v.schema.Measurements {
+		measurements[wireName(name)] = true
+	}
+
+	var unknown []string
+	sent := make(map[string]bool, len(m.Measurements))
+	for name := range m.Measurements {
+		key := wireName(name)
+		if sent[key] {
+			unknown = append(unknown, fmt.Sprintf("duplicate measurement %q", key))
+		}
+		sent[key] = true
+		if !measurements[key] {
+			unknown = append(unknown, fmt.Sprintf("unknown measurement %q", name))
+		}
+	}
+	dimensions := make(map[string]string, len(m.Dimensions))
+	for name, val := range m.Dimensions {
+		key := wireName(name)
+		if _, ok := dimensions[key]; ok {
+			unknown = append(unknown, fmt.Sprintf("duplicate dimension %q", key))
+		}
+		dimensions[key] = val
+		if !v.dimensions[key] {
+			unknown = append(unknown, fmt.Sprintf("unknown dimension %q", name))
+		}
+	}
+	sort.Strings(unknown)
+	errs = append(errs, unknown...)
+
+	var missing []string
+	for _, d := range v.schema.Dimensions {
+		if strings.TrimSpace(dimensions[wireName(d)]) == "" {
+			missing = append(missing, d)
+		}
+	}
+
+	if len(missing) == 0 || v.policyAction == MissingDimIgnore {
+		return m, errs, missing
+	}
+	if v.policyAction == MissingDimFail {
+		return m, append(errs, missingErrors(missing)...), missing
+	}
+
+	filled := make(map[string]bool, len(missing))
+	for _, d := range missing {
+		filled[wireName(d)] = true
+	}
+	dims := make(map[string]string, len(v.schema.Dimensions))
+	for k, val := range m.Dimensions {
+		if !filled[wireName(k)] {
+			dims[k] = val
+		}
+	}
+	for _, d := range missing {
+		dims[d] = v.fill
+	}
+	m.Dimensions = dims
+
+	return m, errs, missing
+}
+
+// wireName returns dimension or measurement name as it is sent to Anodot.
+func wireName(name string) string {
+	return escape(strings.TrimSpace(name))
+}
+
+func missingErrors(missing []string) []string {
+	errs := make([]string, len(missing))
+	for i, d := range missing {
+		errs[i] = fmt.Sprintf("missing dimension %q", d)
+	}
+	return errs
+}
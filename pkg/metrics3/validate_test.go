@@ -0,0 +1,117 @@
+package metrics3
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestValidator(t *testing.T) {
+	schema := AnodotMetricsSchema{
+		Id:         "s1",
+		Name:       "requests",
+		Dimensions: []string{"host", "region"},
+		Measurements: map[string]MeasurmentBase{
+			"count": {Aggregation: "sum", CountBy: "none"},
+		},
+	}
+	ts := AnodotTimestamp{time.Now()}
+
+	records := []AnodotMetrics30{
+		{SchemaId: "s1", Timestamp: ts, Dimensions: map[string]string{"host": "a", "region": "eu"}, Measurements: map[string]float64{"count": 1}},
+		{SchemaId: "s1", Timestamp: ts, Dimensions: map[string]string{"host": "a"}, Measurements: map[string]float64{"count": 1}},
+		{SchemaId: "s2", Timestamp: ts, Dimensions: map[string]string{"host": "a", "region": "eu", "os": "linux"}, Measurements: map[string]float64{"latency": 1}},
+	}
+
+	testData := []struct {
+		description string
+		policy      *DimensionPolicy
+		valid       []int
+		problems    []RecordProblem
+		filled      map[string]string
+	}{
+		{
+			description: "no policy",
+			valid:       []int{0},
+			problems: []RecordProblem{
+				{Index: 1, Errors: []string{`missing dimension "region"`}},
+				{Index: 2, Errors: []string{`schema id "s2" does not match schema "s1"`, `unknown dimension "os"`, `unknown measurement "latency"`}},
+			},
+		},
+		{
+			description: "fill",
+			policy:      &DimensionPolicy{Action: MissingDimFill, Fill: "unknown"},
+			valid:       []int{0, 1},
+			problems: []RecordProblem{
+				{Index: 2, Errors: []string{`schema id "s2" does not match schema "s1"`, `unknown dimension "os"`, `unknown measurement "latency"`}},
+			},
+			filled: map[string]string{"host": "a", "region": "unknown"},
+		},
+		{
+			description: "ignore",
+			policy:      &DimensionPolicy{Action: MissingDimIgnore},
+			valid:       []int{0},
+			problems: []RecordProblem{
+				{Index: 1, Errors: []string{`missing dimension "region"`}, Dropped: true},
+				{Index: 2, Errors: []string{`schema id "s2" does not match schema "s1"`, `unknown dimension "os"`, `unknown measurement "latency"`}},
+			},
+		},
+	}
+
+	for _, v := range testData {
+		t.Run(v.description, func(t *testing.T) {
+			s := schema
+			s.MissingDimPolicy = v.policy
+
+			validator, err := NewValidator(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result := validator.Validate(records)
+			if !reflect.DeepEqual(result.ValidIndexes, v.valid) {
+				t.Fatalf("expected valid records %v, got %v", v.valid, result.ValidIndexes)
+			}
+			if !reflect.DeepEqual(result.Problems, v.problems) {
+				t.Fatalf("expected problems\n%+v\ngot\n%+v", v.problems, result.Problems)
+			}
+			if v.filled != nil && !reflect.DeepEqual(result.Valid[1].Dimensions, v.filled) {
+				t.Fatalf("expected filled dimensions %v, got %v", v.filled, result.Valid[1].Dimensions)
+			}
+			if len(records[1].Dimensions) != 1 {
+				t.Fatal("validated record should not be modified")
+			}
+		})
+	}
+}
+
+func TestValidatorEscapedNames(t *testing.T) {
+	schema := AnodotMetricsSchema{
+		Dimensions:       []string{"host_name", "region"},
+		Measurements:     map[string]MeasurmentBase{"req_count": {Aggregation: "sum", CountBy: "none"}},
+		MissingDimPolicy: &DimensionPolicy{Action: MissingDimFill, Fill: "unknown"},
+	}
+	ts := AnodotTimestamp{time.Now()}
+
+	validator, err := NewValidator(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := validator.Validate([]AnodotMetrics30{
+		{Timestamp: ts, Dimensions: map[string]string{"host.name": "a", " region": "eu"}, Measurements: map[string]float64{"req count": 1}},
+		{Timestamp: ts, Dimensions: map[string]string{"host.name": " ", "region": "eu"}, Measurements: map[string]float64{"req_count": 1}},
+		{Timestamp: ts, Dimensions: map[string]string{"host.name": "a", "host_name": "b", "region": "eu"}, Measurements: map[string]float64{"req_count": 1}},
+	})
+
+	if !reflect.DeepEqual(result.ValidIndexes, []int{0, 1}) {
+		t.Fatalf("expected escaped names to match schema, got valid %v, problems %+v", result.ValidIndexes, result.Problems)
+	}
+	if filled := map[string]string{"host_name": "unknown", "region": "eu"}; !reflect.DeepEqual(result.Valid[1].Dimensions, filled) {
+		t.Fatalf("expected filled dimensions %v, got %v", filled, result.Valid[1].Dimensions)
+	}
+	problems := []RecordProblem{{Index: 2, Errors: []string{`duplicate dimension "host_name"`}}}
+	if !reflect.DeepEqual(result.Problems, problems) {
+		t.Fatalf("expected problems\n%+v\ngot\n%+v", problems, result.Problems)
+	}
+}
@@ -0,0 +1,431 @@
+package metrics3
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/anodot/anodot-common/pkg/deadletter"
+	"github.com/anodot/anodot-common/pkg/diskqueue"
+)
+
+var (
+	ErrBufferFull   = errors.New("metrics writer buffer is full")
+	ErrWriterClosed = errors.New("metrics writer is closed")
+)
+
+// Submitter sends metrics and watermarks to Anodot. Implemented by Anodot30Client.
+type Submitter interface {
+	SubmitMetrics(metrics []AnodotMetrics30) (*SubmitMetricsResponse, error)
+	SubmitWatermark(schemaId string, watermark AnodotTimestamp) (*SubmitWatermarkResponse, error)
+}
+
+// Result of a single metrics batch or watermark submission made by MetricsWriter.
+// Watermark is set only for watermark submissions, Metrics only for metrics batches.
+type WriterResult struct {
+	SchemaId  string
+	Metrics   []AnodotMetrics30
+	Watermark *AnodotTimestamp
+	Response  AnodotResponse
+	Err       error
+	// Metrics of partly delivered batch which failed temporarily and were stored in WriterOptions.Queue.
+	// They are reported again once resent.
+	Queued []AnodotMetrics30
+	// Error of writing rejected and permanently failed metrics to WriterOptions.DeadLetter.
+	DeadLetterErr error
+}
+
+type WriterOptions struct {
+	// Maximum number of metrics sent in one request. Defaults to 1000.
+	MaxBatchSize int
+	// How often buffered metrics are sent and watermarks are checked. Defaults to 10 seconds.
+	FlushInterval time.Duration
+	// Maximum number of buffered metrics across all schemas. Defaults to 10 * MaxBatchSize.
+	BufferSize int
+	// Bucket interval of schemas not listed in Intervals. Defaults to 1 hour.
+	Interval time.Duration
+	// Bucket interval per schema id.
+	Intervals map[string]time.Duration
+	// Time to wait after the end of a bucket before its watermark is sent,
+	// so late metrics still make it into the bucket.
+	WatermarkDelay time.Duration
+	// Called from the background goroutine after every metrics batch and watermark submission.
+	OnResult func(WriterResult)
+	// Optional durable queue for batches which could not be delivered because of network
+	// failure or temporary API error. Queued batches are resent oldest first on every flush,
+	// also after process restart. Watermarks are not sent while the queue has batches,
+	// so buckets are not closed before their metrics arrive. The queue is not closed by MetricsWriter.
+	Queue *diskqueue.Queue
+	// Optional sink receiving metrics rejected by Anodot or failed permanently, e.g. because they
+	// could not be encoded, before OnResult is called.
+	DeadLetter deadletter.Sink
+}
+
+type schemaBucket struct {
+	metrics  []AnodotMetrics30
+	interval time.Duration
+	// Last watermark sent, or start of the bucket of the first metric written.
+	watermark time.Time
+}
+
+// MetricsWriter buffers metrics per schema, sends them in batches and submits a
+// watermark for every schema once its current bucket is closed.
+//
+// Bucket for a schema with interval I is closed WatermarkDelay after its end,
+// and the watermark sent is the end of the bucket, aligned to I. Watermarks of a schema
+// start from the bucket of the first metric written to it.
+type MetricsWriter struct {
+	submitter Submitter
+	opts      WriterOptions
+	now       func() time.Time
+
+	mu       sync.Mutex
+	schemas  map[string]*schemaBucket
+	buffered int
+	closed   bool
+
+	wakeup  chan struct{}
+	flushes chan chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// Constructs new MetricsWriter and starts its background goroutine. Close should be called to release it.
+func NewMetricsWriter(submitter Submitter, opts WriterOptions) (*MetricsWriter, error) {
+	return newMetricsWriter(submitter, opts, time.Now)
+}
+
+func newMetricsWriter(submitter Submitter, opts WriterOptions, now func() time.Time) (*MetricsWriter, error) {
+	if submitter == nil {
+		return nil, errors.New("submitter should not be nil")
+	}
+
+	if opts.MaxBatchSize <= 0 {
+		opts.MaxBatchSize = 1000
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = 10 * time.Second
+	}
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = 10 * opts.MaxBatchSize
+	}
+	if opts.BufferSize < opts.MaxBatchSize {
+		return nil, errors.New("buffer size should not be less than max batch size")
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = time.Hour
+	}
+	if opts.WatermarkDelay < 0 {
+		return nil, errors.New("watermark delay should not be negative")
+	}
+	for id, interval := range opts.Intervals {
+		if interval <= 0 {
+			return nil, errors.New("interval of schema " + id + " should be positive")
+		}
+	}
+
+	w := &MetricsWriter{
+		submitter: submitter,
+		opts:      opts,
+		now:       now,
+		schemas:   make(map[string]*schemaBucket),
+		wakeup:    make(chan struct{}, 1),
+		flushes:   make(chan chan struct{}),
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	go w.run()
+
+	return w, nil
+}
+
+// Write adds metrics to the buffers of their schemas and returns immediately.
+// Delivery results are reported through WriterOptions.OnResult.
+func (w *MetricsWriter) Write(metrics ...AnodotMetrics30) error {
+	for _, m := range metrics {
+		if m.SchemaId == "" {
+			return errors.New("metrics should have schema id")
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return ErrWriterClosed
+	}
+
+	if w.buffered+len(metrics) > w.opts.BufferSize {
+		return ErrBufferFull
+	}
+
+	full := false
+	for _, m := range metrics {
+		b := w.bucket(m.SchemaId)
+		if b.watermark.IsZero() {
+			// Watermarks start from the bucket of the first metric, earlier buckets have no data.
+			ts := m.Timestamp.Time
+			if ts.IsZero() {
+				ts = w.now()
+			}
+			b.watermark = ts.Truncate(b.interval)
+		}
+		b.metrics = append(b.metrics, m)
+		if len(b.metrics) >= w.opts.MaxBatchSize {
+			full = true
+		}
+	}
+	w.buffered += len(metrics)
+
+	if full {
+		select {
+		case w.wakeup <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// Flush sends all buffered metrics together with watermarks which are due, and
+// blocks until they are submitted.
+func (w *MetricsWriter) Flush() {
+	ack := make(chan struct{})
+	select {
+	case w.flushes <- ack:
+		<-ack
+	case <-w.stopped:
+	}
+}
+
+// Close stops accepting new metrics, sends everything left in the buffers
+// together with watermarks which are due, and waits for the background goroutine to finish.
+func (w *MetricsWriter) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return ErrWriterClosed
+	}
+	w.closed = true
+	w.mu.Unlock()
+
+	close(w.done)
+	<-w.stopped
+
+	return nil
+}
+
+// bucket returns schema state, creating it if needed. Must be called with w.mu held.
+func (w *MetricsWriter) bucket(schemaId string) *schemaBucket {
+	b, ok := w.schemas[schemaId]
+	if !ok {
+		interval, ok := w.opts.Intervals[schemaId]
+		if !ok {
+			interval = w.opts.Interval
+		}
+		b = &schemaBucket{interval: interval}
+		w.schemas[schemaId] = b
+	}
+	return b
+}
+
+func (w *MetricsWriter) run() {
+	defer close(w.stopped)
+
+	ticker := time.NewTicker(w.opts.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.wakeup:
+			w.send(false)
+		case <-ticker.C:
+			w.send(true)
+			w.sendWatermarks()
+		case ack := <-w.flushes:
+			w.send(true)
+			w.sendWatermarks()
+			close(ack)
+		case <-w.done:
+			w.send(true)
+			w.sendWatermarks()
+			return
+		}
+	}
+}
+
+// send submits buffered metrics of every schema in batches of MaxBatchSize.
+// Incomplete batches are sent only when all is true.
+func (w *MetricsWriter) send(all bool) {
+	w.replay()
+
+	for {
+		w.mu.Lock()
+		var schemaId string
+		var batch []AnodotMetrics30
+		for id, b := range w.schemas {
+			n := len(b.metrics)
+			if n == 0 || (!all && n < w.opts.MaxBatchSize) {
+				continue
+			}
+			if n > w.opts.MaxBatchSize {
+				n = w.opts.MaxBatchSize
+			}
+
+			schemaId = id
+			batch = make([]AnodotMetrics30, n)
+			copy(batch, b.metrics[:n])
+			b.metrics = append(b.metrics[:0], b.metrics[n:]...)
+			w.buffered -= n
+			break
+		}
+		w.mu.Unlock()
+
+		if batch == nil {
+			return
+		}
+
+		w.deliver(schemaId, batch)
+	}
+}
+
+// deliver submits batch, or stores it in the queue if older batches are still waiting
+// there or delivery fails temporarily. Only metrics which were not delivered are queued.
+func (w *MetricsWriter) deliver(schemaId string, batch []AnodotMetrics30) {
+	q := w.opts.Queue
+	if q != nil && q.Len() > 0 && pushBatch(q, batch) == nil {
+		return
+	}
+
+	result := w.submit(schemaId, batch)
+	if q != nil && result.Err != nil {
+		retry := result.retryable()
+		if len(retry) > 0 && pushBatch(q, retry) == nil {
+			if len(retry) == len(batch) {
+				// reported once delivered
+				return
+			}
+			result.Queued = retry
+		}
+	}
+	w.report(result)
+}
+
+// replay resends queued batches oldest first, until the queue is empty or delivery fails temporarily.
+// Metrics of partly delivered batch which failed temporarily are queued again at the end.
+func (w *MetricsWriter) replay() {
+	q := w.opts.Queue
+	if q == nil {
+		return
+	}
+
+	err := q.Replay(func(data []byte) bool {
+		var batch []AnodotMetrics30
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&batch); err != nil || len(batch) == 0 {
+			w.report(WriterResult{Err: errors.New("could not decode queued metrics batch")})
+			return true
+		}
+
+		result := w.submit(batch[0].SchemaId, batch)
+		if retry := result.retryable(); len(retry) > 0 {
+			if len(retry) == len(batch) {
+				return false
+			}
+			// requeue failed part of the batch only, before the batch is removed
+			if err := pushBatch(q, retry); err != nil {
+				w.report(WriterResult{Err: err})
+				return false
+			}
+			result.Queued = retry
+		}
+		w.report(result)
+		return true
+	})
+	if err != nil {
+		w.report(WriterResult{Err: err})
+	}
+}
+
+func (w *MetricsWriter) submit(schemaId string, batch []AnodotMetrics30) WriterResult {
+	result := WriterResult{SchemaId: schemaId, Metrics: batch}
+	resp, err := w.submitter.SubmitMetrics(batch)
+	if resp != nil {
+		result.Response = resp
+	}
+	result.Err = err
+	return result
+}
+
+// retryable returns metrics of the batch which failed temporarily.
+func (r WriterResult) retryable() []AnodotMetrics30 {
+	if r.Err == nil {
+		return nil
+	}
+	resp, _ := r.Response.(*SubmitMetricsResponse)
+	return NewSubmitResult(r.Metrics, resp, r.Err).retryable()
+}
+
+func pushBatch(q *diskqueue.Queue, batch []AnodotMetrics30) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(batch); err != nil {
+		return err
+	}
+	return q.Push(buf.Bytes())
+}
+
+// sendWatermarks submits watermark for every schema whose bucket was closed since the last watermark.
+func (w *MetricsWriter) sendWatermarks() {
+	type pending struct {
+		schemaId  string
+		watermark time.Time
+	}
+
+	if w.opts.Queue != nil && w.opts.Queue.Len() > 0 {
+		return
+	}
+
+	now := w.now()
+
+	w.mu.Lock()
+	var due []pending
+	for id, b := range w.schemas {
+		wm := now.Add(-w.opts.WatermarkDelay).Truncate(b.interval)
+		if wm.After(b.watermark) {
+			due = append(due, pending{id, wm})
+		}
+	}
+	w.mu.Unlock()
+
+	for _, p := range due {
+		wm := AnodotTimestamp{p.watermark}
+		result := WriterResult{SchemaId: p.schemaId, Watermark: &wm}
+		resp, err := w.submitter.SubmitWatermark(p.schemaId, wm)
+		if resp != nil {
+			result.Response = resp
+		}
+		result.Err = err
+
+		if err == nil {
+			w.mu.Lock()
+			w.schemas[p.schemaId].watermark = p.watermark
+			w.mu.Unlock()
+		}
+		w.report(result)
+	}
+}
+
+func (w *MetricsWriter) report(r WriterResult) {
+	if w.opts.DeadLetter != nil && r.Err != nil && len(r.Metrics) > 0 {
+		resp, _ := r.Response.(*SubmitMetricsResponse)
+		result := NewSubmitResult(r.Metrics, resp, r.Err)
+		records := append(result.DeadLetterRecords(time.Now()), result.failedRecords(time.Now())...)
+		if len(records) > 0 {
+			r.DeadLetterErr = w.opts.DeadLetter.Write(records)
+		}
+	}
+	if w.opts.OnResult != nil {
+		w.opts.OnResult(r)
+	}
+}
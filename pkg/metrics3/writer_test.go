@@ -0,0 +1,276 @@
+package metrics3
+
+import (
+	"errors"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anodot/anodot-common/pkg/deadletter"
+	"github.com/anodot/anodot-common/pkg/diskqueue"
+)
+
+type recordingSubmitter struct {
+	mu         sync.Mutex
+	metrics    map[string]int
+	watermarks map[string][]time.Time
+	// returned by SubmitMetrics instead of recording metrics when set
+	err error
+}
+
+func newRecordingSubmitter() *recordingSubmitter {
+	return &recordingSubmitter{metrics: map[string]int{}, watermarks: map[string][]time.Time{}}
+}
+
+func (s *recordingSubmitter) SubmitMetrics(metrics []AnodotMetrics30) (*SubmitMetricsResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	for _, m := range metrics {
+		s.metrics[m.SchemaId]++
+	}
+	return &SubmitMetricsResponse{}, nil
+}
+
+func (s *recordingSubmitter) SubmitWatermark(schemaId string, watermark AnodotTimestamp) (*SubmitWatermarkResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.watermarks[schemaId] = append(s.watermarks[schemaId], watermark.Time)
+	return &SubmitWatermarkResponse{}, nil
+}
+
+func TestMetricsWriterWatermarks(t *testing.T) {
+	var mu sync.Mutex
+	now := time.Date(2020, 5, 1, 10, 30, 0, 0, time.UTC)
+	clock := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+
+	rs := newRecordingSubmitter()
+	w, err := newMetricsWriter(rs, WriterOptions{
+		FlushInterval:  time.Hour,
+		Intervals:      map[string]time.Duration{"5m": 5 * time.Minute},
+		WatermarkDelay: time.Minute,
+	}, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := AnodotTimestamp{now}
+	if err := w.Write(
+		AnodotMetrics30{SchemaId: "1h", Timestamp: ts},
+		AnodotMetrics30{SchemaId: "5m", Timestamp: ts},
+		AnodotMetrics30{SchemaId: "5m", Timestamp: ts},
+	); err != nil {
+		t.Fatal(err)
+	}
+	w.Flush()
+
+	mu.Lock()
+	now = now.Add(6 * time.Minute)
+	mu.Unlock()
+	w.Flush()
+
+	mu.Lock()
+	now = time.Date(2020, 5, 1, 11, 2, 0, 0, time.UTC)
+	mu.Unlock()
+	w.Flush()
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if rs.metrics["1h"] != 1 || rs.metrics["5m"] != 2 {
+		t.Fatalf("unexpected submitted metrics: %v", rs.metrics)
+	}
+
+	// No watermarks for buckets before the first metric.
+	expected := map[string][]time.Time{
+		"1h": {time.Date(2020, 5, 1, 11, 0, 0, 0, time.UTC)},
+		"5m": {time.Date(2020, 5, 1, 10, 35, 0, 0, time.UTC), time.Date(2020, 5, 1, 11, 0, 0, 0, time.UTC)},
+	}
+	for id, want := range expected {
+		got := rs.watermarks[id]
+		if len(got) != len(want) {
+			t.Fatalf("schema %s: expected watermarks %v, got %v", id, want, got)
+		}
+		for i := range want {
+			if !got[i].Equal(want[i]) {
+				t.Fatalf("schema %s: expected watermarks %v, got %v", id, want, got)
+			}
+		}
+	}
+}
+
+func TestMetricsWriterBatches(t *testing.T) {
+	rs := newRecordingSubmitter()
+	results := make(chan WriterResult, 10)
+
+	w, err := NewMetricsWriter(rs, WriterOptions{MaxBatchSize: 2, BufferSize: 4, FlushInterval: time.Hour, OnResult: func(r WriterResult) {
+		if r.Metrics != nil {
+			results <- r
+		}
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if err := w.Write(AnodotMetrics30{}); err == nil {
+		t.Fatal("expected error for metrics without schema id")
+	}
+
+	m := AnodotMetrics30{SchemaId: "s1"}
+	if err := w.Write(m, m, m, m, m); err != ErrBufferFull {
+		t.Fatalf("expected ErrBufferFull, got %v", err)
+	}
+	if err := w.Write(m, m); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case r := <-results:
+		if r.SchemaId != "s1" || len(r.Metrics) != 2 || r.Err != nil {
+			t.Fatalf("unexpected result %+v", r)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("full batch was not submitted")
+	}
+}
+
+func TestMetricsWriterQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "writerqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := diskqueue.Open(diskqueue.Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	rs := newRecordingSubmitter()
+	rs.err = &url.Error{Op: "Post", URL: "http://localhost", Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}}
+
+	now := time.Date(2020, 5, 1, 10, 30, 0, 0, time.UTC)
+	w, err := newMetricsWriter(rs, WriterOptions{FlushInterval: time.Hour, Queue: q}, func() time.Time { return now })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if err := w.Write(AnodotMetrics30{SchemaId: "1h", Timestamp: AnodotTimestamp{now.Add(-time.Hour)}}); err != nil {
+		t.Fatal(err)
+	}
+	w.Flush()
+
+	rs.mu.Lock()
+	if q.Len() != 1 || len(rs.watermarks["1h"]) != 0 {
+		t.Fatalf("expected batch to be queued and watermark held back, got %d queued, watermarks %v", q.Len(), rs.watermarks)
+	}
+	rs.err = nil
+	rs.mu.Unlock()
+
+	w.Flush()
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if q.Len() != 0 || rs.metrics["1h"] != 1 || len(rs.watermarks["1h"]) != 1 {
+		t.Fatalf("expected queued batch and watermark to be sent, got %d queued, metrics %v, watermarks %v", q.Len(), rs.metrics, rs.watermarks)
+	}
+}
+
+func TestMetricsWriterQueueDropsPermanentFailures(t *testing.T) {
+	var mu sync.Mutex
+	var metricCalls, watermarkCalls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		if strings.HasSuffix(r.URL.Path, "/watermark") {
+			watermarkCalls++
+		} else {
+			metricCalls++
+		}
+		mu.Unlock()
+		w.Write([]byte(`{"errors":[]}`))
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	token := "token"
+	c, err := NewAnodot30Client(*u, nil, &token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "writerqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := diskqueue.Open(diskqueue.Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	now := time.Date(2020, 5, 1, 10, 30, 0, 0, time.UTC)
+	ts := AnodotTimestamp{now.Add(-time.Hour)}
+	// NaN measurement can't be encoded as JSON, neither queued nor fresh batch may block the others
+	unencodable := AnodotMetrics30{SchemaId: "1h", Timestamp: ts, Measurements: map[string]float64{"value": math.NaN()}}
+	if err := pushBatch(q, []AnodotMetrics30{unencodable}); err != nil {
+		t.Fatal(err)
+	}
+
+	var results []WriterResult
+	var records []deadletter.Record
+	w, err := newMetricsWriter(c, WriterOptions{
+		MaxBatchSize:  1,
+		FlushInterval: time.Hour,
+		OnResult:      func(r WriterResult) { results = append(results, r) },
+		Queue:         q,
+		DeadLetter: deadletter.SinkFunc(func(r []deadletter.Record) error {
+			records = append(records, r...)
+			return nil
+		}),
+	}, func() time.Time { return now })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	w.Write(unencodable)
+	w.Write(AnodotMetrics30{SchemaId: "1h", Timestamp: ts, Measurements: map[string]float64{"value": 1}})
+	w.Flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if q.Len() != 0 {
+		t.Fatalf("expected queue to be drained, %d batches left", q.Len())
+	}
+	if metricCalls != 1 || watermarkCalls != 1 {
+		t.Fatalf("expected valid batch and watermark to be sent, got %d metrics and %d watermark requests", metricCalls, watermarkCalls)
+	}
+	failed := 0
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+		}
+	}
+	if failed != 2 || len(records) != 2 {
+		t.Fatalf("expected unencodable batches to be reported and dead-lettered, got %d failed results and %d records", failed, len(records))
+	}
+}
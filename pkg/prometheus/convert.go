@@ -0,0 +1,57 @@
+package prometheus
+
+import (
+	"math"
+	"strings"
+	"time"
+
+	"github.com/anodot/anodot-common/pkg/metrics"
+)
+
+// Target type of all converted samples, see package doc.
+const targetGauge = "gauge"
+
+// Convert turns every sample of the families into Anodot 2.0 metric. Sample name becomes the "what"
+// property, labels become properties, and "target_type" is set to "gauge", cumulative samples
+// included.
+//
+// Samples without timestamp get now. NaN and infinite values, _created samples and labels
+// with empty value are skipped. Labels named "what" or "target_type" are renamed to
+// "label_what" and "label_target_type".
+func Convert(families []Family, now time.Time) []metrics.Anodot20Metric {
+	var result []metrics.Anodot20Metric
+
+	for _, f := range families {
+		for _, s := range f.Samples {
+			if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) || (strings.HasSuffix(s.Name, "_created") && s.Name != f.Name) {
+				continue
+			}
+
+			props := make(map[string]string, len(s.Labels)+2)
+			for k, v := range s.Labels {
+				if v == "" {
+					continue
+				}
+				if k == "what" || k == "target_type" {
+					k = "label_" + k
+				}
+				props[k] = v
+			}
+			props["what"] = s.Name
+			props["target_type"] = targetGauge
+
+			ts := s.Timestamp
+			if ts.IsZero() {
+				ts = now
+			}
+
+			result = append(result, metrics.Anodot20Metric{
+				Properties: props,
+				Timestamp:  metrics.AnodotTimestamp{Time: ts},
+				Value:      s.Value,
+			})
+		}
+	}
+
+	return result
+}
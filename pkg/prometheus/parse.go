@@ -0,0 +1,269 @@
+// Package prometheus converts metrics exposed in Prometheus text or OpenMetrics format
+// to Anodot 2.0 metrics and submits them with metrics.Submitter.
+//
+// All samples are sent with target_type "gauge". Counters, histogram buckets and _count and
+// _sum samples hold cumulative values, and Anodot sums values of "counter" target type within
+// a bucket, which would inflate them. Rate of a cumulative sample can be derived in Anodot.
+package prometheus
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Metric types as declared by "# TYPE" lines.
+const (
+	TypeCounter        = "counter"
+	TypeGauge          = "gauge"
+	TypeHistogram      = "histogram"
+	TypeGaugeHistogram = "gaugehistogram"
+	TypeSummary        = "summary"
+	TypeInfo           = "info"
+	TypeStateSet       = "stateset"
+	TypeUntyped        = "untyped"
+	TypeUnknown        = "unknown"
+)
+
+// Family is a group of samples sharing metric name, type and help.
+type Family struct {
+	Name    string
+	Type    string
+	Help    string
+	Samples []Sample
+}
+
+// Sample is a single exposed series value. Name includes type specific suffix, like _bucket or _total.
+type Sample struct {
+	Name   string
+	Labels map[string]string
+	Value  float64
+	// Zero if sample has no timestamp.
+	Timestamp time.Time
+}
+
+// sample name suffixes which belong to the family without them
+var familySuffixes = map[string][]string{
+	TypeCounter:        {"_total", "_created"},
+	TypeHistogram:      {"_bucket", "_count", "_sum", "_created"},
+	TypeGaugeHistogram: {"_bucket", "_gcount", "_gsum"},
+	TypeSummary:        {"_count", "_sum", "_created"},
+	TypeInfo:           {"_info"},
+}
+
+// Parse parses Prometheus text exposition format. Sample timestamps are in milliseconds.
+func Parse(r io.Reader) ([]Family, error) {
+	return parse(r, false)
+}
+
+// ParseOpenMetrics parses OpenMetrics text format. Sample timestamps are in seconds,
+// exemplars are ignored and parsing stops at "# EOF".
+func ParseOpenMetrics(r io.Reader) ([]Family, error) {
+	return parse(r, true)
+}
+
+func parse(r io.Reader, openMetrics bool) ([]Family, error) {
+	var families []*Family
+	byName := make(map[string]*Family)
+
+	family := func(name string) *Family {
+		f, ok := byName[name]
+		if !ok {
+			f = &Family{Name: name, Type: TypeUntyped}
+			byName[name] = f
+			families = append(families, f)
+		}
+		return f
+	}
+
+	var current *Family
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "#") {
+			fields := strings.Fields(line[1:])
+			if len(fields) == 1 && fields[0] == "EOF" && openMetrics {
+				break
+			}
+			if len(fields) < 3 || (fields[0] != "TYPE" && fields[0] != "HELP") {
+				continue
+			}
+
+			current = family(fields[1])
+			if fields[0] == "TYPE" {
+				current.Type = strings.ToLower(fields[2])
+			} else {
+				help := strings.TrimSpace(line[1:])
+				help = strings.TrimSpace(strings.TrimPrefix(help, "HELP"))
+				current.Help = strings.TrimSpace(strings.TrimPrefix(help, fields[1]))
+			}
+			continue
+		}
+
+		s, err := parseSample(line, openMetrics)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNum, err)
+		}
+
+		if current == nil || !belongsTo(s.Name, current) {
+			current = family(s.Name)
+		}
+		current.Samples = append(current.Samples, s)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	result := make([]Family, len(families))
+	for i, f := range families {
+		result[i] = *f
+	}
+	return result, nil
+}
+
+func belongsTo(sampleName string, f *Family) bool {
+	if sampleName == f.Name {
+		return true
+	}
+	for _, suffix := range familySuffixes[f.Type] {
+		if sampleName == f.Name+suffix {
+			return true
+		}
+	}
+	return false
+}
+
+func parseSample(line string, openMetrics bool) (Sample, error) {
+	s := Sample{Labels: map[string]string{}}
+
+	end := strings.IndexAny(line, "{ \t")
+	if end <= 0 {
+		return s, fmt.Errorf("invalid sample %q", line)
+	}
+	s.Name = line[:end]
+	rest := line[end:]
+
+	if rest[0] == '{' {
+		n, err := parseLabels(rest, s.Labels)
+		if err != nil {
+			return s, err
+		}
+		rest = rest[n:]
+	}
+
+	if openMetrics {
+		// drop exemplar
+		if i := strings.Index(rest, " # "); i >= 0 {
+			rest = rest[:i]
+		}
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) == 0 || len(fields) > 2 {
+		return s, fmt.Errorf("invalid sample %q", line)
+	}
+
+	v, err := parseFloat(fields[0])
+	if err != nil {
+		return s, fmt.Errorf("invalid value of %s: %v", s.Name, err)
+	}
+	s.Value = v
+
+	if len(fields) == 2 {
+		if openMetrics {
+			ts, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil {
+				return s, fmt.Errorf("invalid timestamp of %s: %v", s.Name, err)
+			}
+			sec, frac := math.Modf(ts)
+			s.Timestamp = time.Unix(int64(sec), int64(frac*1e9))
+		} else {
+			ms, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return s, fmt.Errorf("invalid timestamp of %s: %v", s.Name, err)
+			}
+			s.Timestamp = time.Unix(0, ms*int64(time.Millisecond))
+		}
+	}
+
+	return s, nil
+}
+
+// parseLabels parses label set starting with '{' and returns number of bytes consumed.
+func parseLabels(s string, labels map[string]string) (int, error) {
+	i := 1
+	for {
+		for i < len(s) && (s[i] == ' ' || s[i] == ',') {
+			i++
+		}
+		if i >= len(s) {
+			return 0, fmt.Errorf("unterminated label set in %q", s)
+		}
+		if s[i] == '}' {
+			return i + 1, nil
+		}
+
+		eq := strings.IndexByte(s[i:], '=')
+		if eq < 0 {
+			return 0, fmt.Errorf("invalid label in %q", s)
+		}
+		name := strings.TrimSpace(s[i : i+eq])
+		i += eq + 1
+		for i < len(s) && s[i] == ' ' {
+			i++
+		}
+		if i >= len(s) || s[i] != '"' {
+			return 0, fmt.Errorf("label %s value should be quoted", name)
+		}
+		i++
+
+		var value strings.Builder
+		for {
+			if i >= len(s) {
+				return 0, fmt.Errorf("unterminated value of label %s", name)
+			}
+			c := s[i]
+			if c == '"' {
+				i++
+				break
+			}
+			if c == '\\' && i+1 < len(s) {
+				i++
+				switch s[i] {
+				case 'n':
+					value.WriteByte('\n')
+				default:
+					value.WriteByte(s[i])
+				}
+			} else {
+				value.WriteByte(c)
+			}
+			i++
+		}
+		labels[name] = value.String()
+	}
+}
+
+func parseFloat(s string) (float64, error) {
+	switch s {
+	case "+Inf", "Inf":
+		return math.Inf(1), nil
+	case "-Inf":
+		return math.Inf(-1), nil
+	case "NaN":
+		return math.NaN(), nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
@@ -0,0 +1,144 @@
+package prometheus
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const promText = `# HELP http_requests_total Total requests.
+# TYPE http_requests_total counter
+http_requests_total{method="post",code="200"} 1027 1395066363000
+http_requests_total{method="post",code="400"}    3 1395066363000
+
+# TYPE temperature gauge
+temperature{room="a \"big\" one",what="cpu"} 21.5
+temperature{room="empty"} NaN
+
+# HELP rpc_duration_seconds RPC latency.
+# TYPE rpc_duration_seconds histogram
+rpc_duration_seconds_bucket{le="0.1"} 2
+rpc_duration_seconds_bucket{le="+Inf"} 5
+rpc_duration_seconds_sum 1.7
+rpc_duration_seconds_count 5
+
+# TYPE gc_pause summary
+gc_pause{quantile="0.5"} 0.01
+gc_pause_sum 3
+gc_pause_count 100
+untyped_metric 7
+`
+
+const openMetricsText = `# TYPE jobs counter
+# HELP jobs Processed jobs.
+jobs_total{queue="fast"} 10 1520879607.789 # {trace_id="abc"} 1.0
+jobs_created{queue="fast"} 1520430000
+# EOF
+ignored 1
+`
+
+func TestParse(t *testing.T) {
+	families, err := Parse(strings.NewReader(promText))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		name, typ string
+		samples   int
+	}{
+		{"http_requests_total", TypeCounter, 2},
+		{"temperature", TypeGauge, 2},
+		{"rpc_duration_seconds", TypeHistogram, 4},
+		{"gc_pause", TypeSummary, 3},
+		{"untyped_metric", TypeUntyped, 1},
+	}
+	if len(families) != len(expected) {
+		t.Fatalf("expected %d families, got %d: %+v", len(expected), len(families), families)
+	}
+	for i, e := range expected {
+		f := families[i]
+		if f.Name != e.name || f.Type != e.typ || len(f.Samples) != e.samples {
+			t.Fatalf("family %d: expected %s %s with %d samples, got %s %s with %d", i, e.name, e.typ, e.samples, f.Name, f.Type, len(f.Samples))
+		}
+	}
+
+	if families[0].Help != "Total requests." {
+		t.Fatalf("unexpected help %q", families[0].Help)
+	}
+	s := families[0].Samples[0]
+	if s.Value != 1027 || s.Labels["code"] != "200" || !s.Timestamp.Equal(time.Unix(1395066363, 0)) {
+		t.Fatalf("unexpected sample %+v", s)
+	}
+	if room := families[1].Samples[0].Labels["room"]; room != `a "big" one` {
+		t.Fatalf("unexpected escaped label value %q", room)
+	}
+}
+
+func TestParseOpenMetrics(t *testing.T) {
+	families, err := ParseOpenMetrics(strings.NewReader(openMetricsText))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) != 1 || families[0].Name != "jobs" || len(families[0].Samples) != 2 {
+		t.Fatalf("unexpected families %+v", families)
+	}
+
+	s := families[0].Samples[0]
+	if s.Name != "jobs_total" || s.Value != 10 || s.Timestamp.Unix() != 1520879607 {
+		t.Fatalf("unexpected sample %+v", s)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, text := range []string{
+		"metric{label=\"x\" 1",
+		"metric{label=x} 1",
+		"metric abc",
+		"metric 1 2 3",
+	} {
+		if _, err := Parse(strings.NewReader(text)); err == nil {
+			t.Fatalf("expected error for %q", text)
+		}
+	}
+}
+
+func TestConvert(t *testing.T) {
+	families, err := Parse(strings.NewReader(promText))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	converted := Convert(families, now)
+
+	// NaN temperature is skipped
+	if len(converted) != 11 {
+		t.Fatalf("expected 11 metrics, got %d", len(converted))
+	}
+
+	targets := map[string]string{}
+	for _, m := range converted {
+		targets[m.Properties["what"]] = m.Properties["target_type"]
+	}
+	// cumulative samples are sent as gauges
+	expected := map[string]string{
+		"http_requests_total":         "gauge",
+		"temperature":                 "gauge",
+		"rpc_duration_seconds_bucket": "gauge",
+		"rpc_duration_seconds_count":  "gauge",
+		"gc_pause":                    "gauge",
+		"gc_pause_sum":                "gauge",
+		"untyped_metric":              "gauge",
+	}
+	for what, target := range expected {
+		if targets[what] != target {
+			t.Fatalf("expected %s target type %s, got %q", what, target, targets[what])
+		}
+	}
+
+	temp := converted[2]
+	if temp.Properties["label_what"] != "cpu" || temp.Properties["room"] != `a "big" one` || !temp.Timestamp.Equal(now) {
+		t.Fatalf("unexpected converted metric %+v", temp)
+	}
+}
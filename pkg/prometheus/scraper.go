@@ -0,0 +1,94 @@
+package prometheus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/anodot/anodot-common/pkg/metrics"
+)
+
+const acceptHeader = "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5,*/*;q=0.1"
+
+// Scraper reads metrics from Prometheus endpoint and submits them to Anodot.
+type Scraper struct {
+	// Prometheus endpoint, usually ending with /metrics.
+	Target    *url.URL
+	Submitter metrics.Submitter
+	// Properties added to every submitted metric, e.g. instance or job name.
+	// Sample labels with the same name take precedence.
+	Properties map[string]string
+
+	client *http.Client
+}
+
+// Constructs new Scraper. Default http client is used if httpClient is nil.
+func NewScraper(target url.URL, submitter metrics.Submitter, httpClient *http.Client) (*Scraper, error) {
+	if submitter == nil {
+		return nil, errors.New("submitter should not be nil")
+	}
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scrape target scheme %q", target.Scheme)
+	}
+
+	client := httpClient
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+
+	return &Scraper{Target: &target, Submitter: submitter, client: client}, nil
+}
+
+// Scrape fetches and parses the target metrics. Format is chosen by response content type.
+func (s *Scraper) Scrape(ctx context.Context) ([]Family, error) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, s.Target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Accept", acceptHeader)
+
+	resp, err := s.client.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		return nil, fmt.Errorf("scrape of %s%s failed: http status %d", s.Target.Host, s.Target.Path, resp.StatusCode)
+	}
+
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/openmetrics-text") {
+		return ParseOpenMetrics(resp.Body)
+	}
+	return Parse(resp.Body)
+}
+
+// ScrapeAndSubmit scrapes the target and submits converted metrics. Returns nil response if target has no metrics.
+func (s *Scraper) ScrapeAndSubmit(ctx context.Context) (metrics.AnodotResponse, error) {
+	families, err := s.Scrape(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	converted := Convert(families, time.Now())
+	if len(converted) == 0 {
+		return nil, nil
+	}
+
+	for _, m := range converted {
+		for k, v := range s.Properties {
+			if _, ok := m.Properties[k]; !ok {
+				m.Properties[k] = v
+			}
+		}
+	}
+
+	return s.Submitter.SubmitMetrics(converted)
+}
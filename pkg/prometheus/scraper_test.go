@@ -0,0 +1,62 @@
+package prometheus
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/anodot/anodot-common/pkg/metrics"
+)
+
+type recordingSubmitter struct {
+	metrics []metrics.Anodot20Metric
+}
+
+func (s *recordingSubmitter) SubmitMetrics(m []metrics.Anodot20Metric) (metrics.AnodotResponse, error) {
+	s.metrics = append(s.metrics, m...)
+	return &metrics.CreateResponse{}, nil
+}
+
+func (s *recordingSubmitter) AnodotURL() *url.URL {
+	return &url.URL{Scheme: "http", Host: "localhost"}
+}
+
+func TestScrapeAndSubmit(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/metrics" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+		_, _ = w.Write([]byte(openMetricsText))
+	}))
+	defer srv.Close()
+
+	target, _ := url.Parse(srv.URL + "/metrics")
+	rs := &recordingSubmitter{}
+	s, err := NewScraper(*target, rs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Properties = map[string]string{"instance": "host-1", "queue": "default"}
+
+	if _, err := s.ScrapeAndSubmit(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rs.metrics) != 1 {
+		t.Fatalf("expected single metric, got %+v", rs.metrics)
+	}
+	props := rs.metrics[0].Properties
+	if props["what"] != "jobs_total" || props["target_type"] != "gauge" || props["instance"] != "host-1" || props["queue"] != "fast" {
+		t.Fatalf("unexpected properties %v", props)
+	}
+
+	target.Path = "/missing"
+	s, _ = NewScraper(*target, rs, nil)
+	if _, err := s.ScrapeAndSubmit(context.Background()); err == nil {
+		t.Fatal("expected scrape error")
+	}
+}
@@ -0,0 +1,180 @@
+// Package ratelimit paces requests made by Anodot clients, so bursts of submissions
+// do not trigger throttling on the server side.
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// ErrLimited is returned by Limiter in fail fast mode when the request is over budget.
+var ErrLimited = errors.New("client rate limit exceeded")
+
+type Options struct {
+	// Maximum rate of requests. Zero means unlimited.
+	RequestsPerSecond float64
+	// Maximum rate of submitted metrics. Zero means unlimited.
+	MetricsPerSecond float64
+	// Number of requests and metrics which may be sent at once after idle period.
+	// Default to one second worth of the corresponding rate.
+	RequestBurst int
+	MetricBurst  int
+	// Maximum number of requests waiting for response at the same time. Zero means unlimited.
+	MaxInFlight int
+	// Return ErrLimited instead of waiting when a budget is exhausted.
+	FailFast bool
+}
+
+// Limiter enforces Options for all requests passing through it. Methods are safe for concurrent use,
+// nil Limiter does not limit anything.
+type Limiter struct {
+	opts     Options
+	requests *bucket
+	metrics  *bucket
+	inFlight chan struct{}
+}
+
+// Constructs new Limiter.
+func New(opts Options) (*Limiter, error) {
+	if opts.RequestsPerSecond < 0 || opts.MetricsPerSecond < 0 {
+		return nil, errors.New("rate should not be negative")
+	}
+	if opts.RequestBurst < 0 || opts.MetricBurst < 0 || opts.MaxInFlight < 0 {
+		return nil, errors.New("burst and in-flight limits should not be negative")
+	}
+
+	l := &Limiter{opts: opts}
+	if opts.RequestsPerSecond > 0 {
+		l.requests = newBucket(opts.RequestsPerSecond, opts.RequestBurst)
+	}
+	if opts.MetricsPerSecond > 0 {
+		l.metrics = newBucket(opts.MetricsPerSecond, opts.MetricBurst)
+	}
+	if opts.MaxInFlight > 0 {
+		l.inFlight = make(chan struct{}, opts.MaxInFlight)
+	}
+	return l, nil
+}
+
+// Acquire takes budget for one request carrying the given number of metrics, waiting until
+// it is available or ctx is done. Returned release function should be called once the request completes.
+func (l *Limiter) Acquire(ctx context.Context, metrics int) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	now := time.Now()
+	requestsWait, err := l.requests.reserve(now, 1, l.opts.FailFast)
+	if err != nil {
+		return nil, err
+	}
+	metricsWait, err := l.metrics.reserve(now, metrics, l.opts.FailFast)
+	if err != nil {
+		l.requests.cancel(1)
+		return nil, err
+	}
+
+	cancel := func() {
+		l.requests.cancel(1)
+		l.metrics.cancel(metrics)
+	}
+
+	if wait := maxDuration(requestsWait, metricsWait); wait > 0 {
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			cancel()
+			return nil, ctx.Err()
+		}
+	}
+
+	if l.inFlight == nil {
+		return func() {}, nil
+	}
+	if l.opts.FailFast {
+		select {
+		case l.inFlight <- struct{}{}:
+		default:
+			cancel()
+			return nil, ErrLimited
+		}
+	} else {
+		select {
+		case l.inFlight <- struct{}{}:
+		case <-ctx.Done():
+			cancel()
+			return nil, ctx.Err()
+		}
+	}
+
+	var once sync.Once
+	return func() { once.Do(func() { <-l.inFlight }) }, nil
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// bucket is a token bucket which may go into debt, so that waiting callers are served in order.
+type bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate float64, burst int) *bucket {
+	b := float64(burst)
+	if burst == 0 {
+		b = math.Max(1, math.Ceil(rate))
+	}
+	return &bucket{rate: rate, burst: b, tokens: b, last: time.Now()}
+}
+
+// reserve takes n tokens and returns how long the caller has to wait before using them.
+// In fail fast mode tokens are taken only if they are available now.
+func (b *bucket) reserve(now time.Time, n int, failFast bool) (time.Duration, error) {
+	if b == nil || n <= 0 {
+		return 0, nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if now.After(b.last) {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+
+	// requests larger than burst are allowed once the bucket is full
+	need := math.Min(float64(n), b.burst)
+	if failFast && b.tokens < need {
+		return 0, ErrLimited
+	}
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0, nil
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second)), nil
+}
+
+// cancel returns tokens of a reservation which was not used.
+func (b *bucket) cancel(n int) {
+	if b == nil || n <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = math.Min(b.burst, b.tokens+float64(n))
+}
@@ -0,0 +1,97 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFailFast(t *testing.T) {
+	l, err := New(Options{RequestsPerSecond: 1, MetricsPerSecond: 10, FailFast: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release, err := l.Acquire(context.Background(), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+
+	if _, err := l.Acquire(context.Background(), 1); err != ErrLimited {
+		t.Fatalf("expected request budget to be exhausted, got %v", err)
+	}
+}
+
+func TestMetricsBudgetFailFast(t *testing.T) {
+	l, _ := New(Options{MetricsPerSecond: 10, FailFast: true})
+
+	if _, err := l.Acquire(context.Background(), 8); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Acquire(context.Background(), 5); err != ErrLimited {
+		t.Fatalf("expected metrics budget to be exhausted, got %v", err)
+	}
+	// rejected request does not take budget
+	if _, err := l.Acquire(context.Background(), 2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWait(t *testing.T) {
+	l, _ := New(Options{RequestsPerSecond: 20, RequestBurst: 1})
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		release, err := l.Acquire(context.Background(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		release()
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Fatalf("expected requests to be paced, took %v", elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := l.Acquire(ctx, 0); err != context.DeadlineExceeded {
+		t.Fatalf("expected context error, got %v", err)
+	}
+}
+
+func TestMaxInFlight(t *testing.T) {
+	l, _ := New(Options{MaxInFlight: 1})
+
+	release, err := l.Acquire(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		r, err := l.Acquire(context.Background(), 0)
+		if err == nil {
+			r()
+		}
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("second request should wait for the first one")
+	case <-time.After(20 * time.Millisecond):
+	}
+	release()
+	release()
+	<-acquired
+}
+
+func TestNilLimiter(t *testing.T) {
+	var l *Limiter
+	release, err := l.Acquire(context.Background(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
@@ -0,0 +1,191 @@
+// Package retry implements retrying of Anodot API requests with exponential backoff.
+package retry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Policy describes how failed requests are retried.
+// Requests are retried on connection errors, 429 and 5xx (except 501) responses.
+type Policy struct {
+	// Maximum number of attempts, including the first one. Values less than 2 disable retries.
+	MaxAttempts int
+	// Delay before the first retry.
+	InitialInterval time.Duration
+	// Upper bound of the delay between attempts.
+	MaxInterval time.Duration
+	// Factor the delay is multiplied by after each attempt. Defaults to 2.
+	Multiplier float64
+	// Randomization factor in range [0, 1]. Every delay is picked randomly
+	// from [delay * (1 - Jitter), delay * (1 + Jitter)].
+	Jitter float64
+	// Maximum time spent on all attempts. Zero means no limit.
+	MaxElapsedTime time.Duration
+	// DELETE requests are not idempotent in Anodot API and are never retried unless set.
+	RetryDeletes bool
+	// Requests marked with NonIdempotent, e.g. schema creation, are never retried unless set.
+	RetryCreates bool
+}
+
+type nonIdempotentKey struct{}
+
+// NonIdempotent returns copy of req marked as not safe to repeat, e.g. POST creating a resource.
+// Do retries such requests only if Policy.RetryCreates is set.
+func NonIdempotent(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), nonIdempotentKey{}, true))
+}
+
+func isNonIdempotent(req *http.Request) bool {
+	v, _ := req.Context().Value(nonIdempotentKey{}).(bool)
+	return v
+}
+
+// Returns policy with 4 attempts, delays starting from 500ms up to 30s, 50% jitter
+// and 2 minutes elapsed time limit.
+func DefaultPolicy() *Policy {
+	return &Policy{
+		MaxAttempts:     4,
+		InitialInterval: 500 * time.Millisecond,
+		MaxInterval:     30 * time.Second,
+		Multiplier:      2,
+		Jitter:          0.5,
+		MaxElapsedTime:  2 * time.Minute,
+	}
+}
+
+// Backoff returns delay before retry number n, starting from 1, without jitter applied.
+func (p *Policy) Backoff(n int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier <= 0 {
+		multiplier = 2
+	}
+
+	d := float64(p.InitialInterval) * math.Pow(multiplier, float64(n-1))
+	if p.MaxInterval > 0 && d > float64(p.MaxInterval) {
+		return p.MaxInterval
+	}
+	return time.Duration(d)
+}
+
+func (p *Policy) jitter(d time.Duration) time.Duration {
+	if p.Jitter <= 0 {
+		return d
+	}
+	j := p.Jitter
+	if j > 1 {
+		j = 1
+	}
+	delta := j * float64(d)
+	return time.Duration(float64(d) - delta + rand.Float64()*2*delta)
+}
+
+// Retryable reports whether request which resulted in resp and err is safe to retry.
+func Retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return true
+		}
+		var netErr net.Error
+		return errors.As(err, &netErr)
+	}
+
+	if resp == nil {
+		return false
+	}
+
+	return resp.StatusCode == http.StatusTooManyRequests ||
+		(resp.StatusCode >= 500 && resp.StatusCode != http.StatusNotImplemented)
+}
+
+// RetryAfter returns delay requested by server in Retry-After header, either in seconds or as HTTP date.
+func RetryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if t, err := http.ParseTime(v); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+
+	return 0, false
+}
+
+// Do sends req using do and retries it according to the policy. Waiting between
+// attempts is interrupted when request context is done. Nil policy disables retries.
+//
+// Response and error of the last attempt are returned.
+func Do(p *Policy, req *http.Request, do func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	if p == nil || p.MaxAttempts < 2 || (req.Method == http.MethodDelete && !p.RetryDeletes) ||
+		(isNonIdempotent(req) && !p.RetryCreates) || (req.Body != nil && req.GetBody == nil) {
+		return do(req)
+	}
+
+	start := time.Now()
+	ctx := req.Context()
+
+	for attempt := 1; ; attempt++ {
+		r := req
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r = req.Clone(ctx)
+			r.Body = body
+		}
+
+		resp, err := do(r)
+		if attempt >= p.MaxAttempts || !Retryable(resp, err) || ctx.Err() != nil {
+			return resp, err
+		}
+
+		delay := p.jitter(p.Backoff(attempt))
+		if retryAfter, ok := RetryAfter(resp); ok && retryAfter > delay {
+			delay = retryAfter
+		}
+
+		if p.MaxElapsedTime > 0 && time.Since(start)+delay > p.MaxElapsedTime {
+			return resp, err
+		}
+
+		if resp != nil && resp.Body != nil {
+			_, _ = io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
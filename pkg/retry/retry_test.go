@@ -0,0 +1,135 @@
+package retry
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testPolicy() *Policy {
+	return &Policy{MaxAttempts: 3, InitialInterval: time.Millisecond, MaxInterval: 10 * time.Millisecond}
+}
+
+func TestDoRetriesWithBody(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if string(body) != "payload" {
+			t.Errorf("attempt %d: unexpected body %q", atomic.LoadInt32(&calls), body)
+		}
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, srv.URL, bytes.NewBufferString("payload"))
+	resp, err := Do(testPolicy(), req, http.DefaultClient.Do)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || calls != 3 {
+		t.Fatalf("expected success after 3 attempts, got status %d after %d", resp.StatusCode, calls)
+	}
+}
+
+func TestDoDoesNotRetry(t *testing.T) {
+	testData := []struct {
+		description string
+		method      string
+		status      int
+		policy      *Policy
+		create      bool
+		calls       int32
+	}{
+		{"bad request", http.MethodPost, http.StatusBadRequest, testPolicy(), false, 1},
+		{"not implemented", http.MethodPost, http.StatusNotImplemented, testPolicy(), false, 1},
+		{"delete", http.MethodDelete, http.StatusServiceUnavailable, testPolicy(), false, 1},
+		{"delete with opt-in", http.MethodDelete, http.StatusServiceUnavailable, &Policy{MaxAttempts: 2, RetryDeletes: true}, false, 2},
+		{"create", http.MethodPost, http.StatusServiceUnavailable, testPolicy(), true, 1},
+		{"create with opt-in", http.MethodPost, http.StatusServiceUnavailable, &Policy{MaxAttempts: 2, RetryCreates: true}, true, 2},
+		{"nil policy", http.MethodPost, http.StatusServiceUnavailable, nil, false, 1},
+		{"attempts exhausted", http.MethodPost, http.StatusTooManyRequests, testPolicy(), false, 3},
+	}
+
+	for _, v := range testData {
+		t.Run(v.description, func(t *testing.T) {
+			var calls int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&calls, 1)
+				w.WriteHeader(v.status)
+			}))
+			defer srv.Close()
+
+			req, _ := http.NewRequest(v.method, srv.URL, nil)
+			if v.create {
+				req = NonIdempotent(req)
+			}
+			resp, err := Do(v.policy, req, http.DefaultClient.Do)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != v.status {
+				t.Fatalf("expected status %d, got %d", v.status, resp.StatusCode)
+			}
+			if calls != v.calls {
+				t.Fatalf("expected %d attempts, got %d", v.calls, calls)
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	resp := &http.Response{Header: http.Header{}}
+	if _, ok := RetryAfter(resp); ok {
+		t.Fatal("expected no delay without header")
+	}
+
+	resp.Header.Set("Retry-After", "7")
+	if d, ok := RetryAfter(resp); !ok || d != 7*time.Second {
+		t.Fatalf("expected 7s, got %v", d)
+	}
+
+	resp.Header.Set("Retry-After", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	if d, ok := RetryAfter(resp); !ok || d <= 50*time.Second || d > time.Minute {
+		t.Fatalf("expected about a minute, got %v", d)
+	}
+}
+
+func TestElapsedTimeLimit(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	p := testPolicy()
+	p.MaxElapsedTime = time.Second
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	resp, err := Do(p, req, http.DefaultClient.Do)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusTooManyRequests || calls != 1 {
+		t.Fatalf("expected to give up after first attempt, got %d attempts", calls)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	p := &Policy{InitialInterval: time.Second, MaxInterval: 5 * time.Second}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second}
+	for i, want := range expected {
+		if got := p.Backoff(i + 1); got != want {
+			t.Fatalf("retry %d: expected %v, got %v", i+1, want, got)
+		}
+	}
+}
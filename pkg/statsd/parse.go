@@ -0,0 +1,130 @@
+// Package statsd implements StatsD UDP server which aggregates received metrics
+// and submits them to Anodot as Anodot 2.0 metrics.
+package statsd
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// StatsD metric types.
+const (
+	TypeCounter = "c"
+	TypeGauge   = "g"
+	TypeTimer   = "ms"
+	// Histogram and distribution are DogStatsD types aggregated the same way as timers.
+	TypeHistogram    = "h"
+	TypeDistribution = "d"
+	TypeSet          = "s"
+)
+
+// Sample is a single parsed StatsD line.
+type Sample struct {
+	Name string
+	Type string
+	// Numeric value. Not set for sets.
+	Value float64
+	// Raw value, used as set member.
+	RawValue string
+	// Gauge value prefixed with sign is applied as a change of the current value.
+	Delta      bool
+	SampleRate float64
+	Tags       map[string]string
+}
+
+// ParseLine parses line in StatsD format: <name>:<value>|<type>[|@<sample rate>][|#<tag>:<value>,...].
+// DogStatsD tags without value get value "true", other DogStatsD extensions, e.g. container id or
+// timestamp, are ignored.
+func ParseLine(line string) (Sample, error) {
+	s := Sample{SampleRate: 1}
+
+	colon := strings.IndexByte(line, ':')
+	if colon <= 0 {
+		return s, fmt.Errorf("invalid statsd line %q", line)
+	}
+	s.Name = line[:colon]
+
+	parts := strings.Split(line[colon+1:], "|")
+	if len(parts) < 2 {
+		return s, fmt.Errorf("metric %s has no type", s.Name)
+	}
+
+	s.RawValue = parts[0]
+	s.Type = parts[1]
+	switch s.Type {
+	case TypeCounter, TypeGauge, TypeTimer, TypeHistogram, TypeDistribution:
+		v, err := strconv.ParseFloat(s.RawValue, 64)
+		if err != nil {
+			return s, fmt.Errorf("invalid value of metric %s: %v", s.Name, err)
+		}
+		s.Value = v
+		s.Delta = s.Type == TypeGauge && (s.RawValue[0] == '+' || s.RawValue[0] == '-')
+	case TypeSet:
+		if s.RawValue == "" {
+			return s, fmt.Errorf("empty set member of metric %s", s.Name)
+		}
+	default:
+		return s, fmt.Errorf("unsupported type %q of metric %s", s.Type, s.Name)
+	}
+
+	for _, p := range parts[2:] {
+		switch {
+		case strings.HasPrefix(p, "@"):
+			rate, err := strconv.ParseFloat(p[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return s, fmt.Errorf("invalid sample rate %q of metric %s", p[1:], s.Name)
+			}
+			s.SampleRate = rate
+		case strings.HasPrefix(p, "#"):
+			s.Tags = parseTags(p[1:])
+		case p == "":
+		default:
+			// unknown DogStatsD extensions, e.g. container id (c:<id>) or timestamp (T<unix time>), are ignored
+			if !isExtension(p) {
+				return s, errors.New("invalid statsd line section " + p)
+			}
+		}
+	}
+
+	return s, nil
+}
+
+// isExtension reports whether line section is DogStatsD extension: lowercase name followed by
+// colon and value, or uppercase letter followed by value.
+func isExtension(p string) bool {
+	if len(p) < 2 {
+		return false
+	}
+	if p[0] >= 'A' && p[0] <= 'Z' {
+		return true
+	}
+
+	colon := strings.IndexByte(p, ':')
+	if colon <= 0 {
+		return false
+	}
+	for _, c := range p[:colon] {
+		if c < 'a' || c > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
+func parseTags(s string) map[string]string {
+	tags := make(map[string]string)
+	for _, t := range strings.Split(s, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		if i := strings.IndexByte(t, ':'); i > 0 {
+			tags[t[:i]] = t[i+1:]
+		} else {
+			tags[t] = "true"
+		}
+	}
+	return tags
+}
@@ -0,0 +1,45 @@
+package statsd
+
+import "testing"
+
+func TestParseLine(t *testing.T) {
+	s, err := ParseLine("page.views:3|c|@0.5|#env:prod,canary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Name != "page.views" || s.Type != TypeCounter || s.Value != 3 || s.SampleRate != 0.5 {
+		t.Fatalf("unexpected sample %+v", s)
+	}
+	if len(s.Tags) != 2 || s.Tags["env"] != "prod" || s.Tags["canary"] != "true" {
+		t.Fatalf("unexpected tags %v", s.Tags)
+	}
+
+	s, err = ParseLine("queue.size:-2|g")
+	if err != nil || !s.Delta || s.Value != -2 {
+		t.Fatalf("expected gauge delta, got %+v, %v", s, err)
+	}
+
+	s, err = ParseLine("users:alice|s")
+	if err != nil || s.RawValue != "alice" {
+		t.Fatalf("expected set member, got %+v, %v", s, err)
+	}
+
+	s, err = ParseLine("request.time:12|ms|@0.1|#env:prod|c:83c0a99c0a54c0c187f461c7980e9b57f3f6a8b0c918c8d93df19a9de6f3fe1d|T1656581400|card:low")
+	if err != nil || s.Value != 12 || s.SampleRate != 0.1 || s.Tags["env"] != "prod" {
+		t.Fatalf("expected DogStatsD extensions to be ignored, got %+v, %v", s, err)
+	}
+
+	for _, line := range []string{
+		"no-value",
+		"metric:1",
+		"metric:abc|c",
+		"metric:1|x",
+		"metric:1|c|@2",
+		"metric:1|c|x",
+		"metric:1|c|T",
+	} {
+		if _, err := ParseLine(line); err == nil {
+			t.Fatalf("expected error for %q", line)
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package statsd
+
+import (
+	"errors"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anodot/anodot-common/pkg/metrics"
+)
+
+type Options struct {
+	// How often aggregated metrics are submitted. Defaults to 10 seconds.
+	FlushInterval time.Duration
+	// Percentiles calculated for timers. Defaults to 90.
+	Percentiles []float64
+	// Properties added to every submitted metric. Tags with the same name take precedence.
+	Properties map[string]string
+	// Maximum size of received packet. Defaults to 65535.
+	MaxPacketSize int
+	// Called from the flushing goroutine after every submission.
+	OnResult func(metrics.BatchResult)
+	// Called for every line which could not be parsed.
+	OnParseError func(line string, err error)
+	// Called from the receiving goroutine when reading from the socket fails.
+	OnError func(err error)
+}
+
+type series struct {
+	name string
+	typ  string
+	tags map[string]string
+
+	// counter sum, or gauge value
+	value   float64
+	updated bool
+	// timer values, and their count and sum corrected by sample rate
+	values []float64
+	count  float64
+	sum    float64
+	set    map[string]struct{}
+}
+
+// Server receives StatsD metrics over UDP, aggregates them per flush interval and
+// submits the aggregates with the Submitter.
+//
+// Every series is submitted with "what" property set to metric name and its tags as properties.
+// Counters are submitted as sum of received values with target_type "counter", gauges as their last
+// value with target_type "gauge", and only if they were updated during the interval. Timers are
+// submitted as several metrics distinguished by "stat" property: count and sum with target_type
+// "counter", and mean, min, max and percentiles (p90, p99_9) with target_type "gauge".
+// Sets are submitted as number of unique members with target_type "gauge".
+type Server struct {
+	submitter metrics.Submitter
+	opts      Options
+	conn      net.PacketConn
+
+	mu     sync.Mutex
+	series map[string]*series
+	closed bool
+
+	flushes chan chan struct{}
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// Constructs new Server listening on UDP address addr, e.g. ":8125", and starts its goroutines.
+// Close should be called to release it.
+func NewServer(addr string, submitter metrics.Submitter, opts Options) (*Server, error) {
+	if submitter == nil {
+		return nil, errors.New("submitter should not be nil")
+	}
+
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = 10 * time.Second
+	}
+	if opts.Percentiles == nil {
+		opts.Percentiles = []float64{90}
+	}
+	for _, p := range opts.Percentiles {
+		if p <= 0 || p > 100 {
+			return nil, errors.New("percentiles should be in range (0, 100]")
+		}
+	}
+	if opts.MaxPacketSize <= 0 {
+		opts.MaxPacketSize = 65535
+	}
+
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		submitter: submitter,
+		opts:      opts,
+		conn:      conn,
+		series:    make(map[string]*series),
+		flushes:   make(chan chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	s.wg.Add(2)
+	go s.receive()
+	go s.run()
+
+	return s, nil
+}
+
+// Addr returns address the server listens on.
+func (s *Server) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Flush submits metrics aggregated so far and blocks until they are submitted.
+func (s *Server) Flush() {
+	ack := make(chan struct{})
+	select {
+	case s.flushes <- ack:
+		<-ack
+	case <-s.done:
+	}
+}
+
+// Close stops listening, submits metrics aggregated so far and waits for the server goroutines to finish.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errors.New("statsd server is closed")
+	}
+	s.closed = true
+	s.mu.Unlock()
+
+	close(s.done)
+	err := s.conn.Close()
+	s.wg.Wait()
+
+	return err
+}
+
+func (s *Server) receive() {
+	defer s.wg.Done()
+
+	buf := make([]byte, s.opts.MaxPacketSize)
+	var backoff time.Duration
+	for {
+		n, _, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			if s.opts.OnError != nil {
+				s.opts.OnError(err)
+			}
+
+			// back off so that persistent error does not spin the loop
+			backoff = nextBackoff(backoff)
+			timer := time.NewTimer(backoff)
+			select {
+			case <-s.done:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			continue
+		}
+		backoff = 0
+		s.handlePacket(string(buf[:n]))
+	}
+}
+
+// nextBackoff doubles the delay after receive error, from 5ms up to 1s.
+func nextBackoff(d time.Duration) time.Duration {
+	switch {
+	case d <= 0:
+		return 5 * time.Millisecond
+	case 2*d > time.Second:
+		return time.Second
+	default:
+		return 2 * d
+	}
+}
+
+func (s *Server) handlePacket(packet string) {
+	for _, line := range strings.Split(packet, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		sample, err := ParseLine(line)
+		if err != nil {
+			if s.opts.OnParseError != nil {
+				s.opts.OnParseError(line, err)
+			}
+			continue
+		}
+		s.add(sample)
+	}
+}
+
+func (s *Server) add(sample Sample) {
+	typ := sample.Type
+	if typ == TypeHistogram || typ == TypeDistribution {
+		typ = TypeTimer
+	}
+	key := seriesKey(sample.Name, typ, sample.Tags)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ser, ok := s.series[key]
+	if !ok {
+		ser = &series{name: sample.Name, typ: typ, tags: sample.Tags}
+		s.series[key] = ser
+	}
+	ser.updated = true
+
+	switch typ {
+	case TypeCounter:
+		ser.value += sample.Value / sample.SampleRate
+	case TypeGauge:
+		if sample.Delta {
+			ser.value += sample.Value
+		} else {
+			ser.value = sample.Value
+		}
+	case TypeTimer:
+		ser.values = append(ser.values, sample.Value)
+		ser.count += 1 / sample.SampleRate
+		ser.sum += sample.Value / sample.SampleRate
+	case TypeSet:
+		if ser.set == nil {
+			ser.set = make(map[string]struct{})
+		}
+		ser.set[sample.RawValue] = struct{}{}
+	}
+}
+
+func seriesKey(name, typ string, tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte('|')
+	b.WriteString(typ)
+	for _, k := range keys {
+		b.WriteByte('|')
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(tags[k])
+	}
+	return b.String()
+}
+
+func (s *Server) run() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.opts.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.flush(time.Now())
+		case ack := <-s.flushes:
+			s.flush(time.Now())
+			close(ack)
+		case <-s.done:
+			s.flush(time.Now())
+			return
+		}
+	}
+}
+
+// flush submits aggregates and resets them. Gauges keep their value so that later deltas apply to it.
+func (s *Server) flush(now time.Time) {
+	s.mu.Lock()
+	var result []metrics.Anodot20Metric
+	for key, ser := range s.series {
+		if !ser.updated {
+			continue
+		}
+		result = append(result, s.aggregate(ser, now)...)
+
+		if ser.typ == TypeGauge {
+			ser.updated = false
+		} else {
+			delete(s.series, key)
+		}
+	}
+	s.mu.Unlock()
+
+	if len(result) == 0 {
+		return
+	}
+
+	resp, err := s.submitter.SubmitMetrics(result)
+	if s.opts.OnResult != nil {
+		s.opts.OnResult(metrics.BatchResult{Metrics: result, Response: resp, Err: err})
+	}
+}
+
+func (s *Server) aggregate(ser *series, now time.Time) []metrics.Anodot20Metric {
+	metric := func(stat string, targetType string, value float64) metrics.Anodot20Metric {
+		props := make(map[string]string, len(s.opts.Properties)+len(ser.tags)+3)
+		for k, v := range s.opts.Properties {
+			props[k] = v
+		}
+		for k, v := range ser.tags {
+			if k == "what" || k == "target_type" || k == "stat" {
+				k = "tag_" + k
+			}
+			props[k] = v
+		}
+		props["what"] = ser.name
+		props["target_type"] = targetType
+		if stat != "" {
+			props["stat"] = stat
+		}
+		return metrics.Anodot20Metric{Properties: props, Timestamp: metrics.AnodotTimestamp{Time: now}, Value: value}
+	}
+
+	switch ser.typ {
+	case TypeCounter:
+		return []metrics.Anodot20Metric{metric("", "counter", ser.value)}
+	case TypeGauge:
+		return []metrics.Anodot20Metric{metric("", "gauge", ser.value)}
+	case TypeSet:
+		return []metrics.Anodot20Metric{metric("", "gauge", float64(len(ser.set)))}
+	}
+
+	values := ser.values
+	sort.Float64s(values)
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+
+	// count and sum estimate all values, including the ones not sent due to sampling
+	result := []metrics.Anodot20Metric{
+		metric("count", "counter", ser.count),
+		metric("sum", "counter", ser.sum),
+		metric("mean", "gauge", sum/float64(len(values))),
+		metric("min", "gauge", values[0]),
+		metric("max", "gauge", values[len(values)-1]),
+	}
+	for _, p := range s.opts.Percentiles {
+		rank := int(math.Ceil(p/100*float64(len(values)))) - 1
+		if rank < 0 {
+			rank = 0
+		}
+		stat := "p" + strings.Replace(strconv.FormatFloat(p, 'f', -1, 64), ".", "_", 1)
+		result = append(result, metric(stat, "gauge", values[rank]))
+	}
+	return result
+}
@@ -0,0 +1,160 @@
+package statsd
+
+import (
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/anodot/anodot-common/pkg/metrics"
+)
+
+type recordingSubmitter struct {
+	mu      sync.Mutex
+	metrics []metrics.Anodot20Metric
+}
+
+func (s *recordingSubmitter) SubmitMetrics(m []metrics.Anodot20Metric) (metrics.AnodotResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.metrics = append(s.metrics, m...)
+	return &metrics.CreateResponse{}, nil
+}
+
+func (s *recordingSubmitter) AnodotURL() *url.URL {
+	return &url.URL{Scheme: "http", Host: "localhost"}
+}
+
+// find returns value of submitted metric with the given properties
+func (s *recordingSubmitter) find(t *testing.T, props map[string]string) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+outer:
+	for _, m := range s.metrics {
+		for k, v := range props {
+			if m.Properties[k] != v {
+				continue outer
+			}
+		}
+		return m.Value
+	}
+	t.Fatalf("metric %v was not submitted", props)
+	return 0
+}
+
+func TestServerAggregation(t *testing.T) {
+	rs := &recordingSubmitter{}
+	s, err := NewServer("127.0.0.1:0", rs, Options{FlushInterval: time.Hour, Percentiles: []float64{50, 99.9}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.handlePacket("hits:1|c|#env:prod\nhits:2|c|@0.5|#env:prod\nhits:5|c|#env:dev\n" +
+		"temp:20|g\ntemp:+3|g\n" +
+		"latency:10|ms\nlatency:30|ms\nlatency:20|h\n" +
+		"sampled:10|ms|@0.5\nsampled:30|ms\n" +
+		"users:a|s\nusers:b|s\nusers:a|s\nbroken")
+	s.Flush()
+
+	checks := []struct {
+		props map[string]string
+		value float64
+	}{
+		{map[string]string{"what": "hits", "env": "prod", "target_type": "counter"}, 5},
+		{map[string]string{"what": "hits", "env": "dev"}, 5},
+		{map[string]string{"what": "temp", "target_type": "gauge"}, 23},
+		{map[string]string{"what": "latency", "stat": "count", "target_type": "counter"}, 3},
+		{map[string]string{"what": "latency", "stat": "mean", "target_type": "gauge"}, 20},
+		{map[string]string{"what": "latency", "stat": "max"}, 30},
+		{map[string]string{"what": "latency", "stat": "p50"}, 20},
+		{map[string]string{"what": "latency", "stat": "p99_9"}, 30},
+		{map[string]string{"what": "sampled", "stat": "count"}, 3},
+		{map[string]string{"what": "sampled", "stat": "sum"}, 50},
+		{map[string]string{"what": "sampled", "stat": "mean"}, 20},
+		{map[string]string{"what": "users"}, 2},
+	}
+	for _, c := range checks {
+		if v := rs.find(t, c.props); v != c.value {
+			t.Fatalf("metric %v: expected %v, got %v", c.props, c.value, v)
+		}
+	}
+
+	// only updated gauges are submitted, deltas apply to the last value
+	rs.metrics = nil
+	s.handlePacket("temp:-1|g")
+	s.Flush()
+	if len(rs.metrics) != 1 || rs.find(t, map[string]string{"what": "temp"}) != 22 {
+		t.Fatalf("expected single updated gauge, got %+v", rs.metrics)
+	}
+}
+
+func TestServerReceivesUDP(t *testing.T) {
+	rs := &recordingSubmitter{}
+	s, err := NewServer("127.0.0.1:0", rs, Options{FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("udp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := conn.Write([]byte("requests:1|c")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		s.mu.Lock()
+		received := len(s.series) > 0
+		s.mu.Unlock()
+		if received {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("packet was not received")
+		}
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if rs.find(t, map[string]string{"what": "requests"}) < 1 {
+		t.Fatal("expected received counter to be submitted on close")
+	}
+}
+
+func TestServerReceiveErrorBackoff(t *testing.T) {
+	var errs int32
+	s, err := NewServer("127.0.0.1:0", &recordingSubmitter{}, Options{FlushInterval: time.Hour, OnError: func(err error) {
+		atomic.AddInt32(&errs, 1)
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every read fails with timeout until the deadline is reset
+	if err := s.conn.SetReadDeadline(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	if n := atomic.LoadInt32(&errs); n == 0 || n > 20 {
+		t.Fatalf("expected receive errors to be reported with backoff, got %d errors", n)
+	}
+
+	start := time.Now()
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("close should interrupt backoff")
+	}
+}